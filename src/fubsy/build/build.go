@@ -5,13 +5,21 @@
 package build
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"os"
+	"sort"
 	"strings"
+	"syscall"
+	"time"
 
 	"fubsy/dag"
 	"fubsy/db"
+	"fubsy/dsl"
+	"fubsy/events"
 	"fubsy/log"
+	"fubsy/trace"
 )
 
 type stateset map[dag.NodeState]bool
@@ -21,6 +29,35 @@ type BuildState struct {
 	db           BuildDB
 	options      BuildOptions
 	changestates stateset
+
+	// if tracing: record how long it took to build each node (nil
+	// tracer means no tracing)
+	tracer  *trace.Tracer
+	timings map[dag.Node]time.Duration
+
+	// where to report build events (nil for nowhere), how many
+	// nodes have entered each state, and how many nodes we tried to
+	// build (for the summary event)
+	events    *events.Stream
+	counts    map[dag.NodeState]int
+	attempted int
+
+	// limits on how many rules of each kind can run at once (by name)
+	pools map[string]*Pool
+}
+
+// the trace lane for building nodes in a serial build; a parallel
+// build uses lanes 1 to options.Jobs, one for each job
+const jobLane = 1
+
+// the outcome of running one build rule in a parallel build
+type jobResult struct {
+	node    dag.Node
+	lane    int
+	pool    *Pool
+	span    *trace.Span
+	targets []dag.Node
+	errs    []error
 }
 
 // user options, typically from the command line
@@ -38,20 +75,90 @@ type BuildOptions struct {
 	// intermediate targets behind our back (default: check only
 	// original sources)
 	CheckAll bool
+
+	// run actions with only the environment variables declared by
+	// the build script (default: inherit Fubsy's entire environment)
+	Hermetic bool
+
+	// only build targets that depend on these files (e.g. the files
+	// modified by a pull request); nil means build every requested
+	// target, but an empty slice means nothing is affected
+	AffectedBy []string
+
+	// write a timing trace of the build to this file (in Chrome's
+	// Trace Event Format); "" for no trace
+	TraceFile string
+
+	// how many build rules to run at once (default: 1, i.e. a serial
+	// build)
+	Jobs int
 }
 
 type BuildError struct {
 	// nodes that failed to build
 	failed []dag.Node
 
+	// why they failed (all the errors returned by their build rules)
+	errors []error
+
 	// total number of nodes that we attempted to build
 	attempts int
 }
 
+// Error returned by a build rule when one of its actions fails (e.g.
+// a command exits with non-zero status). Has everything the user
+// might want to know about the failure.
+type ActionError struct {
+	// the command that failed, with all variables expanded
+	Command string
+
+	// the command's exit status; -1 if it was killed by a signal or
+	// could not be run at all
+	ExitStatus int
+
+	// the signal that killed the command (0 if none)
+	Signal syscall.Signal
+
+	// if non-zero, the command was killed because it ran for longer
+	// than this
+	Timeout time.Duration
+
+	// the targets of the failed build rule
+	Targets []dag.Node
+
+	// where that rule is defined (nil if unknown)
+	Location dsl.Location
+
+	// the underlying error (e.g. from package os/exec)
+	Err error
+}
+
 func NewBuildState(graph *dag.DAG, db BuildDB, options BuildOptions) *BuildState {
 	return &BuildState{graph: graph, db: db, options: options}
 }
 
+// Record the time spent building each node in tracer.
+func (self *BuildState) SetTracer(tracer *trace.Tracer) {
+	self.tracer = tracer
+	self.timings = make(map[dag.Node]time.Duration)
+	for lane := jobLane; lane <= self.jobs(); lane++ {
+		tracer.NameLane(lane, fmt.Sprintf("job %d", lane))
+	}
+}
+
+// Report the progress of the build to stream.
+func (self *BuildState) SetEvents(stream *events.Stream) {
+	self.events = stream
+}
+
+// Make pool available to build rules that ask for it by name.
+func (self *BuildState) AddPool(pool *Pool) {
+	if self.pools == nil {
+		self.pools = make(map[string]*Pool)
+	}
+	self.pools[pool.Name()] = pool
+}
+
 // The heart of Fubsy: do a depth-first walk of the dependency graph
 // to discover nodes in topological order, then (re)build nodes that
 // are stale or missing. Skip target nodes that are "tainted" by
@@ -63,52 +170,269 @@ func (self *BuildState) BuildTargets(targets *dag.NodeSet) error {
 	// What sort of nodes do we check for changes?
 	self.setChangeStates()
 	log.Debug(log.BUILD, "building %d targets", targets.Length())
+	start := time.Now()
+	self.counts = make(map[dag.NodeState]int)
+	self.attempted = 0
+	if self.events != nil {
+		names := []string{}
+		for _, node := range self.graph.NodesIn(targets) {
+			names = append(names, node.Name())
+		}
+		self.events.Emit("build_start", events.Fields{"targets": names})
+	}
 
 	builderr := new(BuildError)
+	var err error
+	span := self.tracer.Begin(0, "phase", "build targets")
+	if self.jobs() > 1 {
+		err = self.buildParallel(targets, builderr)
+	} else {
+		err = self.buildSerial(targets, builderr)
+	}
+	span.End()
+	if err == nil && len(builderr.failed) > 0 {
+		// build failures in keep-going mode
+		err = builderr
+	}
+	self.events.Emit("build_summary", events.Fields{
+		"ok":        err == nil,
+		"attempted": self.attempted,
+		"built":     self.counts[dag.BUILT],
+		"failed":    self.counts[dag.FAILED],
+		"tainted":   self.counts[dag.TAINTED],
+		"duration":  time.Since(start).Seconds(),
+	})
+	return err
+}
+
+// Build targets one node at a time, as the depth-first walk visits
+// them.
+func (self *BuildState) buildSerial(
+	targets *dag.NodeSet, builderr *BuildError) error {
 	visit := func(node dag.Node) error {
-		if node.State() == dag.SOURCE {
-			// can't build original source nodes!
-			return nil
+		build, err := self.visitNode(node)
+		if err != nil || !build {
+			return err
 		}
-		if node.BuildRule() == nil {
-			panic("node is a target, but has no build rule: " + node.Name())
+		rule := node.BuildRule()
+		span := self.startNode(node, jobLane, builderr)
+		var tnodes []dag.Node
+		var errs []error
+		pool, err := self.rulePool(rule)
+		if err != nil {
+			tnodes, errs = []dag.Node{node}, []error{err}
+		} else {
+			if pool != nil {
+				pool.Acquire()
+			}
+			tnodes, errs = self.executeRule(node, rule)
+			if pool != nil {
+				pool.Release()
+			}
 		}
+		return self.finishNode(node, span, tnodes, errs, builderr)
+	}
+	return self.graph.DFS(targets, visit)
+}
 
-		checkInitialState(node)
+// Build targets running up to options.Jobs build rules at once. Nodes
+// are visited in the same order as buildSerial() visits them, but
+// only once all of their parents are finished; a node that needs
+// building then waits for a free job, and for a free slot in its pool
+// (if any). Only executing build rules happens in other goroutines:
+// everything else, including every change to the state of a node,
+// happens here.
+func (self *BuildState) buildParallel(
+	targets *dag.NodeSet, builderr *BuildError) error {
+	order := []dag.Node{}
+	err := self.graph.DFS(targets, func(node dag.Node) error {
+		order = append(order, node)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
 
-		// do we need to build this node? can we?
-		build, tainted, err := self.considerNode(node)
-		log.Debug(log.BUILD, "node %s: build=%v, tainted=%v err=%v\n",
-			node, build, tainted, err)
-		if err != nil {
-			return err
+	// free trace lanes: one per job, so running out of lanes means
+	// every job is busy
+	lanes := make([]int, 0, self.jobs())
+	for lane := self.jobs(); lane >= jobLane; lane-- {
+		lanes = append(lanes, lane)
+	}
+	finished := make(map[dag.Node]bool)
+	ready := []dag.Node{} // visited, waiting for a job or pool slot
+	// rules with a target in ready or running: their other targets
+	// are not visited until the rule is finished, so it runs once
+	pending := make(map[dag.BuildRule]bool)
+	results := make(chan jobResult)
+	running := 0
+	stopped := false
+	for {
+		// Visit every node whose parents are finished. order is
+		// topological, so a node that needs no building lets its
+		// children be visited in the same pass.
+		waiting := order[:0]
+		for _, node := range order {
+			if stopped || pending[node.BuildRule()] ||
+				!self.parentsFinished(node, finished) {
+				waiting = append(waiting, node)
+				continue
+			}
+			build, verr := self.visitNode(node)
+			if verr != nil {
+				err = verr
+				stopped = true
+			} else if build {
+				ready = append(ready, node)
+				pending[node.BuildRule()] = true
+			} else {
+				finished[node] = true
+			}
 		}
+		order = waiting
 
-		if tainted {
-			node.SetState(dag.TAINTED)
-		} else if build {
-			ok := self.buildNode(node, builderr)
-			if !ok && !self.keepGoing() {
-				// attempts counter is not very useful when we break
-				// out of the build early
-				builderr.attempts = -1
-				return builderr
+		blocked := ready[:0]
+		for _, node := range ready {
+			if stopped || len(lanes) == 0 {
+				blocked = append(blocked, node)
+				continue
+			}
+			rule := node.BuildRule()
+			pool, perr := self.rulePool(rule)
+			if perr == nil && pool != nil && !pool.TryAcquire() {
+				blocked = append(blocked, node)
+				continue
 			}
-			if ok {
-				err = self.recordNode(node)
-				if err != nil {
-					return err
+			lane := lanes[len(lanes)-1]
+			lanes = lanes[:len(lanes)-1]
+			result := jobResult{node: node, lane: lane, pool: pool}
+			result.span = self.startNode(node, lane, builderr)
+			running++
+			go func(result jobResult, rule dag.BuildRule, perr error) {
+				if perr != nil {
+					result.targets = []dag.Node{result.node}
+					result.errs = []error{perr}
+				} else {
+					result.targets, result.errs =
+						self.executeRule(result.node, rule)
 				}
+				results <- result
+			}(result, rule, perr)
+		}
+		ready = blocked
+
+		if running == 0 {
+			break
+		}
+		result := <-results
+		running--
+		lanes = append(lanes, result.lane)
+		if result.pool != nil {
+			result.pool.Release()
+		}
+		finished[result.node] = true
+		delete(pending, result.node.BuildRule())
+		ferr := self.finishNode(
+			result.node, result.span, result.targets, result.errs, builderr)
+		if ferr != nil && !stopped {
+			// let the jobs that are already running finish, but
+			// don't start any more
+			err = ferr
+			stopped = true
+		}
+	}
+	if !stopped && len(order)+len(ready) > 0 {
+		panic(fmt.Sprintf(
+			"parallel build stalled with %d nodes unfinished",
+			len(order)+len(ready)))
+	}
+	return err
+}
+
+// Return true if every parent of node has been visited, and built if
+// it needed building.
+func (self *BuildState) parentsFinished(
+	node dag.Node, finished map[dag.Node]bool) bool {
+	for _, parent := range self.graph.ParentNodes(node) {
+		if !finished[parent] {
+			return false
+		}
+	}
+	return true
+}
+
+// Decide what to do with node, now that all of its parents have been
+// visited: return true if it should be built. Nodes that cannot be
+// built because of upstream failure are marked TAINTED here.
+func (self *BuildState) visitNode(node dag.Node) (bool, error) {
+	if node.State() == dag.SOURCE {
+		// can't build original source nodes!
+		return false, nil
+	}
+	if node.BuildRule() == nil {
+		panic("node is a target, but has no build rule: " + node.Name())
+	}
+	if state := node.State(); state == dag.BUILT || state == dag.FAILED {
+		// another target of the same rule: the rule already ran, so
+		// don't run it again
+		return false, nil
+	}
+
+	checkInitialState(node)
+
+	// do we need to build this node? can we?
+	build, tainted, reason, err := self.considerNode(node)
+	log.Debug(log.BUILD, "node %s: build=%v, tainted=%v reason=%s err=%v\n",
+		node, build, tainted, reason, err)
+	if err != nil {
+		return false, err
+	}
+	self.events.Emit("node_considered", events.Fields{
+		"node": node.Name(), "rebuild": build, "reason": reason})
+
+	if tainted {
+		self.setState(node, dag.TAINTED)
+		return false, nil
+	}
+	return build, nil
+}
+
+// Figure out which nodes BuildTargets() would rebuild, without
+// building anything: walk the ancestors of targets in topological
+// order and inspect each target node as considerNode() would. Since
+// nothing is actually rebuilt, a node whose parent is stale is
+// pessimistically assumed to be stale too. Returns the set of stale
+// nodes.
+func (self *BuildState) StaleTargets(targets *dag.NodeSet) (
+	map[dag.Node]bool, error) {
+	self.setChangeStates()
+	stale := make(map[dag.Node]bool)
+	visit := func(node dag.Node) error {
+		if node.State() == dag.SOURCE {
+			return nil
+		}
+		for _, parent := range self.graph.TrackedParentNodes(node) {
+			if stale[parent] {
+				stale[node] = true
+				return nil
 			}
 		}
+		if _, ok := node.(*dag.AliasNode); ok {
+			// always "built", but that's only interesting if one of
+			// its parents will actually be rebuilt
+			return nil
+		}
+		build, _, _, err := self.considerNode(node)
+		if err != nil {
+			return err
+		}
+		if build {
+			stale[node] = true
+		}
 		return nil
 	}
 	err := self.graph.DFS(targets, visit)
-	if err == nil && len(builderr.failed) > 0 {
-		// build failures in keep-going mode
-		err = builderr
-	}
-	return err
+	return stale, err
 }
 
 func (self *BuildState) setChangeStates() {
@@ -142,11 +466,13 @@ func checkInitialState(node dag.Node) {
 
 // Inspect node and its parents to see if we need to build it. Return
 // build=true if we should build it, tainted=true if we should skip
-// building this node due to upstream failure. Return non-nil err if
-// there were unexpected node errors (error checking existence or
-// change status).
+// building this node due to upstream failure, and a brief
+// explanation of either decision in reason (e.g. "missing", or
+// "parent changed: foo.c"). Return non-nil err if there were
+// unexpected node errors (error checking existence or change
+// status).
 func (self *BuildState) considerNode(node dag.Node) (
-	build bool, tainted bool, err error) {
+	build bool, tainted bool, reason string, err error) {
 
 	var exists, changed bool
 	exists, err = node.Exists() // obvious rebuild (unless tainted)
@@ -171,11 +497,23 @@ func (self *BuildState) considerNode(node dag.Node) (
 	}
 
 	build = missing
+	if missing {
+		reason = "missing"
+	}
 	parents := self.graph.ParentNodes(node)
 
+	// parents whose signature differs from the one recorded, but not
+	// in a way that counts as a change (e.g. a file touched but not
+	// modified in HYBRID mode)
+	var refreshed map[string][]byte
+
 	// Check if any of node's former parents have been removed.
+	// (Order-only parents are not recorded, so don't count them.)
 	if !build && record != nil {
-		build = parentsRemoved(parents, record)
+		build = parentsRemoved(self.graph.TrackedParentNodes(node), record)
+		if build {
+			reason = "parent removed"
+		}
 	}
 
 	for _, parent := range parents {
@@ -183,23 +521,31 @@ func (self *BuildState) considerNode(node dag.Node) (
 		if pstate == dag.FAILED || pstate == dag.TAINTED {
 			build = false
 			tainted = true
+			reason = "parent failed: " + parent.Name()
 			return // no further inspection required
 		}
+		if self.graph.IsOrderOnly(node, parent) {
+			// only matters for ordering (which DFS took care of) and
+			// upstream failure (just checked)
+			continue
+		}
 
 		var oldsig []byte
 		if record != nil {
 			oldsig = record.SourceSignature(parent.Name())
 		}
-		if oldsig == nil {
+		if oldsig == nil && !build {
 			// New parent for this node: rebuild unless another
 			// parent is failed/tainted.
 			build = true
+			reason = "new parent: " + parent.Name()
 		}
 
 		if build {
 			continue
 		}
-		changed, err = self.parentChanged(parent, pstate, oldsig)
+		var cursig []byte
+		changed, cursig, err = self.parentChanged(parent, pstate, oldsig)
 		if err != nil {
 			return
 		}
@@ -208,11 +554,41 @@ func (self *BuildState) considerNode(node dag.Node) (
 			// parents to make sure they don't taint this node with
 			// upstream failure.
 			build = true
+			reason = "parent changed: " + parent.Name()
+		} else if !bytes.Equal(cursig, oldsig) {
+			if refreshed == nil {
+				refreshed = make(map[string][]byte)
+			}
+			refreshed[parent.Name()] = cursig
+		}
+	}
+	if !build {
+		reason = "up to date"
+		if len(refreshed) > 0 {
+			err = self.refreshRecord(node, record, refreshed)
 		}
 	}
 	return
 }
 
+// Rewrite the build record of node, which is up to date, with the
+// current signatures of the parents in refreshed. Otherwise, a file
+// that was touched but not modified would be rehashed on every build
+// in HYBRID mode, since its recorded stat info is never current.
+func (self *BuildState) refreshRecord(
+	node dag.Node, record *db.BuildRecord, refreshed map[string][]byte) error {
+	newrecord := db.NewBuildRecord()
+	newrecord.SetTargetSignature(record.TargetSignature())
+	for _, name := range record.Parents() {
+		sig := refreshed[name]
+		if sig == nil {
+			sig = record.SourceSignature(name)
+		}
+		newrecord.AddParent(name, sig)
+	}
+	return self.db.WriteNode(node.Name(), newrecord)
+}
+
 func parentsRemoved(parents []dag.Node, record *db.BuildRecord) bool {
 	parentset := make(map[string]bool)
 	for _, parent := range parents {
@@ -226,9 +602,11 @@ func parentsRemoved(parents []dag.Node, record *db.BuildRecord) bool {
 	return false
 }
 
+// Return true if parent has changed since oldsig was recorded, along
+// with its current signature.
 func (self *BuildState) parentChanged(
 	parent dag.Node, pstate dag.NodeState, oldsig []byte) (
-	bool, error) {
+	bool, []byte, error) {
 
 	var cursig []byte
 	var err error
@@ -244,7 +622,7 @@ func (self *BuildState) parentChanged(
 		// for.
 		precord, err := self.db.LookupNode(parent.Name())
 		if err != nil {
-			return false, err
+			return false, nil, err
 		}
 		if precord != nil {
 			cursig = precord.TargetSignature()
@@ -252,55 +630,158 @@ func (self *BuildState) parentChanged(
 	}
 
 	if cursig == nil {
-		cursig, err = parent.Signature()
+		// Let the parent know what its signature was last time, in
+		// case that lets it avoid expensive work (e.g. rehashing a
+		// large file that has not been touched).
+		if hinter, ok := parent.(dag.SignatureHinter); ok && oldsig != nil {
+			hinter.SetSignatureHint(oldsig)
+		}
+		cursig, err = self.signature(parent)
 		if err != nil {
 			// This should not happen: parent should exist and be readable,
 			// since we've already visited it earlier in the build and we
 			// avoid looking at failed/tainted parents.
-			return false, err
+			return false, nil, err
 		}
 	}
 	changed := parent.Changed(cursig, oldsig)
 	//log.Verbose("parent %s: oldsig=%v, cursig=%v, changed=%v",
 	//	parent, oldsig, cursig, changed)
-	return changed, nil
+	return changed, cursig, nil
 }
 
-// Build the specified node (caller has determined that it should be
-// built and can be built). On failure, report the error (e.g. to the
-// console, a GUI window, ...) and return false. On success, return
-// true.
-func (self *BuildState) buildNode(node dag.Node, builderr *BuildError) bool {
+// Start building node (caller has determined that it should be built
+// and can be built), timing it in the trace lane for its job. Returns
+// the span for finishNode() to end.
+func (self *BuildState) startNode(
+	node dag.Node, lane int, builderr *BuildError) *trace.Span {
 	rule := node.BuildRule()
 	log.Verbose("building node %s, action=%s\n", node, rule.ActionString())
 	node.SetState(dag.BUILDING)
+	self.attempted++
 	builderr.attempts++
-	targets, errs := rule.Execute()
+	span := self.tracer.Begin(lane, "build", node.Name())
+	span.SetArg("action", rule.ActionString())
+	return span
+}
+
+// Finish building node, whose build rule returned targets and errs.
+// On failure, report the error (e.g. to the console, a GUI window,
+// ...) and return builderr, unless we should keep going. On success,
+// record the build in the database.
+func (self *BuildState) finishNode(
+	node dag.Node,
+	span *trace.Span,
+	targets []dag.Node,
+	errs []error,
+	builderr *BuildError) error {
+	duration := span.End()
+	if self.tracer != nil {
+		self.timings[node] = duration
+	}
 	if len(errs) > 0 {
 		// Normal, everyday build failure: report the precise problem
-		// immediately, and accumulate summary info in the caller.
+		// immediately, and accumulate summary info in builderr.
 		for _, tnode := range targets {
-			tnode.SetState(dag.FAILED)
+			self.setState(tnode, dag.FAILED)
 		}
 		self.reportFailure(errs)
-		builderr.addFailure(node)
-		return false
+		builderr.addFailure(node, errs)
+		if !self.keepGoing() {
+			// attempts counter is not very useful when we break out
+			// of the build early
+			builderr.attempts = -1
+			return builderr
+		}
+		return nil
 	}
 	for _, tnode := range targets {
-		tnode.SetState(dag.BUILT)
+		self.setState(tnode, dag.BUILT)
 	}
-	return true
+	return self.recordNode(node)
+}
+
+// Return the pool that rule must run in, or nil if it doesn't belong
+// to one.
+func (self *BuildState) rulePool(rule dag.BuildRule) (*Pool, error) {
+	pooled, ok := rule.(dag.PooledRule)
+	if !ok || pooled.Pool() == "" {
+		return nil, nil
+	}
+	pool := self.pools[pooled.Pool()]
+	if pool == nil {
+		return nil, fmt.Errorf("undefined pool '%s'", pooled.Pool())
+	}
+	return pool, nil
+}
+
+// Run rule to build node (and its other targets), retrying on failure
+// as many times as it allows. The caller must already hold a slot in
+// the rule's pool, if any. In a parallel build this runs in its own
+// goroutine, so it must not change the state of the build.
+func (self *BuildState) executeRule(node dag.Node, rule dag.BuildRule) (
+	[]dag.Node, []error) {
+	targets, errs := rule.Execute()
+	if retrying, ok := rule.(dag.RetryingRule); ok {
+		retries := retrying.Retries()
+		for attempt := 1; len(errs) > 0 && attempt <= retries; attempt++ {
+			self.reportRetry(node, attempt, retries, errs)
+			targets, errs = rule.Execute()
+		}
+	}
+	return targets, errs
+}
+
+// Change node's state to one of the outcomes of building it (BUILT,
+// FAILED, or TAINTED), and tell anyone who's listening.
+func (self *BuildState) setState(node dag.Node, state dag.NodeState) {
+	node.SetState(state)
+	self.counts[state]++
+	self.events.Emit("node_state", events.Fields{
+		"node": node.Name(), "state": state.String()})
 }
 
 func (self *BuildState) reportFailure(errs []error) {
 	for _, err := range errs {
-		fmt.Fprintf(os.Stderr, "build failure: %s\n", err)
+		writeFailure(os.Stderr, err)
+	}
+}
+
+// Report a failure that we are about to retry, without marking
+// anything failed (yet).
+func (self *BuildState) reportRetry(
+	node dag.Node, attempt int, retries int, errs []error) {
+	self.reportFailure(errs)
+	log.Info("retrying %s (retry %d of %d)", node.Name(), attempt, retries)
+	self.events.Emit("node_retry", events.Fields{
+		"node":    node.Name(),
+		"attempt": attempt,
+		"retries": retries,
+		"error":   errs[0].Error(),
+	})
+}
+
+func writeFailure(writer io.Writer, err error) {
+	actionerr, ok := err.(*ActionError)
+	if !ok {
+		fmt.Fprintf(writer, "build failure: %s\n", err)
+		return
+	}
+	fmt.Fprintf(writer, "build failure: command %s\n", actionerr.status())
+	fmt.Fprintf(writer, "  command: %s\n", actionerr.Command)
+	if len(actionerr.Targets) > 0 {
+		fmt.Fprintf(writer, "  targets: %s\n",
+			joinNodes(", ", 10, actionerr.Targets))
+	}
+	if actionerr.Location != nil {
+		fmt.Fprintf(writer, "  rule:    %s\n",
+			strings.TrimSuffix(actionerr.Location.ErrorPrefix(), ": "))
 	}
 }
 
 func (self *BuildState) recordNode(node dag.Node) error {
 	log.Debug(log.BUILD, "recording successful build of %s %s", node.Typename(), node)
-	sig, err := node.Signature()
+	sig, err := self.signature(node)
 	log.Debug(log.BUILD, "sig=%v, err=%v", sig, err)
 	if err != nil {
 		return fmt.Errorf("could not compute signature of target %s: %s",
@@ -309,8 +790,8 @@ func (self *BuildState) recordNode(node dag.Node) error {
 
 	record := db.NewBuildRecord()
 	record.SetTargetSignature(sig)
-	for _, parent := range self.graph.ParentNodes(node) {
-		sig, err = parent.Signature()
+	for _, parent := range self.graph.TrackedParentNodes(node) {
+		sig, err = self.signature(parent)
 		if err != nil {
 			return err
 		}
@@ -323,16 +804,170 @@ func (self *BuildState) recordNode(node dag.Node) error {
 	return nil
 }
 
+// Return the current signature of node. If node's signature is
+// derived from its parents, compute their signatures first (which
+// might recurse further up the graph).
+func (self *BuildState) signature(node dag.Node) ([]byte, error) {
+	if dnode, ok := node.(dag.DerivedSignatureNode); ok {
+		parents := self.graph.TrackedParentNodes(node)
+		names := make([]string, len(parents))
+		sigs := make([][]byte, len(parents))
+		for i, parent := range parents {
+			sig, err := self.signature(parent)
+			if err != nil {
+				return nil, err
+			}
+			names[i] = parent.Name()
+			sigs[i] = sig
+		}
+		dnode.SetParentSignatures(names, sigs)
+	}
+	return node.Signature()
+}
+
+// Summarize the timings recorded by the last call to BuildTargets()
+// (which requires SetTracer()): write the max slowest build actions
+// to writer, and then the critical path, i.e. the chain of
+// dependent nodes whose build times add up to the longest total.
+// Nothing else could finish faster than that, no matter how many
+// jobs run in parallel.
+func (self *BuildState) WriteTimings(writer io.Writer, max int) {
+	if len(self.timings) == 0 {
+		return
+	}
+	nodes := make([]dag.Node, 0, len(self.timings))
+	for node := range self.timings {
+		nodes = append(nodes, node)
+	}
+	sort.Sort(byDuration{nodes, self.timings})
+	if len(nodes) > max {
+		nodes = nodes[:max]
+	}
+	fmt.Fprintf(writer, "slowest actions:\n")
+	for _, node := range nodes {
+		fmt.Fprintf(writer, "  %s  %s: %s\n",
+			formatDuration(self.timings[node]),
+			node.Name(), node.BuildRule().ActionString())
+	}
+
+	path, total := self.criticalPath()
+	fmt.Fprintf(writer, "critical path (%s):\n",
+		strings.TrimSpace(formatDuration(total)))
+	for _, node := range path {
+		fmt.Fprintf(writer, "  %s  %s\n",
+			formatDuration(self.timings[node]), node.Name())
+	}
+}
+
+// Return the critical path through the nodes that were built, from
+// upstream to downstream, and its total duration.
+func (self *BuildState) criticalPath() ([]dag.Node, time.Duration) {
+	// cost of a node = its build time plus the cost of its most
+	// costly parent; prev remembers that parent
+	cost := make(map[dag.Node]time.Duration)
+	prev := make(map[dag.Node]dag.Node)
+	var visit func(node dag.Node) time.Duration
+	visit = func(node dag.Node) time.Duration {
+		if total, ok := cost[node]; ok {
+			return total
+		}
+		var worst time.Duration
+		for _, parent := range self.graph.ParentNodes(node) {
+			if pcost := visit(parent); pcost > worst {
+				worst = pcost
+				prev[node] = parent
+			}
+		}
+		cost[node] = worst + self.timings[node]
+		return cost[node]
+	}
+
+	var last dag.Node
+	var total time.Duration
+	for _, node := range self.graph.Nodes() {
+		if visit(node) > total {
+			last = node
+			total = cost[node]
+		}
+	}
+
+	path := []dag.Node{}
+	for node := last; node != nil; node = prev[node] {
+		if _, ok := self.timings[node]; ok {
+			path = append(path, node)
+		}
+	}
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+	return path, total
+}
+
+// sort nodes by decreasing build time (ties broken by name, so the
+// output is stable)
+type byDuration struct {
+	nodes   []dag.Node
+	timings map[dag.Node]time.Duration
+}
+
+func (self byDuration) Len() int {
+	return len(self.nodes)
+}
+
+func (self byDuration) Less(i, j int) bool {
+	ti := self.timings[self.nodes[i]]
+	tj := self.timings[self.nodes[j]]
+	if ti != tj {
+		return ti > tj
+	}
+	return self.nodes[i].Name() < self.nodes[j].Name()
+}
+
+func (self byDuration) Swap(i, j int) {
+	self.nodes[i], self.nodes[j] = self.nodes[j], self.nodes[i]
+}
+
+// e.g. "  1.250s"
+func formatDuration(duration time.Duration) string {
+	return fmt.Sprintf("%7.3fs", duration.Seconds())
+}
+
 func (self *BuildState) keepGoing() bool {
 	return self.options.KeepGoing
 }
 
+func (self *BuildState) jobs() int {
+	if self.options.Jobs < 1 {
+		return 1
+	}
+	return self.options.Jobs
+}
+
 func (self *BuildState) checkAll() bool {
 	return self.options.CheckAll
 }
 
-func (self *BuildError) addFailure(node dag.Node) {
+func (self *BuildError) addFailure(node dag.Node, errs []error) {
 	self.failed = append(self.failed, node)
+	self.errors = append(self.errors, errs...)
+}
+
+// Return the nodes that failed to build.
+func (self *BuildError) Failed() []dag.Node {
+	return self.failed
+}
+
+// Return the details of every failed action, in the order they
+// failed. (Build rules can fail in other ways too, e.g. an undefined
+// variable in a command; those failures are not included here.)
+func (self *BuildError) ActionErrors() []*ActionError {
+	result := []*ActionError{}
+	for _, err := range self.errors {
+		if actionerr, ok := err.(*ActionError); ok {
+			result = append(result, actionerr)
+		}
+	}
+	return result
 }
 
 func (self *BuildError) Error() string {
@@ -350,6 +985,28 @@ func (self *BuildError) Error() string {
 	return fmt.Sprintf("failed to build target: %s", self.failed[0])
 }
 
+// e.g. "test.fubsy:3: command exited with status 1: cc -c foo.c"
+func (self *ActionError) Error() string {
+	prefix := ""
+	if self.Location != nil {
+		prefix = self.Location.ErrorPrefix()
+	}
+	return fmt.Sprintf("%scommand %s: %s", prefix, self.status(), self.Command)
+}
+
+// e.g. "exited with status 1", "killed by signal interrupt", "timed
+// out after 30s"
+func (self *ActionError) status() string {
+	if self.Timeout != 0 {
+		return "timed out after " + self.Timeout.String()
+	} else if self.ExitStatus >= 0 {
+		return fmt.Sprintf("exited with status %d", self.ExitStatus)
+	} else if self.Signal != 0 {
+		return "killed by signal " + self.Signal.String()
+	}
+	return fmt.Sprintf("could not be run (%s)", self.Err)
+}
+
 func joinNodes(delim string, max int, nodes []dag.Node) string {
 	if len(nodes) < max {
 		max = len(nodes)
@@ -5,15 +5,25 @@
 package build
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"os"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/stretchrcom/testify/assert"
 
 	"fubsy/dag"
 	"fubsy/db"
+	"fubsy/dsl"
+	"fubsy/events"
 	//"fubsy/log"
+	"fubsy/testutils"
+	"fubsy/trace"
 )
 
 // full build of all targets, all actions succeed
@@ -188,6 +198,301 @@ func Test_BuildState_BuildTargets_one_failure_keep_going(t *testing.T) {
 	assert.Equal(t, dag.TAINTED, graph.Lookup("tool1").State())
 }
 
+// a failing action is retried as many times as its rule allows
+func Test_BuildState_BuildTargets_retries(t *testing.T) {
+	sig := []byte{0}
+	graph, executed := setupBuild(false, sig)
+	db := makeFakeDB(graph, sig)
+	rule := graph.Lookup("misc.o").BuildRule().(*dag.StubRule)
+	rule.SetFailCount(2)
+	rule.SetRetries(2)
+
+	expect := []buildexpect{
+		{"tool1.o", dag.BUILT},
+		{"misc.o", dag.BUILT},
+		{"misc.o", dag.BUILT},
+		{"misc.o", dag.BUILT},
+		{"util.o", dag.BUILT},
+		{"tool1", dag.BUILT},
+	}
+	bstate := NewBuildState(graph, db, BuildOptions{})
+	err := bstate.BuildTargets(graph.MakeNodeSet("tool1"))
+	assert.Nil(t, err)
+	assertBuild(t, graph, expect, *executed)
+
+	// not enough retries
+	graph, executed = setupBuild(false, sig)
+	db = makeFakeDB(graph, sig)
+	rule = graph.Lookup("misc.o").BuildRule().(*dag.StubRule)
+	rule.SetFailCount(2)
+	rule.SetRetries(1)
+	expect = []buildexpect{
+		{"tool1.o", dag.BUILT},
+		{"misc.o", dag.FAILED},
+		{"misc.o", dag.FAILED},
+	}
+	bstate = NewBuildState(graph, db, BuildOptions{})
+	err = bstate.BuildTargets(graph.MakeNodeSet("tool1"))
+	assert.NotNil(t, err)
+	assertBuild(t, graph, expect, *executed)
+}
+
+// a rule in a pool holds a slot in that pool while it runs
+func Test_BuildState_BuildTargets_pool(t *testing.T) {
+	sig := []byte{0}
+	graph, _ := setupBuild(false, sig)
+	db := makeFakeDB(graph, sig)
+	pool := NewPool("link", 1)
+	running := -1
+	node := graph.Lookup("tool1")
+	rule := dag.MakeStubRule(func(string) { running = pool.Running() }, node)
+	rule.SetPool("link")
+	node.SetBuildRule(rule)
+
+	bstate := NewBuildState(graph, db, BuildOptions{})
+	bstate.AddPool(pool)
+	err := bstate.BuildTargets(graph.MakeNodeSet("tool1"))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, running)
+	assert.Equal(t, 0, pool.Running())
+	assert.Equal(t, dag.BUILT, node.State())
+
+	// a rule in a pool that the build doesn't know about fails
+	graph, _ = setupBuild(false, sig)
+	db = makeFakeDB(graph, sig)
+	graph.Lookup("tool1").BuildRule().(*dag.StubRule).SetPool("bogus")
+	bstate = NewBuildState(graph, db, BuildOptions{})
+	err = bstate.BuildTargets(graph.MakeNodeSet("tool1"))
+	assert.NotNil(t, err)
+	assert.Equal(t, dag.FAILED, graph.Lookup("tool1").State())
+}
+
+// with several jobs, independent rules run at once, but never more
+// than a pool allows
+func Test_BuildState_BuildTargets_parallel(t *testing.T) {
+	sig := []byte{0}
+	var lock sync.Mutex
+	running := 0
+	maxrunning := 0
+	callback := func(string) {
+		lock.Lock()
+		running++
+		if running > maxrunning {
+			maxrunning = running
+		}
+		lock.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		lock.Lock()
+		running--
+		lock.Unlock()
+	}
+	build := func(pool string) (*dag.DAG, error) {
+		graph, _ := setupBuild(false, sig)
+		db := makeFakeDB(graph, sig)
+		running, maxrunning = 0, 0
+		for _, name := range []string{"tool1.o", "misc.o", "util.o", "tool2.o"} {
+			node := graph.Lookup(name)
+			rule := dag.MakeStubRule(callback, node)
+			rule.SetPool(pool)
+			node.SetBuildRule(rule)
+		}
+		bstate := NewBuildState(graph, db, BuildOptions{Jobs: 4})
+		bstate.AddPool(NewPool("cc", 1))
+		return graph, bstate.BuildTargets(graph.MakeNodeSet("tool1", "tool2"))
+	}
+
+	graph, err := build("")
+	assert.Nil(t, err)
+	assert.True(t, maxrunning > 1,
+		"expected rules to overlap, but at most %d ran at once", maxrunning)
+	for _, name := range []string{"tool1", "tool2", "tool1.o", "misc.o", "util.o", "tool2.o"} {
+		assert.Equal(t, dag.BUILT, graph.Lookup(name).State())
+	}
+
+	graph, err = build("cc")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, maxrunning)
+	for _, name := range []string{"tool1", "tool2", "tool1.o", "misc.o", "util.o", "tool2.o"} {
+		assert.Equal(t, dag.BUILT, graph.Lookup(name).State())
+	}
+}
+
+// a rule with several targets runs once, not once per target
+func Test_BuildState_BuildTargets_multitarget(t *testing.T) {
+	sig := []byte{0}
+	for _, jobs := range []int{1, 3} {
+		tdag := dag.NewTestDAG()
+		tdag.Add("parser.c", "parser.y")
+		tdag.Add("parser.h", "parser.y")
+		tdag.Add("parser.o", "parser.c", "parser.h")
+		tdag.Add("parser.y")
+		graph := tdag.Finish()
+		setNodeExists(graph, false)
+		setNodeSigs(graph, sig)
+		executed := addTrackingRules(graph)
+		rule := dag.MakeStubRule(
+			func(string) { *executed = append(*executed, "yacc") },
+			graph.Lookup("parser.c"), graph.Lookup("parser.h"))
+		graph.Lookup("parser.c").SetBuildRule(rule)
+		graph.Lookup("parser.h").SetBuildRule(rule)
+		graph.MarkSources()
+
+		db := makeFakeDB(graph, sig)
+		opts := BuildOptions{Jobs: jobs}
+		bstate := NewBuildState(graph, db, opts)
+		err := bstate.BuildTargets(graph.MakeNodeSet("parser.o"))
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"yacc", "parser.o"}, *executed)
+		for _, name := range []string{"parser.c", "parser.h", "parser.o"} {
+			assert.Equal(t, dag.BUILT, graph.Lookup(name).State())
+		}
+	}
+}
+
+// a parallel build reaches the same result as a serial build: failed
+// nodes, and the nodes they taint
+func Test_BuildState_BuildTargets_parallel_failure(t *testing.T) {
+	sig := []byte{0}
+	for _, jobs := range []int{1, 3} {
+		graph, executed := setupBuild(false, sig)
+		db := makeFakeDB(graph, sig)
+		graph.Lookup("misc.o").BuildRule().(*dag.StubRule).SetFail(true)
+
+		opts := BuildOptions{KeepGoing: true, Jobs: jobs}
+		bstate := NewBuildState(graph, db, opts)
+		err := bstate.BuildTargets(graph.MakeNodeSet("tool1", "tool2"))
+		assert.NotNil(t, err)
+		assert.Equal(t, 5, len(*executed))
+		assert.Equal(t, dag.FAILED, graph.Lookup("misc.o").State())
+		assert.Equal(t, dag.TAINTED, graph.Lookup("tool1").State())
+		assert.Equal(t, dag.BUILT, graph.Lookup("tool2").State())
+	}
+}
+
+func Test_BuildState_BuildTargets_events(t *testing.T) {
+	// same as the previous test, but with events enabled
+	sig := []byte{0}
+	graph, _ := setupBuild(false, sig)
+	db := makeFakeDB(graph, sig)
+	rule := graph.Lookup("misc.o").BuildRule().(*dag.StubRule)
+	rule.SetFail(true)
+
+	buf := &bytes.Buffer{}
+	opts := BuildOptions{KeepGoing: true}
+	bstate := NewBuildState(graph, db, opts)
+	bstate.SetEvents(events.NewStream(buf))
+	goal := graph.MakeNodeSet("tool1", "tool2")
+	err := bstate.BuildTargets(goal)
+	assert.NotNil(t, err)
+
+	// summarize each event as a string (omitting times)
+	actual := []string{}
+	decoder := json.NewDecoder(buf)
+	for decoder.More() {
+		var event map[string]interface{}
+		err = decoder.Decode(&event)
+		assert.Nil(t, err)
+		summary := event["event"].(string)
+		switch summary {
+		case "build_start":
+			summary += fmt.Sprintf(" %v", event["targets"])
+		case "node_considered":
+			summary += fmt.Sprintf(" %s %v (%s)",
+				event["node"], event["rebuild"], event["reason"])
+		case "node_state":
+			summary += fmt.Sprintf(" %s %s", event["node"], event["state"])
+		case "build_summary":
+			summary += fmt.Sprintf(
+				" ok=%v attempted=%v built=%v failed=%v tainted=%v",
+				event["ok"], event["attempted"], event["built"],
+				event["failed"], event["tainted"])
+		}
+		actual = append(actual, summary)
+	}
+	expect := []string{
+		"build_start [tool1 tool2]",
+		"node_considered tool1.o true (missing)",
+		"node_state tool1.o BUILT",
+		"node_considered misc.o true (missing)",
+		"node_state misc.o FAILED",
+		"node_considered util.o true (missing)",
+		"node_state util.o BUILT",
+		"node_considered tool1 false (parent failed: misc.o)",
+		"node_state tool1 TAINTED",
+		"node_considered tool2.o true (missing)",
+		"node_state tool2.o BUILT",
+		"node_considered tool2 true (missing)",
+		"node_state tool2 BUILT",
+		"build_summary ok=false attempted=5 built=4 failed=1 tainted=1",
+	}
+	assert.Equal(t, expect, actual)
+}
+
+// in HYBRID mode, a source file that was touched but not modified
+// does not make its target stale, and its new stat info is recorded
+// so it isn't rehashed in every later build
+func Test_BuildState_BuildTargets_hybrid_touched(t *testing.T) {
+	cleanup := testutils.Chtemp()
+	defer cleanup()
+	dag.SetSignatureMode("", dag.HYBRID)
+	defer dag.SetSignatureMode("", dag.CONTENT)
+
+	testutils.Mkfile(".", "foo.c", "int main;\n")
+	graph := dag.NewDAG()
+	source := dag.MakeFileNode(graph, "foo.c")
+	oldsig, err := dag.NewFileNode("foo.c").Signature()
+	assert.Nil(t, err)
+	target := dag.MakeStubNode(graph, "foo")
+	target.SetExists(true)
+	target.SetSignature([]byte{0})
+	graph.AddParent(target, source)
+	executed := addTrackingRules(graph)
+	graph.MarkSources()
+
+	bdb := db.NewFakeDB()
+	record := db.NewBuildRecord()
+	record.SetTargetSignature([]byte{0})
+	record.AddParent("foo.c", oldsig)
+	bdb.WriteNode("foo", record)
+
+	mtime := time.Unix(1234567890, 0)
+	err = os.Chtimes("foo.c", mtime, mtime)
+	assert.Nil(t, err)
+	cursig, err := dag.NewFileNode("foo.c").Signature()
+	assert.Nil(t, err)
+	assert.NotEqual(t, oldsig, cursig)
+
+	bstate := NewBuildState(graph, bdb, BuildOptions{})
+	err = bstate.BuildTargets(graph.MakeNodeSet("foo"))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(*executed))
+	record, err = bdb.LookupNode("foo")
+	assert.Nil(t, err)
+	assert.Equal(t, cursig, record.SourceSignature("foo.c"))
+	assert.Equal(t, []byte{0}, record.TargetSignature())
+}
+
+func Test_BuildState_considerNode_reason(t *testing.T) {
+	sig := []byte{0}
+	graph, _ := setupBuild(true, sig)
+	db := makeFakeDB(graph, sig)
+	bstate := NewBuildState(graph, db, BuildOptions{})
+	bstate.setChangeStates()
+
+	node := graph.Lookup("tool1.o")
+	build, tainted, reason, err := bstate.considerNode(node)
+	assert.Nil(t, err)
+	assert.False(t, build)
+	assert.False(t, tainted)
+	assert.Equal(t, "up to date", reason)
+
+	graph.Lookup("misc.h").(*dag.StubNode).SetSignature([]byte{1})
+	build, _, reason, err = bstate.considerNode(node)
+	assert.Nil(t, err)
+	assert.True(t, build)
+	assert.Equal(t, "parent changed: misc.h", reason)
+}
+
 func Test_BuildState_BuildTargets_add_source(t *testing.T) {
 	// do a full build (all targets missing), then add one source file
 	// and ensure that downstream targets are rebuilt
@@ -308,6 +613,150 @@ func Test_BuildState_BuildTargets_unsignable_target(t *testing.T) {
 	assertBuild(t, graph, expect, *executed)
 }
 
+func Test_BuildState_BuildTargets_action_node(t *testing.T) {
+	// "package" depends on the ActionNode "test", which depends on
+	// source file "a.c": modifying a.c reruns the tests, which in
+	// turn rebuilds the package
+	makeGraph := func(sig []byte) (*dag.DAG, *[]string) {
+		graph := dag.NewDAG()
+		source := dag.MakeStubNode(graph, "a.c")
+		source.SetExists(true)
+		source.SetSignature(sig)
+		action := dag.MakeActionNode(graph, "test")
+		target := dag.MakeStubNode(graph, "package")
+		target.SetExists(true)
+		target.SetSignature([]byte{0})
+		graph.AddParent(action, source)
+		graph.AddParent(target, action)
+		executed := addTrackingRules(graph)
+		graph.MarkSources()
+		return graph, executed
+	}
+
+	bdb := db.NewFakeDB()
+	opts := BuildOptions{}
+	graph, executed := makeGraph([]byte{0})
+	goal := graph.MakeNodeSet("package")
+	bstate := NewBuildState(graph, bdb, opts)
+	err := bstate.BuildTargets(goal)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"test", "package"}, *executed)
+
+	// nothing changed: nothing to do
+	graph, executed = makeGraph([]byte{0})
+	bstate = NewBuildState(graph, bdb, opts)
+	err = bstate.BuildTargets(goal)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{}, *executed)
+
+	// source changed: rebuild both
+	graph, executed = makeGraph([]byte{1})
+	bstate = NewBuildState(graph, bdb, opts)
+	err = bstate.BuildTargets(goal)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"test", "package"}, *executed)
+}
+
+func Test_BuildState_BuildTargets_order_only(t *testing.T) {
+	// "obj/a.o" needs directory "obj" to exist before it's built,
+	// but does not care what's in it: rebuilding "obj" (because
+	// "obj.in" changed) must not rebuild "obj/a.o"
+	makeGraph := func(exists bool, sig []byte) (*dag.DAG, *[]string) {
+		graph := dag.NewDAG()
+		target := dag.MakeStubNode(graph, "obj/a.o")
+		source := dag.MakeStubNode(graph, "a.c")
+		dir := dag.MakeStubNode(graph, "obj")
+		dirsrc := dag.MakeStubNode(graph, "obj.in")
+		for _, node := range graph.Nodes() {
+			node.(*dag.StubNode).SetExists(exists)
+			node.(*dag.StubNode).SetSignature([]byte{0})
+		}
+		source.SetExists(true)
+		dirsrc.SetExists(true)
+		dirsrc.SetSignature(sig)
+		dir.SetSignature(sig)
+		graph.AddParent(target, source)
+		graph.AddManyOrderOnlyParents([]dag.Node{target}, []dag.Node{dir})
+		graph.AddParent(dir, dirsrc)
+		executed := addTrackingRules(graph)
+		graph.MarkSources()
+		return graph, executed
+	}
+
+	bdb := db.NewFakeDB()
+	opts := BuildOptions{}
+	graph, executed := makeGraph(false, []byte{0})
+	goal := graph.MakeNodeSet("obj/a.o")
+	bstate := NewBuildState(graph, bdb, opts)
+	err := bstate.BuildTargets(goal)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"obj", "obj/a.o"}, *executed)
+
+	// order-only parents are not recorded
+	record, err := bdb.LookupNode("obj/a.o")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a.c"}, record.Parents())
+
+	// "obj" is rebuilt and changes, but "obj/a.o" doesn't care
+	graph, executed = makeGraph(true, []byte{1})
+	bstate = NewBuildState(graph, bdb, opts)
+	err = bstate.BuildTargets(goal)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"obj"}, *executed)
+}
+
+func Test_BuildState_StaleTargets(t *testing.T) {
+	// util.c changed: everything that depends on it is stale, but
+	// tool1.o and misc.o are fine
+	graph, executed := setupBuild(true, []byte{0})
+	bdb := makeFakeDB(graph, []byte{0})
+	graph.Lookup("util.c").(*dag.StubNode).SetSignature([]byte{1})
+
+	bstate := NewBuildState(graph, bdb, BuildOptions{})
+	goal := graph.MakeNodeSet("tool1", "tool2")
+	stale, err := bstate.StaleTargets(goal)
+	assert.Nil(t, err)
+	names := []string{}
+	for _, node := range graph.Nodes() {
+		if stale[node] {
+			names = append(names, node.Name())
+		}
+	}
+	assert.Equal(t, []string{"tool1", "tool2", "util.o"}, names)
+	assert.Equal(t, []string{}, *executed)
+}
+
+func Test_BuildState_WriteTimings(t *testing.T) {
+	graph, _ := setupBuild(false, []byte{0})
+	bstate := NewBuildState(graph, db.NewFakeDB(), BuildOptions{})
+	bstate.SetTracer(trace.NewTracer())
+	err := bstate.BuildTargets(graph.FindFinalTargets())
+	assert.Nil(t, err)
+	assert.Equal(t, 6, len(bstate.timings))
+
+	// replace the real (tiny) timings with something predictable
+	ms := time.Millisecond
+	durations := map[string]time.Duration{
+		"tool1.o": 400 * ms, "misc.o": 300 * ms, "util.o": 1200 * ms,
+		"tool2.o": 100 * ms, "tool1": 50 * ms, "tool2": 20 * ms,
+	}
+	for name, duration := range durations {
+		bstate.timings[graph.Lookup(name)] = duration
+	}
+
+	buf := &bytes.Buffer{}
+	bstate.WriteTimings(buf, 3)
+	expect := "" +
+		"slowest actions:\n" +
+		"    1.200s  util.o: build \"util.o\"\n" +
+		"    0.400s  tool1.o: build \"tool1.o\"\n" +
+		"    0.300s  misc.o: build \"misc.o\"\n" +
+		"critical path (1.250s):\n" +
+		"    1.200s  util.o\n" +
+		"    0.050s  tool1\n"
+	assert.Equal(t, expect, buf.String())
+}
+
 func setupBuild(exists bool, sig []byte) (*dag.DAG, *[]string) {
 	graph := makeSimpleGraph()
 	setNodeExists(graph, exists)
@@ -369,9 +818,13 @@ func setNodeSigs(graph *dag.DAG, sig []byte) {
 // add a stub build rule to every target node, so we track when each
 // rule's Execute() method is called
 func addTrackingRules(graph *dag.DAG) *[]string {
+	// rules may run in parallel (with options.Jobs > 1)
+	var lock sync.Mutex
 	executed := []string{}
 	callback := func(name string) {
+		lock.Lock()
 		executed = append(executed, name)
+		lock.Unlock()
 	}
 	for _, node := range graph.Nodes() {
 		if graph.HasParents(node) {
@@ -467,6 +920,75 @@ func Test_BuildError_Error(t *testing.T) {
 		err.Error())
 }
 
+func Test_ActionError(t *testing.T) {
+	ast, errs := dsl.ParseString("test.fubsy",
+		"main {\n  \"foo\": \"foo.c\" {\n    \"cc foo.c\"\n  }\n}\n")
+	assert.Equal(t, 0, len(errs))
+	location := ast.FindPhase("main").Children()[0].Location()
+
+	graph := dag.NewDAG()
+	err := &ActionError{
+		Command:    "cc foo.c",
+		ExitStatus: 1,
+		Targets:    mknodelist(graph, "foo", "foo.h"),
+		Location:   location,
+	}
+	assert.Equal(t,
+		"test.fubsy:2-4: command exited with status 1: cc foo.c", err.Error())
+	buf := &bytes.Buffer{}
+	writeFailure(buf, err)
+	assert.Equal(t, ""+
+		"build failure: command exited with status 1\n"+
+		"  command: cc foo.c\n"+
+		"  targets: \"foo\", \"foo.h\"\n"+
+		"  rule:    test.fubsy:2-4\n",
+		buf.String())
+
+	err = &ActionError{
+		Command:    "sleep 100",
+		ExitStatus: -1,
+		Signal:     syscall.SIGINT,
+	}
+	assert.Equal(t, "command killed by signal interrupt: sleep 100", err.Error())
+	buf.Reset()
+	writeFailure(buf, err)
+	assert.Equal(t, ""+
+		"build failure: command killed by signal interrupt\n"+
+		"  command: sleep 100\n",
+		buf.String())
+
+	err = &ActionError{
+		Command:    "sleep 100",
+		ExitStatus: -1,
+		Signal:     syscall.SIGKILL,
+		Timeout:    30 * time.Second,
+	}
+	assert.Equal(t, "command timed out after 30s: sleep 100", err.Error())
+
+	err = &ActionError{
+		Command:    "cc foo.c",
+		ExitStatus: -1,
+		Err:        errors.New("fork failed"),
+	}
+	assert.Equal(t,
+		"command could not be run (fork failed): cc foo.c", err.Error())
+
+	buf.Reset()
+	writeFailure(buf, errors.New("undefined variable"))
+	assert.Equal(t, "build failure: undefined variable\n", buf.String())
+}
+
+func Test_BuildError_ActionErrors(t *testing.T) {
+	graph := dag.NewDAG()
+	nodes := mknodelist(graph, "foo", "bar")
+	actionerr := &ActionError{Command: "false", ExitStatus: 1}
+	builderr := &BuildError{}
+	builderr.addFailure(nodes[0], []error{actionerr})
+	builderr.addFailure(nodes[1], []error{errors.New("bogus")})
+	assert.Equal(t, nodes, builderr.Failed())
+	assert.Equal(t, []*ActionError{actionerr}, builderr.ActionErrors())
+}
+
 func Test_joinNodes(t *testing.T) {
 	graph := dag.NewDAG()
 	nodes := mknodelist(graph, "blargh", "merp", "whoosh", "fwob", "whee")
@@ -29,5 +29,13 @@ type BuildDB interface {
 	// database I/O problems.
 	WriteNode(nodename string, record *db.BuildRecord) error
 
+	// Lookup a value saved by WriteValue() in an earlier run (e.g. the
+	// cached output of a command run by the build script). Returns
+	// nil if key not found.
+	LookupValue(key string) ([]byte, error)
+
+	// Save value under key for future runs.
+	WriteValue(key string, value []byte) error
+
 	log.Dumper
 }
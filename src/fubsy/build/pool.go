@@ -0,0 +1,64 @@
+// Copyright © 2013, Greg Ward. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE.txt file.
+
+package build
+
+import (
+	"fmt"
+)
+
+// A named limit on how many build rules can run at once, e.g. to
+// stop too many memory-hungry links from running together. Rules
+// that belong to a pool must acquire one of its slots before running
+// and release it when done; this is in addition to any limit on the
+// total number of build jobs. (Like the "pool" feature of Ninja.)
+type Pool struct {
+	name  string
+	slots chan struct{}
+}
+
+func NewPool(name string, capacity int) *Pool {
+	if capacity < 1 {
+		panic(fmt.Sprintf("invalid capacity for pool %s: %d", name, capacity))
+	}
+	return &Pool{name: name, slots: make(chan struct{}, capacity)}
+}
+
+func (self *Pool) Name() string {
+	return self.name
+}
+
+func (self *Pool) Capacity() int {
+	return cap(self.slots)
+}
+
+// Return the number of slots currently in use.
+func (self *Pool) Running() int {
+	return len(self.slots)
+}
+
+// Wait for a free slot in this pool, and take it.
+func (self *Pool) Acquire() {
+	self.slots <- struct{}{}
+}
+
+// Take a free slot in this pool if there is one, without waiting.
+// Return true if a slot was taken.
+func (self *Pool) TryAcquire() bool {
+	select {
+	case self.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// Give back a slot taken by Acquire() or TryAcquire().
+func (self *Pool) Release() {
+	select {
+	case <-self.slots:
+	default:
+		panic("Release() called on pool " + self.name + " with no slots taken")
+	}
+}
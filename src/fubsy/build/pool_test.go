@@ -0,0 +1,54 @@
+// Copyright © 2013, Greg Ward. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE.txt file.
+
+package build
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchrcom/testify/assert"
+)
+
+func Test_Pool(t *testing.T) {
+	pool := NewPool("link", 2)
+	assert.Equal(t, "link", pool.Name())
+	assert.Equal(t, 2, pool.Capacity())
+	assert.Equal(t, 0, pool.Running())
+
+	pool.Acquire()
+	pool.Acquire()
+	assert.Equal(t, 2, pool.Running())
+
+	// the pool is full: a third job must wait for a slot
+	acquired := make(chan bool)
+	go func() {
+		pool.Acquire()
+		acquired <- true
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("acquired a slot in a full pool")
+	case <-time.After(20 * time.Millisecond):
+	}
+	pool.Release()
+	<-acquired
+	assert.Equal(t, 2, pool.Running())
+
+	pool.Release()
+	pool.Release()
+	assert.Equal(t, 0, pool.Running())
+	assert.Panics(t, func() { pool.Release() })
+	assert.Panics(t, func() { NewPool("bogus", 0) })
+}
+
+func Test_Pool_TryAcquire(t *testing.T) {
+	pool := NewPool("link", 1)
+	assert.True(t, pool.TryAcquire())
+	assert.Equal(t, 1, pool.Running())
+	assert.False(t, pool.TryAcquire())
+	pool.Release()
+	assert.True(t, pool.TryAcquire())
+	pool.Release()
+}
@@ -5,6 +5,8 @@
 package dag
 
 import (
+	"sort"
+
 	"fubsy/types"
 )
 
@@ -16,8 +18,17 @@ import (
 // saves the resulting ActionNode in the database. Then future builds
 // don't need to re-run that action until the underlying source files
 // change. Result: incremental testing, incremental linting, etc.
+//
+// Since there is no output to hash, an ActionNode's signature is
+// derived from the signatures of its parents: thus it changes exactly
+// when the action needs to run again, and other nodes can depend on
+// it (e.g. "package" depends on "tests passed").
 type ActionNode struct {
 	nodebase
+
+	// signatures of this node's parents (keyed by name), as passed
+	// to SetParentSignatures()
+	parentsigs map[string][]byte
 }
 
 func MakeActionNode(dag *DAG, name string) *ActionNode {
@@ -63,15 +74,34 @@ func (self *ActionNode) Exists() (bool, error) {
 	return true, nil
 }
 
+func (self *ActionNode) SetParentSignatures(names []string, sigs [][]byte) {
+	self.parentsigs = make(map[string][]byte, len(names))
+	for i, name := range names {
+		self.parentsigs[name] = sigs[i]
+	}
+}
+
 func (self *ActionNode) Signature() ([]byte, error) {
-	// Empty signature because there is no output to hash: however,
-	// this means that depending on an ActionNode won't work, since it
-	// will appear to never change (hmmmm).
-	//
-	// Possible alternatives:
-	// - combine the signatures of this node's parents... but we don't
-	//   have access to them
-	// - increment a counter every time this node is built... but that
-	//   requires access to the database to get the previous value
-	return []byte{}, nil
+	// If nobody told us about our parents, all we can do is return an
+	// empty signature (which never changes).
+	if len(self.parentsigs) == 0 {
+		return []byte{}, nil
+	}
+
+	// Hash the name and signature of every parent, in a consistent
+	// order so that merely rearranging the build script doesn't
+	// change anything.
+	names := make([]string, 0, len(self.parentsigs))
+	for name := range self.parentsigs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	hash := newHash()
+	for _, name := range names {
+		hash.Write([]byte(name))
+		hash.Write([]byte{0})
+		hash.Write(self.parentsigs[name])
+		hash.Write([]byte{0})
+	}
+	return hash.Sum(make([]byte, 0, hash.Size())), nil
 }
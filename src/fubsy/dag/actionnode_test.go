@@ -0,0 +1,45 @@
+// Copyright © 2013, Greg Ward. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE.txt file.
+
+package dag
+
+import (
+	"testing"
+
+	"github.com/stretchrcom/testify/assert"
+)
+
+func Test_ActionNode_Signature(t *testing.T) {
+	node := NewActionNode("test:action")
+	sig, err := node.Signature()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{}, sig)
+
+	node.SetParentSignatures(
+		[]string{"a.c", "b.c"}, [][]byte{{1, 2}, {3}})
+	sig1, err := node.Signature()
+	assert.Nil(t, err)
+	assert.Equal(t, newHash().Size(), len(sig1))
+
+	// order of parents does not matter
+	node.SetParentSignatures(
+		[]string{"b.c", "a.c"}, [][]byte{{3}, {1, 2}})
+	sig2, err := node.Signature()
+	assert.Nil(t, err)
+	assert.Equal(t, sig1, sig2)
+
+	// but their signatures do
+	node.SetParentSignatures(
+		[]string{"a.c", "b.c"}, [][]byte{{1}, {2, 3}})
+	sig2, err = node.Signature()
+	assert.Nil(t, err)
+	assert.True(t, node.Changed(sig1, sig2))
+
+	// and so do their names
+	node.SetParentSignatures(
+		[]string{"a.c", "c.c"}, [][]byte{{1, 2}, {3}})
+	sig2, err = node.Signature()
+	assert.Nil(t, err)
+	assert.True(t, node.Changed(sig1, sig2))
+}
@@ -0,0 +1,104 @@
+// Copyright © 2013, Greg Ward. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE.txt file.
+
+package dag
+
+import (
+	"fmt"
+
+	"fubsy/types"
+)
+
+// A phony target that groups other targets under a convenient name,
+// so the user can run "fubsy test" to build every test ActionNode.
+// An alias never exists, so it is always considered for building;
+// building it does nothing except make sure its parents are built
+// first.
+type AliasNode struct {
+	// name: the alias, e.g. "test"
+	nodebase
+}
+
+// the build rule for every AliasNode: nothing to do
+type aliasRule struct {
+	node *AliasNode
+}
+
+// Lookup and return the named alias node in dag. If it doesn't exist,
+// create a new AliasNode, add it to dag, and return it. If there is
+// already some other kind of node by that name, return an error:
+// unlike the names of other node types, alias names come straight
+// from the user, so a clash is not a bug. The caller is responsible
+// for adding the aliased nodes as parents.
+func MakeAliasNode(dag *DAG, name string) (*AliasNode, error) {
+	if node := dag.Lookup(name); node != nil {
+		alias, ok := node.(*AliasNode)
+		if !ok {
+			return nil, fmt.Errorf(
+				"cannot create alias '%s': there is already a %s with that name",
+				name, node.Typename())
+		}
+		return alias, nil
+	}
+	_, node := dag.addNode(NewAliasNode(name))
+	return node.(*AliasNode), nil
+}
+
+func NewAliasNode(name string) *AliasNode {
+	node := &AliasNode{nodebase: makenodebase(name)}
+	node.SetBuildRule(aliasRule{node})
+	return node
+}
+
+func (self *AliasNode) Typename() string {
+	return "AliasNode"
+}
+
+func (self *AliasNode) Equal(other_ types.FuObject) bool {
+	other, ok := other_.(*AliasNode)
+	return ok && other.name == self.name
+}
+
+func (self *AliasNode) Add(other types.FuObject) (types.FuObject, error) {
+	return defaultNodeAdd(self, other)
+}
+
+func (self *AliasNode) List() []types.FuObject {
+	return []types.FuObject{self}
+}
+
+func (self *AliasNode) ActionExpand(
+	ns types.Namespace, ctx *types.ExpandContext) (
+	types.FuObject, error) {
+	return defaultNodeActionExpand(self, ns)
+}
+
+func (self *AliasNode) copy() Node {
+	var c AliasNode = *self
+	c.rule = aliasRule{&c}
+	return &c
+}
+
+func (self *AliasNode) NodeExpand(ns types.Namespace) error {
+	// alias names are taken literally
+	return nil
+}
+
+func (self *AliasNode) Exists() (bool, error) {
+	// never exists, so it's always "built" (which is a no-op)
+	return false, nil
+}
+
+func (self *AliasNode) Signature() ([]byte, error) {
+	// nothing to summarize: an alias never changes
+	return []byte{}, nil
+}
+
+func (self aliasRule) Execute() ([]Node, []error) {
+	return []Node{self.node}, nil
+}
+
+func (self aliasRule) ActionString() string {
+	return "(alias)"
+}
@@ -0,0 +1,56 @@
+// Copyright © 2013, Greg Ward. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE.txt file.
+
+package dag
+
+import (
+	"testing"
+
+	"github.com/stretchrcom/testify/assert"
+)
+
+func Test_AliasNode_basics(t *testing.T) {
+	node := NewAliasNode("test")
+	exists, err := node.Exists()
+	assert.Nil(t, err)
+	assert.False(t, exists)
+	sig, err := node.Signature()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{}, sig)
+
+	rule := node.BuildRule()
+	assert.Equal(t, "(alias)", rule.ActionString())
+	targets, errs := rule.Execute()
+	assert.Equal(t, 0, len(errs))
+	assert.Equal(t, []Node{node}, targets)
+
+	// copying the node rebinds the rule to the copy
+	node2 := node.copy()
+	targets, errs = node2.BuildRule().Execute()
+	assert.Equal(t, 0, len(errs))
+	assert.True(t, targets[0] == node2)
+}
+
+func Test_DAG_MatchTargets_alias(t *testing.T) {
+	dag := NewDAG()
+	src := MakeStubNode(dag, "a.c")
+	obj := MakeStubNode(dag, "a.o")
+	dag.AddParent(obj, src)
+	alias, err := MakeAliasNode(dag, "all")
+	assert.Nil(t, err)
+	dag.AddParent(alias, obj)
+	dag.MarkSources()
+
+	assert.Equal(t, []string{"all"}, dag.AliasNames())
+
+	match, errs := dag.MatchTargets([]string{"all"})
+	assert.Equal(t, 0, len(errs))
+	assert.Equal(t, "{2}", match.String())
+
+	// unknown names remind the user which aliases exist
+	_, errs = dag.MatchTargets([]string{"al"})
+	assert.Equal(t, 1, len(errs))
+	assert.Equal(t,
+		"no targets found matching 'al' (aliases: all)", errs[0].Error())
+}
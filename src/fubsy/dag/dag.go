@@ -26,6 +26,11 @@ package dag
 // node derived from foo.c and foo.h, and a source node for libstuff.a
 // and libstuff.so.
 //
+// A parent can also be *order-only*: it must be built before its
+// child, but changes to it do not make the child stale. That's useful
+// for an output directory or a set of generated headers that must
+// exist before a rule runs.
+//
 // Just to clarify: the direct relationships between nodes are always
 // stated as "parent" and "child": foo.o is a child of foo.c and a
 // parent of libstuff.a. Indirect relationships are described as
@@ -55,6 +60,14 @@ type DAG struct {
 
 	// the parents of every node
 	parents []*bit.Set
+
+	// the order-only parents of every node (always a subset of
+	// parents)
+	orderonly []*bit.Set
+
+	// the children of every node (the inverse of parents, for
+	// walking the graph from sources towards targets)
+	children []*bit.Set
 }
 
 // an opaque set of integer node IDs (this type deliberately has very
@@ -91,9 +104,11 @@ func (self *DAG) Nodes() []Node {
 // copies of nodes in self. Mainly for test code.
 func (self *DAG) copy() *DAG {
 	newdag := DAG{
-		nodes:   make([]Node, len(self.nodes)),
-		index:   make(map[string]int),
-		parents: make([]*bit.Set, len(self.parents)),
+		nodes:     make([]Node, len(self.nodes)),
+		index:     make(map[string]int),
+		parents:   make([]*bit.Set, len(self.parents)),
+		orderonly: make([]*bit.Set, len(self.orderonly)),
+		children:  make([]*bit.Set, len(self.children)),
 	}
 	for id, node := range self.nodes {
 		newdag.nodes[id] = node.copy()
@@ -106,6 +121,16 @@ func (self *DAG) copy() *DAG {
 		copyset = *parentset
 		newdag.parents[id] = &copyset
 	}
+	for id, orderset := range self.orderonly {
+		var copyset bit.Set
+		copyset = *orderset
+		newdag.orderonly[id] = &copyset
+	}
+	for id, childset := range self.children {
+		var copyset bit.Set
+		copyset = *childset
+		newdag.children[id] = &copyset
+	}
 	return &newdag
 }
 
@@ -123,6 +148,16 @@ func (self *DAG) verify() {
 			"corrupt DAG: self.nodes has %d nodes, but self.parents has %d",
 			len(self.nodes), len(self.parents)))
 	}
+	if len(self.nodes) != len(self.orderonly) {
+		panic(fmt.Sprintf(
+			"corrupt DAG: self.nodes has %d nodes, but self.orderonly has %d",
+			len(self.nodes), len(self.orderonly)))
+	}
+	if len(self.nodes) != len(self.children) {
+		panic(fmt.Sprintf(
+			"corrupt DAG: self.nodes has %d nodes, but self.children has %d",
+			len(self.nodes), len(self.children)))
+	}
 
 	for id, node := range self.nodes {
 		if id != node.id() {
@@ -147,6 +182,28 @@ func (self *DAG) verify() {
 				"corrupt DAG: max parent of node %d is %d (should be <= %d)",
 				id, parentset.Max(), maxid))
 		}
+		if !bit.New().SetAndNot(self.orderonly[id], parentset).IsEmpty() {
+			panic(fmt.Sprintf(
+				"corrupt DAG: order-only parents of node %d (%v) "+
+					"are not all parents (%v)",
+				id, self.orderonly[id], parentset))
+		}
+		for pid, ok := parentset.Next(-1); ok; pid, ok = parentset.Next(pid) {
+			if !self.children[pid].Contains(id) {
+				panic(fmt.Sprintf(
+					"corrupt DAG: node %d is a parent of node %d, "+
+						"but not the other way round", pid, id))
+			}
+		}
+	}
+	for id, childset := range self.children {
+		for cid, ok := childset.Next(-1); ok; cid, ok = childset.Next(cid) {
+			if !self.parents[cid].Contains(id) {
+				panic(fmt.Sprintf(
+					"corrupt DAG: node %d is a child of node %d, "+
+						"but not the other way round", cid, id))
+			}
+		}
 	}
 }
 
@@ -165,17 +222,46 @@ func (self *DAG) MakeNodeSet(names ...string) *NodeSet {
 }
 
 // Add the same set of parents (source nodes) to many children (target
-// nodes).
+// nodes). If any of them were order-only parents, they become normal
+// parents.
 func (self *DAG) AddManyParents(targets, sources []Node) {
-	sourceset := bit.New()
+	sourceset := makeIdSet(sources)
+	targetset := makeIdSet(targets)
+	for _, tnode := range targets {
+		tid := tnode.id()
+		self.parents[tid].SetOr(self.parents[tid], sourceset)
+		self.orderonly[tid].SetAndNot(self.orderonly[tid], sourceset)
+	}
 	for _, snode := range sources {
-		sourceset.Add(snode.id())
+		sid := snode.id()
+		self.children[sid].SetOr(self.children[sid], targetset)
 	}
+}
 
+// Add the same set of order-only parents to many children: each
+// child will be built after its order-only parents, but changes to
+// them will not cause the child to be rebuilt. Sources that are
+// already normal parents of a target stay that way.
+func (self *DAG) AddManyOrderOnlyParents(targets, sources []Node) {
+	sourceset := makeIdSet(sources)
+	newset := bit.New()
 	for _, tnode := range targets {
 		tid := tnode.id()
-		self.parents[tid].SetOr(self.parents[tid], sourceset)
+		newset.SetAndNot(sourceset, self.parents[tid])
+		self.parents[tid].SetOr(self.parents[tid], newset)
+		self.orderonly[tid].SetOr(self.orderonly[tid], newset)
+		newset.Do(func(sid int) {
+			self.children[sid].Add(tid)
+		})
+	}
+}
+
+func makeIdSet(nodes []Node) *bit.Set {
+	result := bit.New()
+	for _, node := range nodes {
+		result.Add(node.id())
 	}
+	return result
 }
 
 // Write a compact, human-readable representation of the entire DAG to
@@ -195,7 +281,12 @@ func (self *DAG) Dump(writer io.Writer, indent string) {
 			fmt.Fprintf(writer, indent+"  parents:\n")
 			for parentid, ok := parents.Next(-1); ok; parentid, ok = parents.Next(parentid) {
 				pnode := self.nodes[parentid]
-				fmt.Fprintf(writer, indent+"    %04d: %s\n", parentid, pnode.Name())
+				suffix := ""
+				if self.orderonly[id].Contains(parentid) {
+					suffix = " (order-only)"
+				}
+				fmt.Fprintf(writer, indent+"    %04d: %s%s\n",
+					parentid, pnode.Name(), suffix)
 			}
 		}
 	}
@@ -263,12 +354,29 @@ func (self *DAG) matchPrefix(name string, errs []error) (*bit.Set, []error) {
 		}
 	}
 	if result.IsEmpty() {
-		errs = append(errs,
-			fmt.Errorf("no targets found matching '%s'", name))
+		err := fmt.Errorf("no targets found matching '%s'", name)
+		if aliases := self.AliasNames(); len(aliases) > 0 {
+			// maybe the user mistyped an alias: remind them
+			err = fmt.Errorf("%s (aliases: %s)",
+				err, strings.Join(aliases, ", "))
+		}
+		errs = append(errs, err)
 	}
 	return result, errs
 }
 
+// Return the names of all AliasNodes in this graph, in the order they
+// were created.
+func (self *DAG) AliasNames() []string {
+	names := []string{}
+	for _, node := range self.nodes {
+		if _, ok := node.(*AliasNode); ok {
+			names = append(names, node.Name())
+		}
+	}
+	return names
+}
+
 // Return the set of nodes in this graph with no children.
 func (self *DAG) FindFinalTargets() *NodeSet {
 	//fmt.Println("FindFinalTargets():")
@@ -282,6 +390,58 @@ func (self *DAG) FindFinalTargets() *NodeSet {
 	return (*NodeSet)(targets)
 }
 
+// Return the set of nodes affected by changes to any of filenames
+// (e.g. the files modified by a change under review): every node
+// that represents one of those files (see FindCovering()), plus all
+// of their descendants. Filenames that are not part of the graph
+// affect nothing.
+func (self *DAG) FindAffected(filenames []string) (*NodeSet, error) {
+	changed, err := self.FindCovering(filenames)
+	if err != nil {
+		return nil, err
+	}
+	return (*NodeSet)(self.descendants((*bit.Set)(changed))), nil
+}
+
+// Return the set of nodes that represent any of filenames: the node
+// with the same name, plus any FinderNode or DirNode that covers it.
+func (self *DAG) FindCovering(filenames []string) (*NodeSet, error) {
+	covering := bit.New()
+	for _, filename := range filenames {
+		filename = filepath.Clean(filename)
+		if id, ok := self.index[filename]; ok {
+			covering.Add(id)
+		}
+		for id, node := range self.nodes {
+			var covers bool
+			var err error
+			switch node := node.(type) {
+			case *FinderNode:
+				covers, err = node.Matches(filename)
+			case *DirNode:
+				covers = hasPathPrefix(filename, node.Name())
+			}
+			if err != nil {
+				return nil, err
+			}
+			if covers {
+				covering.Add(id)
+			}
+		}
+	}
+	return (*NodeSet)(covering), nil
+}
+
+// Return the final targets that depend on any of filenames (see
+// FindAffected()).
+func (self *DAG) FindAffectedTargets(filenames []string) (*NodeSet, error) {
+	affected, err := self.FindAffected(filenames)
+	if err != nil {
+		return nil, err
+	}
+	return affected.Intersection(self.FindFinalTargets()), nil
+}
+
 // Callback function to visit nodes from DFS(). Return a non-nil error
 // to abort the traversal and make DFS() return that error. DFS()
 // aborted this way does not report dependency cycles.
@@ -375,6 +535,23 @@ func (self *DAG) MarkSources() {
 	}
 }
 
+// Prepare this graph to be built again by the same process (e.g.
+// after a source file changes in "fubsy --watch"): forget everything
+// the last build learned about each node, and restore the states set
+// by MarkSources().
+func (self *DAG) Reset() {
+	for id, node := range self.nodes {
+		if node, ok := node.(forgetter); ok {
+			node.forget()
+		}
+		if self.parents[id].IsEmpty() {
+			node.SetState(SOURCE)
+		} else {
+			node.SetState(UNKNOWN)
+		}
+	}
+}
+
 // Return the node with the specified name, or nil if no such node.
 func (self *DAG) Lookup(name string) Node {
 	if idx, ok := self.index[name]; ok {
@@ -395,6 +572,23 @@ func (self *DAG) AddNode(node Node) Node {
 	return node
 }
 
+// Add node to the DAG like addNode(), returning the node actually
+// in the DAG. If there is already a node with the same name but a
+// different type, return an error rather than panicking: node names
+// often come straight from the build script (e.g. DirNode("foo")
+// when "foo" is already a file), so a clash is the user's mistake,
+// not a bug.
+func (self *DAG) addNodeChecked(node Node) (Node, error) {
+	if existing := self.Lookup(node.Name()); existing != nil &&
+		reflect.TypeOf(existing) != reflect.TypeOf(node) {
+		return nil, fmt.Errorf(
+			"cannot create %s '%s': there is already a %s with that name",
+			node.Typename(), node.Name(), existing.Typename())
+	}
+	_, node = self.addNode(node)
+	return node, nil
+}
+
 func (self *DAG) addNode(node Node) (int, Node) {
 	name := node.Name()
 	if id, ok := self.index[name]; ok {
@@ -424,6 +618,8 @@ func (self *DAG) addNode(node Node) (int, Node) {
 	node.setid(id)
 	self.nodes = append(self.nodes, node)
 	self.parents = append(self.parents, bit.New())
+	self.orderonly = append(self.orderonly, bit.New())
+	self.children = append(self.children, bit.New())
 	self.index[name] = id
 	return id, node
 }
@@ -441,8 +637,43 @@ func (self *DAG) ParentNodes(node Node) []Node {
 	return result
 }
 
+// Return the parents of node that are not order-only, i.e. the ones
+// whose changes make node stale.
+func (self *DAG) TrackedParentNodes(node Node) []Node {
+	parents := bit.New()
+	parents.SetAndNot(self.parents[node.id()], self.orderonly[node.id()])
+	result := make([]Node, 0, parents.Size())
+	for parentid, ok := parents.Next(-1); ok; parentid, ok = parents.Next(parentid) {
+		result = append(result, self.nodes[parentid])
+	}
+	return result
+}
+
+// Return true if parent is an order-only parent of child.
+func (self *DAG) IsOrderOnly(child Node, parent Node) bool {
+	return self.orderonly[child.id()].Contains(parent.id())
+}
+
+// Return the nodes built from node, i.e. the nodes that have node as
+// a parent.
+func (self *DAG) ChildNodes(node Node) []Node {
+	return self.NodesIn((*NodeSet)(self.children[node.id()]))
+}
+
 func (self *DAG) AddParent(child Node, parent Node) {
 	self.parents[child.id()].Add(parent.id())
+	self.orderonly[child.id()].Remove(parent.id())
+	self.children[parent.id()].Add(child.id())
+}
+
+// Return the nodes in set, in the order they were added to the DAG.
+func (self *DAG) NodesIn(set *NodeSet) []Node {
+	bset := (*bit.Set)(set)
+	result := make([]Node, 0, bset.Size())
+	for id, ok := bset.Next(-1); ok; id, ok = bset.Next(id) {
+		result = append(result, self.nodes[id])
+	}
+	return result
 }
 
 // Return the number of nodes in the DAG.
@@ -453,6 +684,9 @@ func (self *DAG) length() int {
 // test-friendly way to format a NodeSet as a string
 func (self *NodeSet) String() string {
 	set := (*bit.Set)(self)
+	if set.IsEmpty() {
+		return "{}"
+	}
 	result := make([]byte, 1, set.Size()*3)
 	result[0] = '{'
 	for n, ok := set.Next(-1); ok; n, ok = set.Next(n) {
@@ -463,6 +697,12 @@ func (self *NodeSet) String() string {
 	return string(result)
 }
 
+// Return a new set containing the nodes in both self and other.
+func (self *NodeSet) Intersection(other *NodeSet) *NodeSet {
+	result := bit.New().SetAnd((*bit.Set)(self), (*bit.Set)(other))
+	return (*NodeSet)(result)
+}
+
 func (self *NodeSet) Length() int {
 	return (*bit.Set)(self).Size()
 }
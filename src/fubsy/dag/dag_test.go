@@ -33,6 +33,38 @@ func Test_DAG_add_lookup(t *testing.T) {
 	dag.verify()
 }
 
+// asking for a node by a name that belongs to a node of another type
+// is an error, not a panic
+func Test_DAG_make_type_clash(t *testing.T) {
+	dag := NewDAG()
+	MakeFileNode(dag, "foo")
+	MakeFileNode(dag, "X:env")
+	MakeFileNode(dag, "x:value")
+	MakeDirNode(dag, "bin/tool")
+
+	dnode, err := MakeDirNode(dag, "foo")
+	assert.Nil(t, dnode)
+	assert.Equal(t,
+		"cannot create DirNode 'foo': there is already a FileNode with that name",
+		err.Error())
+	enode, err := MakeEnvNode(dag, "X")
+	assert.Nil(t, enode)
+	assert.Equal(t,
+		"cannot create EnvNode 'X:env': there is already a FileNode with that name",
+		err.Error())
+	vnode, err := MakeValueNode(dag, "x", nil)
+	assert.Nil(t, vnode)
+	assert.Equal(t,
+		"cannot create ValueNode 'x:value': there is already a FileNode with that name",
+		err.Error())
+	tnode, err := MakeToolNode(dag, "bin/tool")
+	assert.Nil(t, tnode)
+	assert.Equal(t,
+		"cannot create ToolNode 'bin/tool': there is already a DirNode with that name",
+		err.Error())
+	dag.verify()
+}
+
 func Test_DAG_ExpandNodes(t *testing.T) {
 	ns := types.NewValueMap()
 	ns.Assign("sdir", types.MakeFuString("src/tool1"))
@@ -133,6 +165,90 @@ func Test_DAG_MatchTargets(t *testing.T) {
 	}
 }
 
+func Test_DAG_ChildNodes(t *testing.T) {
+	dag := makeSimpleGraph()
+	names := func(nodes []Node) []string {
+		result := make([]string, len(nodes))
+		for i, node := range nodes {
+			result[i] = node.Name()
+		}
+		return result
+	}
+	assert.Equal(t, []string{"tool1.o", "util.o", "tool2.o"},
+		names(dag.ChildNodes(dag.Lookup("util.h"))))
+	assert.Equal(t, []string{"tool1", "tool2"},
+		names(dag.ChildNodes(dag.Lookup("util.o"))))
+	assert.Equal(t, []string{},
+		names(dag.ChildNodes(dag.Lookup("tool1"))))
+
+	// copies keep the index
+	dag = dag.copy()
+	dag.verify()
+	assert.Equal(t, []string{"misc.o"},
+		names(dag.ChildNodes(dag.Lookup("misc.c"))))
+}
+
+func Test_DAG_FindAffected(t *testing.T) {
+	dag := makeSimpleGraph()
+	finder := MakeFinderNode(dag, "doc/*.txt")
+	dirnode, err := MakeDirNode(dag, "data")
+	assert.Nil(t, err)
+	doc := MakeStubNode(dag, "doc.html")
+	dag.AddParent(doc, finder)
+	dag.AddParent(dag.Lookup("tool2"), dirnode)
+	dag.verify()
+
+	tests := []struct {
+		filenames []string
+		affected  string
+		targets   string
+	}{
+		{[]string{}, "{}", "{}"},
+		{[]string{"README"}, "{}", "{}"},
+		{[]string{"misc.c"}, "{0,3,8}", "{0}"},
+		{[]string{"./util.h"}, "{0,1,2,4,5,9}", "{0,1}"},
+		{[]string{"tool2.c", "doc/new.txt"}, "{1,5,11,12,14}", "{1,14}"},
+		{[]string{"data/x/y.dat"}, "{1,13}", "{1}"},
+	}
+	for _, test := range tests {
+		affected, err := dag.FindAffected(test.filenames)
+		assert.Nil(t, err)
+		assert.Equal(t, test.affected, affected.String())
+		targets, err := dag.FindAffectedTargets(test.filenames)
+		assert.Nil(t, err)
+		assert.Equal(t, test.targets, targets.String())
+	}
+}
+
+func Test_DAG_Reset(t *testing.T) {
+	cleanup := testutils.Chtemp()
+	defer cleanup()
+	testutils.TouchFiles("foo.c")
+
+	dag := NewDAG()
+	source := MakeFileNode(dag, "foo.c")
+	target := MakeFileNode(dag, "foo.o")
+	dag.AddParent(target, source)
+	dag.MarkSources()
+
+	sig1, err := source.Signature()
+	assert.Nil(t, err)
+	target.SetState(BUILT)
+	testutils.Mkfile(".", "foo.c", "int x;\n")
+
+	// cached signature survives until Reset()
+	sig2, err := source.Signature()
+	assert.Nil(t, err)
+	assert.Equal(t, sig1, sig2)
+
+	dag.Reset()
+	assert.Equal(t, SOURCE, source.State())
+	assert.Equal(t, UNKNOWN, target.State())
+	sig2, err = source.Signature()
+	assert.Nil(t, err)
+	assert.NotEqual(t, sig1, sig2)
+}
+
 func Test_DAG_FindFinalTargets(t *testing.T) {
 	dag := makeSimpleGraph()
 	targets := (*bit.Set)(dag.FindFinalTargets())
@@ -320,6 +436,41 @@ func Test_DAG_AddManyParents(t *testing.T) {
 	}
 }
 
+func Test_DAG_AddManyOrderOnlyParents(t *testing.T) {
+	dag := NewDAG()
+	node0 := MakeStubNode(dag, "0")
+	node1 := MakeStubNode(dag, "1")
+	node2 := MakeStubNode(dag, "2")
+	node3 := MakeStubNode(dag, "3")
+
+	dag.AddManyParents([]Node{node0}, []Node{node1})
+	dag.AddManyOrderOnlyParents([]Node{node0}, []Node{node1, node2, node3})
+	dag.verify()
+	assert.False(t, dag.IsOrderOnly(node0, node1)) // already a parent
+	assert.True(t, dag.IsOrderOnly(node0, node2))
+	assert.Equal(t, 3, len(dag.ParentNodes(node0)))
+	assert.Equal(t, []Node{node1}, dag.TrackedParentNodes(node0))
+
+	// adding a normal edge overrides an order-only edge
+	dag.AddParent(node0, node3)
+	dag.verify()
+	assert.False(t, dag.IsOrderOnly(node0, node3))
+	assert.Equal(t, []Node{node1, node3}, dag.TrackedParentNodes(node0))
+
+	buf := &bytes.Buffer{}
+	dag.Dump(buf, "")
+	expect := `0000: StubNode "0" (state UNKNOWN)
+  parents:
+    0001: 1
+    0002: 2 (order-only)
+    0003: 3
+0001: StubNode "1" (state UNKNOWN)
+0002: StubNode "2" (state UNKNOWN)
+0003: StubNode "3" (state UNKNOWN)
+`
+	assert.Equal(t, expect, buf.String())
+}
+
 func Test_DAG_MarkSources(t *testing.T) {
 	dag := makeSimpleGraph()
 
@@ -5,12 +5,9 @@
 package dag
 
 import (
-	"errors"
-	"hash/fnv"
 	"os"
 	"path/filepath"
 	"reflect"
-	"regexp"
 	"strings"
 
 	"fubsy/types"
@@ -24,6 +21,10 @@ func init() {
 	methodsFinderNode = make(types.ValueMap)
 	methodsFinderNode["prune"] = types.NewVariadicFunction(
 		"prune", 0, -1, meth_FinderNode_prune)
+	methodsFinderNode["exclude"] = types.NewVariadicFunction(
+		"exclude", 0, -1, meth_FinderNode_exclude)
+	methodsFinderNode["vcsignore"] = types.NewFixedFunction(
+		"vcsignore", 0, meth_FinderNode_vcsignore)
 }
 
 // Node type that represents filefinders. Code like
@@ -38,10 +39,15 @@ type FinderNode struct {
 	// {"*.c", "foo/*.h"}
 	includes []string
 
-	// exclude patterns (can only be added by exclude() method)
-	// (currently unused)
+	// exclude patterns: e.g. for <src/**/*.c !**/test_*.c>, excludes
+	// will be {"**/test_*.c"}; any file matched by an include
+	// pattern and an exclude pattern is omitted
 	excludes []string
 
+	// ignore files and directories that are ignored by version
+	// control (.gitignore, .hgignore)
+	vcsignore bool
+
 	// set of directories to prune the walk: if we enter a directory in
 	// this set, leave it immediately -- don't look for any files there
 	prune dirset
@@ -52,19 +58,32 @@ type FinderNode struct {
 
 	// cache the result of Signature()
 	sig []byte
+
+	// signature from a previous build (see SetSignatureHint())
+	hint []byte
 }
 
 func NewFinderNode(includes ...string) *FinderNode {
-	// XXX what if the include list changes? what about excludes?
-	name := strings.Join(includes, "+")
-	node := &FinderNode{
-		nodebase: makenodebase(name),
-		includes: includes,
-	}
+	// XXX what if the include list changes?
+	node := &FinderNode{includes: includes}
+	node.nodebase = makenodebase(node.finderName())
 	node.ValueMap = methodsFinderNode
 	return node
 }
 
+// e.g. includes {"*.c", "*.h"} and excludes {"a.*"} yield
+// "*.c+*.h+!a.*" (plus ".vcsignore()" if vcsignore is set)
+func (self *FinderNode) finderName() string {
+	name := strings.Join(self.includes, "+")
+	for _, pattern := range self.excludes {
+		name += "+!" + pattern
+	}
+	if self.vcsignore {
+		name += ".vcsignore()"
+	}
+	return name
+}
+
 func MakeFinderNode(dag *DAG, includes ...string) *FinderNode {
 	node := NewFinderNode(includes...)
 	node = dag.AddNode(node).(*FinderNode)
@@ -76,7 +95,15 @@ func (self *FinderNode) Typename() string {
 }
 
 func (self *FinderNode) String() string {
-	return "<" + strings.Join(self.includes, " ") + ">"
+	result := "<" + strings.Join(self.includes, " ")
+	for _, pattern := range self.excludes {
+		result += " !" + pattern
+	}
+	result += ">"
+	if self.vcsignore {
+		result += ".vcsignore()"
+	}
+	return result
 }
 
 func (self *FinderNode) CommandString() string {
@@ -92,7 +119,8 @@ func (self *FinderNode) Equal(other_ types.FuObject) bool {
 	other, ok := other_.(*FinderNode)
 	return (ok &&
 		reflect.DeepEqual(self.includes, other.includes) &&
-		reflect.DeepEqual(self.excludes, other.excludes))
+		reflect.DeepEqual(self.excludes, other.excludes) &&
+		self.vcsignore == other.vcsignore)
 }
 
 func (self *FinderNode) Add(other_ types.FuObject) (types.FuObject, error) {
@@ -217,29 +245,171 @@ func meth_FinderNode_prune(args types.ArgSource) (types.FuObject, []error) {
 	return nil, nil
 }
 
+// Return a new FinderNode that is like this one, but also excludes
+// files matching patterns. Excludes are part of a FinderNode's
+// identity (its name), so this cannot modify the receiver: it might
+// already be in the DAG, or referenced by other variables.
+func (self *FinderNode) Exclude(patterns ...string) *FinderNode {
+	node := self.derive()
+	node.excludes = append(node.excludes, patterns...)
+	node.name = node.finderName()
+	return node
+}
+
+// Return a copy of this node that is not in any DAG and shares no
+// mutable state with it, ready to be given different patterns.
+func (self *FinderNode) derive() *FinderNode {
+	node := &FinderNode{
+		includes:  append([]string(nil), self.includes...),
+		excludes:  append([]string(nil), self.excludes...),
+		vcsignore: self.vcsignore,
+	}
+	if self.prune != nil {
+		node.prune = make(dirset, len(self.prune))
+		for dir := range self.prune {
+			node.prune[dir] = true
+		}
+	}
+	node.nodebase = makenodebase(node.finderName())
+	node.ValueMap = methodsFinderNode
+	return node
+}
+
+// Ignore files and directories that are ignored by version control,
+// i.e. matched by any .gitignore file or by .hgignore in the current
+// directory. Like Exclude(), this returns a new node, since it
+// changes the node's name.
+func (self *FinderNode) VCSIgnore() *FinderNode {
+	node := self.derive()
+	node.vcsignore = true
+	node.name = node.finderName()
+	return node
+}
+
+// Unlike prune(), exclude() does not modify its receiver: it returns
+// a new filefinder, e.g. tests = src.exclude("**/*Test.java").
+func meth_FinderNode_exclude(args types.ArgSource) (types.FuObject, []error) {
+	robj := args.Receiver().(*FinderNode)
+	patterns := make([]string, len(args.Args()))
+	for i, arg := range args.Args() {
+		patterns[i] = arg.ValueString()
+	}
+	return robj.Exclude(patterns...), nil
+}
+
+func meth_FinderNode_vcsignore(args types.ArgSource) (types.FuObject, []error) {
+	robj := args.Receiver().(*FinderNode)
+	return robj.VCSIgnore(), nil
+}
+
 func (self *FinderNode) FindFiles() ([]string, error) {
 	if self.matches != nil {
 		return self.matches, nil
 	}
 
-	var matches []string
+	includes, err := compileGlobs(self.includes)
+	if err != nil {
+		return nil, err
+	}
+	excludes, err := compileGlobs(self.excludes)
+	if err != nil {
+		return nil, err
+	}
+
+	prune := self.prune
+	var ignore *vcsIgnore
+	if self.vcsignore {
+		// directories ignored by version control are added to a
+		// private copy of the prune set as we find them, so they are
+		// never walked
+		ignore = newVCSIgnore()
+		prune = make(dirset, len(self.prune))
+		for dir := range self.prune {
+			prune[dir] = true
+		}
+	}
+
+	matches, err := findGlobs(includes, prune, ignore)
+	if err != nil {
+		return nil, err
+	}
 	result := []string{}
-	for _, pattern := range self.includes {
-		recursive, prefix, tail, err := splitPattern(pattern)
-		if err != nil {
-			return nil, err
+	for _, pmatches := range matches {
+		for _, name := range pmatches {
+			if !excluded(excludes, name) {
+				result = append(result, name)
+			}
+		}
+	}
+	self.matches = result
+	return result, nil
+}
+
+// Return true if filename matches this filefinder's patterns, i.e.
+// FindFiles() would find it if it existed. (Ignores vcsignore(),
+// which depends on what's in the filesystem.)
+func (self *FinderNode) Matches(filename string) (bool, error) {
+	includes, err := compileGlobs(self.includes)
+	if err != nil {
+		return false, err
+	}
+	excludes, err := compileGlobs(self.excludes)
+	if err != nil {
+		return false, err
+	}
+	for dir := range self.prune {
+		if hasPathPrefix(filename, dir) {
+			return false, nil
+		}
+	}
+	for _, glob := range includes {
+		if glob.match(filename) {
+			return !excluded(excludes, filename), nil
+		}
+	}
+	return false, nil
+}
+
+// Return every existing directory where adding, removing, or
+// modifying a file could change the result of FindFiles(): the base
+// directory of each include pattern (e.g. "src" for <src/**/*.c>),
+// plus any subdirectories that the patterns reach into. Pruned
+// directories are skipped; unreadable ones are silently ignored.
+func (self *FinderNode) WatchDirs() ([]string, error) {
+	includes, err := compileGlobs(self.includes)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []string{}
+	seen := make(map[string]bool)
+	visit := func(path string, info os.FileInfo, err error) error {
+		if info == nil || !info.IsDir() {
+			return nil
+		}
+		if seen[path] || self.prune.contains(path, true) {
+			return filepath.SkipDir
 		}
-		if recursive {
-			matches, err = recursiveGlob(self.prune, prefix, tail)
-		} else {
-			matches, err = simpleGlob(self.prune, pattern)
+		seen[path] = true
+		wanted := false
+		for _, glob := range includes {
+			if glob.mightContain(path) {
+				wanted = true
+				break
+			}
 		}
+		if !wanted {
+			return filepath.SkipDir
+		}
+		result = append(result, path)
 		if err != nil {
-			return nil, err
+			return filepath.SkipDir
 		}
-		result = append(result, matches...)
+		return nil
+	}
+	for _, glob := range includes {
+		walkFollow(glob.base, visit)
 	}
-	self.matches = result
 	return result, nil
 }
 
@@ -262,29 +432,36 @@ func (self *FinderNode) Signature() ([]byte, error) {
 	// the signature consists of:
 	//   sequence of {
 	//       filename_hash []byte
-	//       file_hash []byte
+	//       file_sig []byte
 	//   }
-	// this means we can do a simple bytewise comparison to detect
-	// change (file added, file removed, file modified), but later we
-	// can decode this and figure out *exactly what* changed, for
-	// better reporting to the user ("rebuilding x.jar because you
-	// added 3 files to <src/x/**/*.java>")
-
-	hash := fnv.New64a()
-	sig := make([]byte, 0, (2*hash.Size())*len(filenames))
-	for _, filename := range filenames {
-		hash.Reset()
-		hash.Write(([]byte)(filename))
-		sig = hash.Sum(sig)
-
-		hash.Reset()
-		err = HashFile(filename, hash)
-		if err != nil {
-			return nil, err
+	// where file_sig depends on the signature mode: a hash of the
+	// file content, its stat info, or both. If there are exclude
+	// patterns or vcsignore is set, the first entry is a hash of those
+	// settings (padded with zeros), so that changing them changes the
+	// signature even if the same files are matched. This means we can do a
+	// simple bytewise comparison to detect change (file added, file
+	// removed, file modified), but later we can decode this and
+	// figure out *exactly what* changed, for better reporting to the
+	// user ("rebuilding x.jar because you added 3 files to
+	// <src/x/**/*.java>")
+
+	mode := signatureMode(self.Typename())
+	hash := newHash()
+	sig := make([]byte, 0,
+		(hash.Size()+fileSignatureSize(mode))*(len(filenames)+1))
+	if len(self.excludes) > 0 || self.vcsignore {
+		hash.Write([]byte{0})
+		for _, pattern := range self.excludes {
+			hash.Write(([]byte)(pattern))
+			hash.Write([]byte{0})
+		}
+		if self.vcsignore {
+			hash.Write([]byte(".vcsignore()"))
 		}
 		sig = hash.Sum(sig)
+		sig = append(sig, make([]byte, fileSignatureSize(mode))...)
 	}
-	return sig, nil
+	return appendFileListSignature(sig, filenames, mode, self.hint)
 
 	// // the signature consists of:
 	// // - hash(concatenated filenames)
@@ -308,6 +485,27 @@ func (self *FinderNode) Signature() ([]byte, error) {
 	// return signature, nil
 }
 
+func (self *FinderNode) SetSignatureHint(oldsig []byte) {
+	self.hint = oldsig
+}
+
+func (self *FinderNode) forget() {
+	self.matches = nil
+	self.sig = nil
+	self.hint = nil
+}
+
+func (self *FinderNode) Changed(oldsig, newsig []byte) bool {
+	mode := signatureMode(self.Typename())
+	if mode != HYBRID {
+		return self.nodebase.Changed(oldsig, newsig)
+	}
+	if oldsig == nil || newsig == nil {
+		panic("node signatures must not be nil")
+	}
+	return fileListSignatureChanged(mode, oldsig, newsig)
+}
+
 // Wildcard expansion -- nothing past here has anything to do with
 // FuObject, Node, FinderNode, or any of that high-level stuff. It's
 // purely about filename patterns and walking the filesystem.
@@ -342,175 +540,23 @@ func (self dirset) contains(name string, exact bool) bool {
 	return false
 }
 
-// Scan pattern for the recursive glob pattern "**". If any are found,
-// return recursive = true, prefix = pattern up to the first "**/" and
-// tail = the part after it. If no recursive glob found, return
-// recursive = false. Otherwise return an error describing exactly
-// what is wrong with the pattern.
-func splitPattern(pattern string) (
-	recursive bool,
-	prefix, tail string,
-	err error) {
-	idx := strings.Index(pattern, "**")
-	if idx == -1 {
-		recursive = false
-		return
-	}
-	if idx > 0 && pattern[idx-1] != '/' {
-		// XXX assumes patterns have been normalized to Unix syntax
-		err = errors.New(
-			"recursive glob pattern ** may only occur " +
-				"at the start of a pattern or immediately after /")
-		return
-	}
-	if idx > len(pattern)-4 || pattern[idx+2] != '/' {
-		// the minimum valid pattern is "**/x": "**/" and "**" are invalid
-		err = errors.New(
-			"recursive glob pattern ** must be followed " +
-				"by / and at least one more character")
-		return
-	}
-	recursive = true
-	if idx == 0 {
-		prefix = "."
-	} else {
-		prefix = pattern[0 : idx-1]
-	}
-	tail = pattern[idx+3:]
-	return
-}
-
-func simpleGlob(prune dirset, pattern string) ([]string, error) {
-	matches, err := filepath.Glob(pattern)
-	if err != nil {
-		return matches, err
-	}
-	result := make([]string, 0, len(matches))
-	for _, name := range matches {
-		// for non-recursive patterns, pruning just ends up being like
-		// an exclude pattern
-		if !prune.contains(filepath.Dir(name), false) {
-			result = append(result, name)
-		}
-	}
-	return result, nil
-}
-
-func recursiveGlob(prune dirset, prefix, tail string) ([]string, error) {
-	// prefix might be "", "foo", "fo?", or "fo?/*/b*r": let
-	// filepath.Glob() find all matching filenames, and then reduce
-	// the list to matching directories
-
-	// XXX using filepath.Glob() means that sometimes we allow \ as an
-	// escape character, and sometimes we don't: I suspect we're just
-	// gonna have to reimplement filepath.Glob() and friends to get
-	// exactly the syntax we want ;-(
-
-	allmatches, err := filepath.Glob(prefix)
-	if err != nil {
-		return nil, err
-	}
-	dirmatches := []string{}
-	for _, name := range allmatches {
-		info, err := os.Stat(name)
-		if err != nil {
-			return nil, err
-		}
-		if info.IsDir() && !prune.contains(name, false) {
-			dirmatches = append(dirmatches, name)
-		}
-	}
-
-	tail, err = translateGlob(tail)
-	if err != nil {
-		return nil, err
-	}
-	tailre, err := regexp.Compile(tail)
-	if err != nil {
-		return nil, err
-	}
-
-	// Recursively walk each directory matched by prefix, testing
-	// every file found against tailre.
-	var curdir string
-	var matches []string
-	var choplen int // leading bytes to ignore
-	visit := func(path string, info os.FileInfo, err error) error {
-		if prune.contains(path, true) {
-			return filepath.SkipDir
-		}
-
-		// fail if anything is unreadable (do not silently ignore, unless
-		// this directory was pruned)
-		if err != nil {
-			return err
-		}
-		if path == curdir {
-			// ignore starting point of this walk
-			return nil
-		}
-
-		relevant := path[choplen:]
-		if !info.IsDir() && tailre.FindString(relevant) != "" {
-			matches = append(matches, path)
-		}
-		return nil
-	}
-
-	for _, curdir = range dirmatches {
-		if curdir == "." {
-			// filepath.Walk() conveniently drops the leading "./"
-			choplen = 0
-		} else {
-			choplen = len(curdir) + 1
-		}
-		err := filepath.Walk(curdir, visit)
+func compileGlobs(patterns []string) ([]*globPattern, error) {
+	result := make([]*globPattern, len(patterns))
+	for i, pattern := range patterns {
+		glob, err := compileGlob(pattern)
 		if err != nil {
 			return nil, err
 		}
+		result[i] = glob
 	}
+	return result, nil
+}
 
-	return matches, nil
-}
-
-// Translate a Unix wildcard pattern to a regular expression (caller
-// must compile it). Syntax:
-// - "*" matches zero or more non-separator characters
-//   (where separator is platform-dependent / or \)
-// - "?" matches exactly one non-separator character
-// - "[<range>]" matches exactly one character in <range> (using
-//   RE2 regex syntax)
-// - "**" matches zero or more characters (including separators) --
-//   effectively a recursive search
-func translateGlob(glob string) (string, error) {
-	re := []byte{}
-	for i := 0; i < len(glob); i++ {
-		ch := glob[i]
-		switch ch {
-		case '*':
-			if i+1 < len(glob) && glob[i+1] == '*' {
-				re = append(re, ".*"...)
-				i++
-			} else {
-				re = append(re, "[^/]*"...)
-			}
-		case '?':
-			re = append(re, "[^/]"...)
-		case '.':
-			re = append(re, "\\."...)
-		case '[':
-			for ; i < len(glob) && glob[i] != ']'; i++ {
-				re = append(re, glob[i])
-			}
-			if i < len(glob) {
-				re = append(re, ']')
-			} else {
-				return "", errors.New("unterminated character range")
-			}
-		default:
-			re = append(re, ch)
+func excluded(excludes []*globPattern, name string) bool {
+	for _, glob := range excludes {
+		if glob.match(name) {
+			return true
 		}
 	}
-	re = append(re, '$')
-	return string(re), nil
+	return false
 }
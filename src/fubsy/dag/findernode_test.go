@@ -6,7 +6,6 @@ package dag
 
 import (
 	"reflect"
-	"regexp"
 	"testing"
 
 	"github.com/stretchrcom/testify/assert"
@@ -19,6 +18,11 @@ func Test_FinderNode_String(t *testing.T) {
 	var finder types.FuObject
 	finder = &FinderNode{includes: []string{"*.c", "**/*.h"}}
 	assert.Equal(t, "<*.c **/*.h>", finder.String())
+
+	finder = &FinderNode{
+		includes: []string{"**/*.c"},
+		excludes: []string{"test/*", "*_gen.c"}}
+	assert.Equal(t, "<**/*.c !test/* !*_gen.c>", finder.String())
 }
 
 func Test_FinderNode_CommandString(t *testing.T) {
@@ -35,6 +39,12 @@ func Test_FinderNode_Equal(t *testing.T) {
 	assert.True(t, finder1.Equal(finder1))
 	assert.True(t, finder1.Equal(finder2))
 	assert.False(t, finder1.Equal(finder3))
+
+	finder1 = finder1.Exclude("a.c")
+	assert.False(t, finder1.Equal(finder2))
+	assert.Equal(t, "*.c+*.h+!a.c", finder1.Name())
+	finder2 = finder2.Exclude("a.c")
+	assert.True(t, finder1.Equal(finder2))
 }
 
 func Test_FinderNode_Add(t *testing.T) {
@@ -180,6 +190,69 @@ func Test_FinderNode_Lookup(t *testing.T) {
 	code := val.(*types.FuFunction).Code()
 	assert.True(t, code != nil) // argh: cannot compare function pointers!
 	assert.True(t, ok)
+
+	val, ok = node.Lookup("exclude")
+	assert.True(t, ok)
+	assert.Equal(t, "exclude", val.(*types.FuFunction).Name())
+}
+
+func Test_FinderNode_exclude_method(t *testing.T) {
+	node := NewFinderNode("src/**/*.java")
+	args := types.MakeBasicArgs(node,
+		[]types.FuObject{
+			types.MakeFuString("**/*Test.java"),
+			types.MakeFuString("gen/**/*.java")},
+		nil)
+	result, errs := meth_FinderNode_exclude(args)
+	assert.Equal(t, 0, len(errs))
+	excluded := result.(*FinderNode)
+	assert.Equal(t,
+		"<src/**/*.java !**/*Test.java !gen/**/*.java>", excluded.String())
+	assert.Equal(t,
+		"src/**/*.java+!**/*Test.java+!gen/**/*.java", excluded.Name())
+
+	// the receiver is unchanged
+	assert.Equal(t, "<src/**/*.java>", node.String())
+	assert.Equal(t, "src/**/*.java", node.Name())
+}
+
+func Test_FinderNode_Exclude_in_dag(t *testing.T) {
+	// excluding from a finder that is already in the DAG leaves the
+	// DAG (and anything else using that finder) alone
+	dag := NewDAG()
+	finder := MakeFinderNode(dag, "*.c")
+	excluded := finder.Exclude("x.c")
+	assert.True(t, dag.Lookup("*.c") == finder)
+	assert.Equal(t, "*.c", finder.Name())
+	assert.Equal(t, 0, len(finder.excludes))
+	assert.Nil(t, dag.Lookup("*.c+!x.c"))
+
+	excluded = dag.AddNode(excluded).(*FinderNode)
+	assert.True(t, dag.Lookup("*.c+!x.c") == excluded)
+	assert.True(t, dag.Lookup("*.c") == finder)
+}
+
+func Test_FinderNode_Matches(t *testing.T) {
+	finder := NewFinderNode("src/**/*.c", "*.h")
+	finder = finder.Exclude("**/test_*")
+	finder.Prune("src/old")
+	tests := []struct {
+		filename string
+		expect   bool
+	}{
+		{"src/a.c", true},
+		{"src/lib/b.c", true},
+		{"foo.h", true},
+		{"lib/foo.h", false},
+		{"src/lib/test_b.c", false},
+		{"src/old/c.c", false},
+		{"src/a.o", false},
+	}
+	for _, test := range tests {
+		match, err := finder.Matches(test.filename)
+		assert.Nil(t, err)
+		assert.Equal(t, test.expect, match, test.filename)
+	}
 }
 
 func Test_FinderNode_Expand_empty(t *testing.T) {
@@ -434,6 +507,76 @@ func Test_FinderNode_FindFiles_prune(t *testing.T) {
 	test(expect)
 }
 
+func Test_FinderNode_FindFiles_exclude(t *testing.T) {
+	cleanup := testutils.Chtemp()
+	defer cleanup()
+
+	testutils.TouchFiles(
+		"a.c", "a_test.c", "b.c",
+		"lib/x.c", "lib/x_test.c", "lib/gen/y.c",
+		"test/t.c")
+
+	finder := NewFinderNode("*.c")
+	finder = finder.Exclude("*_test.c")
+	assertExpand(t, nil, []string{"a.c", "b.c"}, finder)
+
+	finder = NewFinderNode("**/*.c")
+	finder = finder.Exclude("**/*_test.c", "lib/gen/*", "test/*")
+	assertExpand(t, nil, []string{"a.c", "b.c", "lib/x.c"}, finder)
+
+	// exclude patterns match whole filenames
+	finder = NewFinderNode("*/*.c")
+	finder = finder.Exclude("x.c")
+	assertExpand(t, nil, []string{"lib/x.c", "lib/x_test.c", "test/t.c"}, finder)
+
+	finder = NewFinderNode("**/*.c")
+	finder = finder.Exclude("[a-")
+	_, err := finder.FindFiles()
+	assert.Equal(t, "unterminated character range", err.Error())
+}
+
+func Test_FinderNode_WatchDirs(t *testing.T) {
+	cleanup := testutils.Chtemp()
+	defer cleanup()
+
+	testutils.TouchFiles(
+		"src/a/1.c", "src/b/b/2.c", "lib/x.c", "lib/sub/x.c", "doc/x.txt")
+
+	finder := NewFinderNode("src/**/*.c", "lib/*.c", "nope/*.c")
+	finder.Prune("src/a")
+	dirs, err := finder.WatchDirs()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"src", "src/b", "src/b/b", "lib"}, dirs)
+
+	finder = NewFinderNode("*.c")
+	dirs, err = finder.WatchDirs()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"."}, dirs)
+}
+
+func Test_FinderNode_Signature_exclude(t *testing.T) {
+	cleanup := testutils.Chtemp()
+	defer cleanup()
+
+	testutils.TouchFiles("a.c", "b.c", "c.c")
+
+	// exclude patterns that don't exclude anything still affect
+	// the signature
+	finder1 := NewFinderNode("*.c")
+	finder2 := NewFinderNode("*.c")
+	finder2 = finder2.Exclude("*.h")
+	sig1, err := finder1.Signature()
+	assert.Nil(t, err)
+	sig2, err := finder2.Signature()
+	assert.Nil(t, err)
+	assert.True(t, finder1.Changed(sig1, sig2))
+
+	finder1 = finder1.Exclude("*.h")
+	sig1, err = finder1.Signature()
+	assert.Nil(t, err)
+	assert.False(t, finder1.Changed(sig1, sig2))
+}
+
 func assertExpand(
 	t *testing.T, ns types.Namespace, expect []string, obj types.FuObject) {
 	if ns == nil {
@@ -464,111 +607,3 @@ func Test_MakeFinderNode(t *testing.T) {
 	assert.Equal(t, "<**/*.java>", node0.String())
 	assert.Equal(t, "<doc/*/*.html>", node1.String())
 }
-
-func Test_translateGlob(t *testing.T) {
-	tests := []struct {
-		glob string
-		re   string
-	}{
-		{"", "$"},
-		{"foo", "foo$"},
-		{"foo/bar", "foo/bar$"},
-
-		{"foo?bar", "foo[^/]bar$"},
-		{"*.c", "[^/]*\\.c$"},
-		{"foo[abc]", "foo[abc]$"},
-		{"foo[a-m]*.bop", "foo[a-m][^/]*\\.bop$"},
-		{"foo/**/bar", "foo/.*/bar$"},
-		{"**/foo/bar", ".*/foo/bar$"},
-		{"foo/bar/**", "foo/bar/.*$"},
-		{"foo/**/bar/**/baz/**", "foo/.*/bar/.*/baz/.*$"},
-	}
-
-	for _, pair := range tests {
-		actual, err := translateGlob(pair.glob)
-		assert.Nil(t, err)
-		assert.Equal(t, pair.re, actual)
-	}
-
-	// make sure one of those regexps actually works as intended
-	pat, err := translateGlob("foo[a-m]/p*g/*.[ch]")
-	assert.Nil(t, err)
-	re, err := regexp.Compile("^" + pat)
-	assert.Nil(t, err)
-	match := []string{
-		"foom/pong/bop.c",
-		"foog/pig/abc.c",
-		"foog/pig/a.c.-af#@0(.h",
-		"foob/pg/a_b&.c",
-	}
-	for _, fn := range match {
-		assert.Equal(t, fn, re.FindString(fn))
-	}
-
-	nomatch := []string{
-		"foo/pong/bop.c",
-		"foom/pongx/bop.c",
-		"foom/pong/bop.cpp",
-		"foom/pong/bop.c/x",
-		"fooz/pong/bop.c",
-		"foom/pg/bop.d",
-	}
-	for _, fn := range nomatch {
-		assert.Equal(t, "", re.FindString(fn))
-	}
-}
-
-func Test_translateGlob_error(t *testing.T) {
-	_, err := translateGlob("foo[a-f*.c")
-	assert.Equal(t, "unterminated character range", err.Error())
-}
-
-func Test_splitPattern_no_recursive(t *testing.T) {
-	patterns := []string{
-		"",
-		"foobar",
-		"foo/b?r/*/blah/*.[ch]",
-	}
-	for _, pattern := range patterns {
-		recursive, _, _, err := splitPattern(pattern)
-		assert.False(t, recursive)
-		assert.Nil(t, err)
-	}
-}
-
-func Test_splitPattern_valid_recursive(t *testing.T) {
-	tests := []struct {
-		glob   string
-		prefix string
-		tail   string
-	}{
-		{"**/*.c", ".", "*.c"},
-		{"**/foo/b?r/*.[ch]", ".", "foo/b?r/*.[ch]"},
-		{"foo/**/*.c", "foo", "*.c"},
-		{"f?o/*/**/?eep/*.[ch]", "f?o/*", "?eep/*.[ch]"},
-	}
-
-	for _, test := range tests {
-		recursive, prefix, tail, err := splitPattern(test.glob)
-		assert.True(t, recursive)
-		assert.Nil(t, err)
-		assert.Equal(t, test.prefix, prefix)
-		assert.Equal(t, test.tail, tail)
-	}
-}
-
-func Test_splitPattern_invalid(t *testing.T) {
-	patterns := []string{
-		"**",
-		"**/",
-		"foo/**",
-		"foo/**/",
-		"foo**/x",
-		"foo/**x",
-	}
-
-	for _, pattern := range patterns {
-		_, _, _, err := splitPattern(pattern)
-		assert.NotNil(t, err)
-	}
-}
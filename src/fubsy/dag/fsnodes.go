@@ -9,9 +9,9 @@ package dag
 import (
 	"errors"
 	"hash"
-	"hash/fnv"
 	"io"
 	"os"
+	"path/filepath"
 	"syscall"
 
 	"fubsy/types"
@@ -23,6 +23,9 @@ type FileNode struct {
 
 	// cache the signature so we only compute it once per process
 	sig []byte
+
+	// signature from a previous build (see SetSignatureHint())
+	hint []byte
 }
 
 // Lookup and return the named file node in dag. If it doesn't exist,
@@ -102,18 +105,234 @@ func (self *FileNode) Signature() ([]byte, error) {
 	if self.sig != nil {
 		return self.sig, nil
 	}
-	hash := fnv.New64a()
-	err := HashFile(self.Name(), hash)
+	mode := signatureMode(self.Typename())
+	signature, err := fileSignature(self.Name(), mode, self.hint)
+	if err != nil {
+		return nil, err
+	}
+	self.sig = signature
+	return signature, nil
+}
+
+func (self *FileNode) SetSignatureHint(oldsig []byte) {
+	self.hint = oldsig
+}
+
+func (self *FileNode) forget() {
+	self.sig = nil
+	self.hint = nil
+}
+
+func (self *FileNode) Changed(oldsig, newsig []byte) bool {
+	mode := signatureMode(self.Typename())
+	if mode != HYBRID {
+		return self.nodebase.Changed(oldsig, newsig)
+	}
+	if oldsig == nil || newsig == nil {
+		panic("node signatures must not be nil")
+	}
+	return fileSignatureChanged(mode, oldsig, newsig)
+}
+
+// A directory whose contents are not known in advance, e.g. the
+// output of a tool like javac that decides for itself which files to
+// write. The signature covers every file in the tree under the
+// directory, so a DirNode can be the target of a rule that populates
+// it and a source for later rules that consume it.
+type DirNode struct {
+	// name: directory name (relative to top)
+	nodebase
+
+	// cache the signature so we only compute it once per process
+	sig []byte
+
+	// signature from a previous build (see SetSignatureHint())
+	hint []byte
+}
+
+// Lookup and return the named directory node in dag. If it doesn't
+// exist, create a new DirNode, add it to dag, and return it. If it
+// does exist but isn't a DirNode, return an error.
+func MakeDirNode(dag *DAG, name string) (*DirNode, error) {
+	node, err := dag.addNodeChecked(NewDirNode(name))
+	if err != nil {
+		return nil, err
+	}
+	return node.(*DirNode), nil
+}
+
+func NewDirNode(name string) *DirNode {
+	return &DirNode{nodebase: makenodebase(name)}
+}
+
+func (self *DirNode) Typename() string {
+	return "DirNode"
+}
+
+func (self *DirNode) Equal(other_ types.FuObject) bool {
+	other, ok := other_.(*DirNode)
+	return ok && other.name == self.name
+}
+
+func (self *DirNode) Add(other_ types.FuObject) (types.FuObject, error) {
+	var err error
+	var result types.FuObject
+	switch other := other_.(type) {
+	case types.FuString:
+		// e.g. classdir + "Main.class" (or "/Main.class"): a file in
+		// this directory
+		result = NewFileNode(filepath.Join(self.name, other.ValueString()))
+	default:
+		result, err = defaultNodeAdd(self, other)
+	}
+	return result, err
+}
+
+func (self *DirNode) List() []types.FuObject {
+	return []types.FuObject{self}
+}
+
+func (self *DirNode) ActionExpand(
+	ns types.Namespace, ctx *types.ExpandContext) (
+	types.FuObject, error) {
+	return defaultNodeActionExpand(self, ns)
+}
+
+func (self *DirNode) copy() Node {
+	var c DirNode = *self
+	return &c
+}
+
+func (self *DirNode) Exists() (bool, error) {
+	info, err := os.Stat(self.name)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if !info.IsDir() {
+		return false, &os.PathError{
+			Op:   "stat",
+			Path: self.name,
+			Err:  errors.New("not a directory")}
+	}
+	return true, nil
+}
+
+// Return the names of all files under this directory, in lexical
+// order (subdirectories themselves are not included).
+func (self *DirNode) Files() ([]string, error) {
+	filenames := []string{}
+	visit := func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			filenames = append(filenames, path)
+		}
+		return nil
+	}
+	err := filepath.Walk(self.name, visit)
+	if err != nil {
+		return nil, err
+	}
+	return filenames, nil
+}
+
+func (self *DirNode) Signature() ([]byte, error) {
+	if self.sig != nil {
+		return self.sig, nil
+	}
+	filenames, err := self.Files()
 	if err != nil {
 		return nil, err
 	}
 
-	signature := make([]byte, 0, hash.Size())
-	signature = hash.Sum(signature)
+	// same layout as FinderNode: a (filename hash, file signature)
+	// entry for every file, so adding, removing, or modifying any
+	// file in the tree changes the signature
+	mode := signatureMode(self.Typename())
+	signature, err := appendFileListSignature(
+		[]byte{}, filenames, mode, self.hint)
+	if err != nil {
+		return nil, err
+	}
 	self.sig = signature
 	return signature, nil
 }
 
+func (self *DirNode) SetSignatureHint(oldsig []byte) {
+	self.hint = oldsig
+}
+
+func (self *DirNode) forget() {
+	self.sig = nil
+	self.hint = nil
+}
+
+func (self *DirNode) Changed(oldsig, newsig []byte) bool {
+	mode := signatureMode(self.Typename())
+	if mode != HYBRID {
+		return self.nodebase.Changed(oldsig, newsig)
+	}
+	if oldsig == nil || newsig == nil {
+		panic("node signatures must not be nil")
+	}
+	return fileListSignatureChanged(mode, oldsig, newsig)
+}
+
+// An executable program run by build actions (e.g. /usr/bin/gcc),
+// usually found by searching PATH. It's a FileNode in every respect
+// except that it isn't an input to the actions: it's there so that
+// upgrading the compiler rebuilds everything compiled with it.
+type ToolNode struct {
+	// name: absolute path to the executable (or relative to top)
+	FileNode
+}
+
+// Lookup and return the tool node for the executable filename in
+// dag. If it doesn't exist, create a new ToolNode, add it to dag, and
+// return it. If it does exist but isn't a ToolNode, return an error.
+func MakeToolNode(dag *DAG, filename string) (*ToolNode, error) {
+	node, err := dag.addNodeChecked(NewToolNode(filename))
+	if err != nil {
+		return nil, err
+	}
+	return node.(*ToolNode), nil
+}
+
+func NewToolNode(filename string) *ToolNode {
+	return &ToolNode{FileNode: *NewFileNode(filename)}
+}
+
+func (self *ToolNode) Typename() string {
+	return "ToolNode"
+}
+
+func (self *ToolNode) Equal(other_ types.FuObject) bool {
+	other, ok := other_.(*ToolNode)
+	return ok && other.name == self.name
+}
+
+func (self *ToolNode) Add(other types.FuObject) (types.FuObject, error) {
+	return defaultNodeAdd(self, other)
+}
+
+func (self *ToolNode) List() []types.FuObject {
+	return []types.FuObject{self}
+}
+
+func (self *ToolNode) ActionExpand(
+	ns types.Namespace, ctx *types.ExpandContext) (
+	types.FuObject, error) {
+	return defaultNodeActionExpand(self, ns)
+}
+
+func (self *ToolNode) copy() Node {
+	var c ToolNode = *self
+	return &c
+}
+
 func HashFile(filename string, hasher hash.Hash) error {
 	file, err := os.Open(filename)
 	if err != nil {
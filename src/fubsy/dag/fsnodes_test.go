@@ -276,6 +276,125 @@ func Test_FileNode_Changed(t *testing.T) {
 	assert.True(t, node.Changed(osig, nsig))
 }
 
+func Test_DirNode_Add(t *testing.T) {
+	node := NewDirNode("classes")
+	result, err := node.Add(types.MakeFuString("/Main.class"))
+	assert.Nil(t, err)
+	assert.Equal(t, NewFileNode("classes/Main.class"), result)
+
+	result, err = node.Add(types.MakeFuString("Main.class"))
+	assert.Nil(t, err)
+	assert.Equal(t, NewFileNode("classes/Main.class"), result)
+}
+
+func Test_DirNode_Exists(t *testing.T) {
+	cleanup := testutils.Chtemp()
+	defer cleanup()
+
+	testutils.TouchFiles("foo.txt", "a/b/c.txt")
+
+	tests := []struct {
+		name   string
+		exists bool
+		err    string
+	}{
+		{"a", true, ""},
+		{"a/b", true, ""},
+		{"foo.txt", false, "stat foo.txt: not a directory"},
+		{"bogus", false, ""},
+	}
+	for _, test := range tests {
+		node := NewDirNode(test.name)
+		exists, err := node.Exists()
+		if test.err != "" {
+			assert.NotNil(t, err)
+			assert.Equal(t, test.err, err.Error())
+		} else {
+			assert.Nil(t, err)
+		}
+		if exists != test.exists {
+			t.Errorf("%v: expected Exists() %v, got %v",
+				node, test.exists, exists)
+		}
+	}
+}
+
+func Test_DirNode_Signature(t *testing.T) {
+	cleanup := testutils.Chtemp()
+	defer cleanup()
+
+	testutils.Mkdirs("classes/org/example", "classes/empty")
+	node := NewDirNode("classes")
+	files, err := node.Files()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{}, files)
+	sig0, err := node.Signature()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{}, sig0)
+
+	testutils.Mkfile("classes/org/example", "Main.class", "main")
+	testutils.Mkfile("classes", "Util.class", "util")
+	node = NewDirNode("classes")
+	files, err = node.Files()
+	assert.Nil(t, err)
+	assert.Equal(t,
+		[]string{"classes/Util.class", "classes/org/example/Main.class"},
+		files)
+	sig1, err := node.Signature()
+	assert.Nil(t, err)
+	assert.Equal(t, 2*(8+8), len(sig1))
+	assert.True(t, node.Changed(sig0, sig1))
+
+	// cached: changes are not seen by the same object
+	testutils.Mkfile("classes/org/example", "Main.class", "main2")
+	sig2, err := node.Signature()
+	assert.Nil(t, err)
+	assert.Equal(t, sig1, sig2)
+
+	// modifying any file in the tree changes the signature
+	node = NewDirNode("classes")
+	sig2, err = node.Signature()
+	assert.Nil(t, err)
+	assert.True(t, node.Changed(sig1, sig2))
+
+	// and so does renaming one
+	err = os.Rename("classes/Util.class", "classes/empty/Util.class")
+	assert.Nil(t, err)
+	node = NewDirNode("classes")
+	sig3, err := node.Signature()
+	assert.Nil(t, err)
+	assert.True(t, node.Changed(sig2, sig3))
+
+	node = NewDirNode("bogus")
+	_, err = node.Signature()
+	assert.NotNil(t, err)
+}
+
+func Test_ToolNode(t *testing.T) {
+	cleanup := testutils.Chtemp()
+	defer cleanup()
+	testutils.Mkfile(".", "tool", "#!/bin/sh\n")
+
+	dag := NewDAG()
+	node, err := MakeToolNode(dag, "tool")
+	assert.Nil(t, err)
+	assert.Equal(t, "ToolNode", node.Typename())
+	node2, err := MakeToolNode(dag, "tool")
+	assert.Nil(t, err)
+	assert.True(t, node == node2)
+	assert.False(t, node.Equal(NewFileNode("tool")))
+
+	// otherwise, it's just a FileNode
+	exists, err := node.Exists()
+	assert.Nil(t, err)
+	assert.True(t, exists)
+	sig, err := node.Signature()
+	assert.Nil(t, err)
+	expect, err := NewFileNode("tool").Signature()
+	assert.Nil(t, err)
+	assert.Equal(t, expect, sig)
+}
+
 func Benchmark_FileNode_AddParent(b *testing.B) {
 	b.StopTimer()
 	dag := NewDAG()
@@ -0,0 +1,504 @@
+// Copyright © 2013, Greg Ward. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE.txt file.
+
+package dag
+
+// Fubsy's wildcard syntax, and the code that walks the filesystem
+// looking for files that match it. Syntax:
+//
+//   *         matches zero or more characters except /
+//   ?         matches exactly one character except /
+//   [abc]     matches one character in the set (ranges like [a-z]
+//             work too); never matches /
+//   [!abc]    matches one character not in the set (or [^abc]);
+//             never matches /
+//   **/       matches zero or more directories; a trailing ** matches
+//             every file at any depth (e.g. "test/**"); ** is only
+//             allowed as a whole path component
+//   {a,b,c}   matches any of the comma-separated alternatives, which
+//             may contain wildcards (including /, **, and nested
+//             braces)
+//   \x        matches x literally, for any character x (e.g. \* or
+//             \{), both inside and outside [...]
+//
+// A pattern must match an entire filename, i.e. "*.c" matches
+// "foo.c" but not "lib/foo.c". Wildcards match filenames starting
+// with "." just like any other filename. Patterns only ever match
+// files, never directories. Symbolic links to directories are
+// followed, except where they lead back to a directory that contains
+// them.
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// a compiled wildcard pattern
+type globPattern struct {
+	pattern string
+	re      *regexp.Regexp
+
+	// longest leading sequence of path components in pattern that
+	// contain no wildcards: the only directory that must be searched
+	// for matches (e.g. "src/main" for "src/main/**/*.java")
+	base string
+
+	// number of path components in every path matched by this
+	// pattern, or -1 if that varies (because of ** or braces)
+	depth int
+}
+
+func compileGlob(pattern string) (*globPattern, error) {
+	for strings.HasPrefix(pattern, "./") {
+		pattern = strings.TrimLeft(pattern[2:], "/")
+	}
+	if strings.HasSuffix(pattern, "/") {
+		return nil, errors.New(
+			"glob pattern must not end with / (patterns only match files)")
+	}
+	restr, err := translateGlob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	re, err := regexp.Compile("^" + restr + "$")
+	if err != nil {
+		return nil, err
+	}
+
+	glob := &globPattern{pattern: pattern, re: re, base: globBase(pattern)}
+	if strings.Contains(pattern, "**") || slashInBraces(pattern) {
+		glob.depth = -1
+	} else {
+		glob.depth = countComponents(pattern)
+	}
+	return glob, nil
+}
+
+func (self *globPattern) String() string {
+	return self.pattern
+}
+
+// Return true if this pattern matches the entire path name.
+func (self *globPattern) match(path string) bool {
+	return self.re.MatchString(path)
+}
+
+// Return true if this pattern might match files somewhere under dir,
+// i.e. it's worth walking dir.
+func (self *globPattern) mightContain(dir string) bool {
+	if !(hasPathPrefix(dir, self.base) || hasPathPrefix(self.base, dir)) {
+		return false
+	}
+	return self.depth < 0 || countComponents(dir) < self.depth
+}
+
+// Translate a wildcard pattern (see above for syntax) to a regular
+// expression (unanchored: caller must add ^ and $ as needed).
+func translateGlob(glob string) (string, error) {
+	re := []byte{}
+	chars := []rune(glob)
+	depth := 0 // nesting level inside {...}
+	for i := 0; i < len(chars); i++ {
+		ch := chars[i]
+		switch ch {
+		case '*':
+			if i+1 < len(chars) && chars[i+1] == '*' {
+				if i > 0 && !strings.ContainsRune("/{,", chars[i-1]) {
+					// XXX assumes patterns have been normalized to Unix syntax
+					return "", errors.New(
+						"recursive glob pattern ** may only occur " +
+							"at the start of a pattern or immediately after /")
+				}
+				if i+2 == len(chars) ||
+					(depth > 0 && strings.ContainsRune(",}", chars[i+2])) {
+					// trailing ** matches everything below this point
+					re = append(re, ".+"...)
+					i++
+					break
+				}
+				if chars[i+2] != '/' {
+					return "", errors.New(
+						"recursive glob pattern ** must be followed " +
+							"by / or end the pattern")
+				}
+				re = append(re, "(?:.*/)?"...)
+				i += 2
+			} else {
+				re = append(re, "[^/]*"...)
+			}
+		case '?':
+			re = append(re, "[^/]"...)
+		case '[':
+			class, end, err := translateClass(chars, i)
+			if err != nil {
+				return "", err
+			}
+			re = append(re, class...)
+			i = end
+		case '{':
+			re = append(re, "(?:"...)
+			depth++
+		case ',':
+			if depth > 0 {
+				re = append(re, '|')
+			} else {
+				re = append(re, ',')
+			}
+		case '}':
+			if depth > 0 {
+				re = append(re, ')')
+				depth--
+			} else {
+				re = append(re, "\\}"...)
+			}
+		case '\\':
+			if i+1 == len(chars) {
+				return "", errors.New("pattern ends with unescaped \\")
+			}
+			i++
+			re = append(re, regexp.QuoteMeta(string(chars[i]))...)
+		default:
+			re = append(re, regexp.QuoteMeta(string(ch))...)
+		}
+	}
+	if depth > 0 {
+		return "", errors.New("unterminated brace expression")
+	}
+	return string(re), nil
+}
+
+// Translate the character class starting at chars[start] (which must
+// be '[') to a regular expression. Return the regexp and the index of
+// the closing ']'. The class never matches '/', even if the pattern
+// says it should.
+func translateClass(chars []rune, start int) (string, int, error) {
+	re := []rune{'['}
+	i := start + 1
+	if i < len(chars) && (chars[i] == '!' || chars[i] == '^') {
+		re = append(re, '^', '/')
+		i++
+	}
+	negate := len(re) > 1
+
+	// return the (possibly escaped) character at chars[i], and the
+	// index of the next character
+	next := func(i int) (rune, int) {
+		if chars[i] == '\\' && i+1 < len(chars) {
+			return chars[i+1], i + 2
+		}
+		return chars[i], i + 1
+	}
+	quote := func(ch rune) []rune {
+		if ch < 128 && !isAlnum(byte(ch)) {
+			return []rune{'\\', ch}
+		}
+		return []rune{ch}
+	}
+	addRange := func(lo, hi rune) {
+		if !negate && lo <= '/' && '/' <= hi {
+			// split the range to leave out '/'
+			if lo < '/' {
+				re = append(re, quote(lo)...)
+				re = append(re, '-')
+				re = append(re, quote('/'-1)...)
+			}
+			if hi > '/' {
+				re = append(re, quote('/'+1)...)
+				re = append(re, '-')
+				re = append(re, quote(hi)...)
+			}
+			return
+		}
+		re = append(re, quote(lo)...)
+		if hi != lo {
+			re = append(re, '-')
+			re = append(re, quote(hi)...)
+		}
+	}
+
+	first := i
+	empty := true
+	for i < len(chars) {
+		if chars[i] == ']' && i > first {
+			if empty {
+				// e.g. "[/]": can never match anything
+				return "[^\\x00-\\x{10FFFF}]", i, nil
+			}
+			re = append(re, ']')
+			return string(re), i, nil
+		}
+		lo, j := next(i)
+		hi := lo
+		if j+1 < len(chars) && chars[j] == '-' && chars[j+1] != ']' {
+			hi, j = next(j + 1)
+			if hi < lo {
+				return "", 0, errors.New("invalid character range")
+			}
+		}
+		i = j
+		if !negate && lo == '/' && hi == '/' {
+			continue
+		}
+		addRange(lo, hi)
+		empty = false
+	}
+	return "", 0, errors.New("unterminated character range")
+}
+
+func isAlnum(ch byte) bool {
+	return (ch >= 'a' && ch <= 'z') ||
+		(ch >= 'A' && ch <= 'Z') ||
+		(ch >= '0' && ch <= '9')
+}
+
+// Return the leading directory components of pattern that contain no
+// special characters.
+func globBase(pattern string) string {
+	idx := strings.IndexAny(pattern, "*?[{\\")
+	if idx == -1 {
+		idx = len(pattern)
+	}
+	slash := strings.LastIndex(pattern[:idx], "/")
+	if slash == -1 {
+		return "."
+	} else if slash == 0 {
+		return "/"
+	}
+	return pattern[:slash]
+}
+
+// Return true if path is dir or is somewhere under dir.
+func hasPathPrefix(path, dir string) bool {
+	switch dir {
+	case ".":
+		return !filepath.IsAbs(path) && path != ".." &&
+			!strings.HasPrefix(path, "../")
+	case "/":
+		return filepath.IsAbs(path)
+	}
+	return path == dir || strings.HasPrefix(path, dir+"/")
+}
+
+// Return true if any {...} alternative in pattern contains /, so the
+// paths it matches could have varying numbers of components.
+func slashInBraces(pattern string) bool {
+	depth := 0
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '\\':
+			i++
+		case '{':
+			depth++
+		case '}':
+			if depth > 0 {
+				depth--
+			}
+		case '/':
+			if depth > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Return the number of path components in path, not counting "." or
+// the root directory: e.g. 2 for both "src/foo.c" and "/usr/include".
+func countComponents(path string) int {
+	switch path {
+	case ".", "/":
+		return 0
+	}
+	if filepath.IsAbs(path) {
+		return strings.Count(path, "/")
+	}
+	return strings.Count(path, "/") + 1
+}
+
+// Walk the filesystem looking for files that match any of globs.
+// Every directory is visited at most once, no matter how many
+// patterns there are. Return the matches for each pattern, in the
+// same order as globs. Do not look in any directory in prune; if
+// ignore is not nil, skip anything ignored by version control (and
+// add ignored directories to prune).
+func findGlobs(globs []*globPattern, prune dirset, ignore *vcsIgnore) (
+	[][]string, error) {
+	matches := make([][]string, len(globs))
+
+	// walk each base directory, unless it's under another one
+	bases := make([]string, 0, len(globs))
+	for _, glob := range globs {
+		bases = append(bases, glob.base)
+	}
+	sort.Strings(bases)
+	roots := []string{}
+	for _, base := range bases {
+		covered := false
+		for _, root := range roots {
+			if hasPathPrefix(base, root) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			roots = append(roots, base)
+		}
+	}
+
+	visit := func(path string, info os.FileInfo, err error) error {
+		if prune.contains(path, true) {
+			return filepath.SkipDir
+		}
+
+		if info != nil && info.IsDir() {
+			wanted := false
+			for _, glob := range globs {
+				if glob.mightContain(path) {
+					wanted = true
+					break
+				}
+			}
+			if !wanted {
+				return filepath.SkipDir
+			}
+		}
+
+		// fail if anything is unreadable (do not silently ignore, unless
+		// no pattern could match there or this directory was pruned)
+		if err != nil {
+			return err
+		}
+		if ignore != nil && path != "." {
+			ignored, err := ignore.ignored(path, info.IsDir())
+			if err != nil {
+				return err
+			}
+			if ignored && info.IsDir() {
+				prune[path] = true
+				return filepath.SkipDir
+			} else if ignored {
+				return nil
+			}
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		for i, glob := range globs {
+			if glob.match(path) {
+				matches[i] = append(matches[i], path)
+			}
+		}
+		return nil
+	}
+
+	for _, root := range roots {
+		_, err := os.Stat(root)
+		if os.IsNotExist(err) || prune.contains(root, false) {
+			continue
+		}
+		if ignore != nil && filepath.Dir(root) != "." {
+			// the walk only consults ignore files at or below root, so
+			// check everything above it here
+			ignored, err := ignore.ignoredPath(filepath.Dir(root), true)
+			if err != nil {
+				return nil, err
+			}
+			if ignored {
+				continue
+			}
+		}
+		err = walkFollow(root, visit)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return matches, nil
+}
+
+// Like filepath.Walk(), but follow symbolic links to directories (as
+// filepath.Glob() does), so e.g. "lib/*.c" still works when lib is a
+// symlink. A link to a directory that is already being walked (i.e.
+// one of its own ancestors) is not followed, to avoid cycles.
+func walkFollow(root string, walkfn filepath.WalkFunc) error {
+	info, err := os.Stat(root)
+	if err != nil {
+		err = walkfn(root, nil, err)
+	} else {
+		err = walkDir(root, info, walkfn, make(map[dirID]bool))
+	}
+	if err == filepath.SkipDir {
+		return nil
+	}
+	return err
+}
+
+// identifies a directory, however many paths lead to it
+type dirID struct {
+	dev, ino uint64
+}
+
+func walkDir(path string, info os.FileInfo, walkfn filepath.WalkFunc,
+	ancestors map[dirID]bool) error {
+	if !info.IsDir() {
+		return walkfn(path, info, nil)
+	}
+	var id dirID
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		id = dirID{uint64(stat.Dev), uint64(stat.Ino)}
+		if ancestors[id] {
+			return nil // symlink cycle
+		}
+		ancestors[id] = true
+		defer delete(ancestors, id)
+	}
+
+	names, err := readDirNames(path)
+	err1 := walkfn(path, info, err)
+	if err != nil || err1 != nil {
+		return err1
+	}
+	for _, name := range names {
+		filename := filepath.Join(path, name)
+		fileinfo, err := os.Lstat(filename)
+		if err == nil && fileinfo.Mode()&os.ModeSymlink != 0 {
+			// dangling links are just files (that don't match)
+			if target, err := os.Stat(filename); err == nil {
+				fileinfo = target
+			}
+		}
+		if err != nil {
+			err = walkfn(filename, fileinfo, err)
+			if err != nil && err != filepath.SkipDir {
+				return err
+			}
+			continue
+		}
+		err = walkDir(filename, fileinfo, walkfn, ancestors)
+		if err != nil && (!fileinfo.IsDir() || err != filepath.SkipDir) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Return the sorted names of the entries in directory dirname.
+func readDirNames(dirname string) ([]string, error) {
+	dir, err := os.Open(dirname)
+	if err != nil {
+		return nil, err
+	}
+	names, err := dir.Readdirnames(-1)
+	dir.Close()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
@@ -0,0 +1,309 @@
+// Copyright © 2013, Greg Ward. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE.txt file.
+
+package dag
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchrcom/testify/assert"
+
+	"fubsy/testutils"
+)
+
+func Test_globPattern_match(t *testing.T) {
+	tests := []struct {
+		glob    string
+		match   []string
+		nomatch []string
+	}{
+		{"foo",
+			[]string{"foo"},
+			[]string{"fo", "fooo", "xfoo", "a/foo", "foo/a"}},
+		{"foo/bar",
+			[]string{"foo/bar"},
+			[]string{"foo", "bar", "foo/bar/baz"}},
+		{"./foo/bar",
+			[]string{"foo/bar"},
+			[]string{"./foo/bar"}},
+		{"*.c",
+			[]string{"a.c", ".c", ".hidden.c", "a.b.c"},
+			[]string{"a.h", "a.cc", "lib/a.c"}},
+		{"foo?bar",
+			[]string{"foo-bar", "fooxbar"},
+			[]string{"foobar", "foo/bar", "fooxxbar"}},
+		{"foo[abc]",
+			[]string{"fooa", "fooc"},
+			[]string{"food", "foo", "fooab"}},
+		{"foo[a-m]*.bop",
+			[]string{"fooa.bop", "foom123.bop"},
+			[]string{"foon.bop", "fooa/x.bop"}},
+		{"foo[!a-m]",
+			[]string{"foon", "foo.", "fooZ"},
+			[]string{"fooa", "foom", "foo/"}},
+		{"foo[^a-m]",
+			[]string{"foon"},
+			[]string{"fooa"}},
+		{"[]x]",
+			[]string{"]", "x"},
+			[]string{"[", "]x"}},
+		{"[!]]",
+			[]string{"x", "["},
+			[]string{"]"}},
+		{"a[-x]",
+			[]string{"a-", "ax"},
+			[]string{"ab"}},
+		{"a[x-]",
+			[]string{"a-", "ax"},
+			[]string{"ab"}},
+		{"a[\\]\\-]",
+			[]string{"a]", "a-"},
+			[]string{"a\\"}},
+		{"a[+-9]b", // range spanning / does not match /
+			[]string{"a+b", "a.b", "a0b", "a9b"},
+			[]string{"a/b"}},
+		{"a[/]b",
+			[]string{},
+			[]string{"a/b", "ab"}},
+		{"a[.^$]",
+			[]string{"a.", "a^", "a$"},
+			[]string{"ab"}},
+		{"\\*.c",
+			[]string{"*.c"},
+			[]string{"a.c"}},
+		{"a\\?\\[b\\]\\{c\\}\\\\",
+			[]string{"a?[b]{c}\\"},
+			[]string{"ax[b]{c}\\"}},
+		{"$x(y)+.^|",
+			[]string{"$x(y)+.^|"},
+			[]string{"$x(y)+a^|"}},
+		{"**/*.c",
+			[]string{"a.c", "lib/a.c", "lib/sub/a.c", ".x/a.c"},
+			[]string{"a.h", "lib/a.h"}},
+		{"foo/**/bar",
+			[]string{"foo/bar", "foo/x/bar", "foo/x/y/bar"},
+			[]string{"foo/xbar", "foobar", "x/foo/bar"}},
+		{"foo/**/bar/**/baz.*",
+			[]string{"foo/bar/baz.c", "foo/a/bar/b/c/baz.h"},
+			[]string{"foo/bar/baz", "foo/barr/baz.c"}},
+		{"*.{c,h}",
+			[]string{"a.c", "a.h"},
+			[]string{"a.cc", "a.{c,h}", "a.c,h", "a.o"}},
+		{"{src,test}/**/*.java",
+			[]string{"src/A.java", "test/org/BTest.java"},
+			[]string{"lib/A.java", "srctest/A.java"}},
+		{"{a,b/{c,d*}}.txt",
+			[]string{"a.txt", "b/c.txt", "b/dog.txt"},
+			[]string{"b.txt", "b/e.txt", "c.txt"}},
+		{"foo/**",
+			[]string{"foo/a", "foo/a/b"},
+			[]string{"foo", "foox/a", "x/foo/a"}},
+		{"**",
+			[]string{"a", "a/b/c"},
+			[]string{""}},
+		{"**/test/**",
+			[]string{"test/a", "a/test/b/c"},
+			[]string{"test", "a/test", "atest/b"}},
+		{"{a/**,b}",
+			[]string{"a/x", "a/x/y", "b"},
+			[]string{"a", "bx"}},
+		{"{**/,}x",
+			[]string{"x", "a/x", "a/b/x"},
+			[]string{"ax"}},
+		{"a,b}",
+			[]string{"a,b}"},
+			[]string{"a", "b"}},
+		{"/usr/include/*.h",
+			[]string{"/usr/include/stdio.h"},
+			[]string{"usr/include/stdio.h", "/usr/include/sys/time.h"}},
+		{"føø/[æø]*",
+			[]string{"føø/æ", "føø/øx"},
+			[]string{"føø/a"}},
+	}
+
+	for _, test := range tests {
+		glob, err := compileGlob(test.glob)
+		if err != nil {
+			t.Errorf("glob %#v: unexpected error: %s", test.glob, err)
+			continue
+		}
+		for _, path := range test.match {
+			if !glob.match(path) {
+				t.Errorf("glob %#v (re %s) should match %#v, but does not",
+					test.glob, glob.re, path)
+			}
+		}
+		for _, path := range test.nomatch {
+			if glob.match(path) {
+				t.Errorf("glob %#v (re %s) should not match %#v, but does",
+					test.glob, glob.re, path)
+			}
+		}
+	}
+}
+
+func Test_compileGlob_errors(t *testing.T) {
+	const badstart = "recursive glob pattern ** may only occur " +
+		"at the start of a pattern or immediately after /"
+	const badend = "recursive glob pattern ** must be followed " +
+		"by / or end the pattern"
+	const slashend = "glob pattern must not end with / " +
+		"(patterns only match files)"
+	tests := []struct {
+		glob   string
+		errmsg string
+	}{
+		{"**/", slashend},
+		{"foo/", slashend},
+		{"foo/**/", slashend},
+		{"foo/**x", badend},
+		{"foo**/x", badstart},
+		{"foo[a-f*.c", "unterminated character range"},
+		{"foo[", "unterminated character range"},
+		{"foo[]", "unterminated character range"},
+		{"foo[z-a]", "invalid character range"},
+		{"*.{c,h", "unterminated brace expression"},
+		{"{a,{b,c}", "unterminated brace expression"},
+		{"foo\\", "pattern ends with unescaped \\"},
+	}
+	for _, test := range tests {
+		_, err := compileGlob(test.glob)
+		if err == nil {
+			t.Errorf("glob %#v: expected error %#v, but got none",
+				test.glob, test.errmsg)
+		} else if err.Error() != test.errmsg {
+			t.Errorf("glob %#v: expected error\n%s\nbut got\n%s",
+				test.glob, test.errmsg, err)
+		}
+	}
+}
+
+func Test_compileGlob_base_depth(t *testing.T) {
+	tests := []struct {
+		glob  string
+		base  string
+		depth int
+	}{
+		{"foo", ".", 1},
+		{"*.c", ".", 1},
+		{"src/foo.c", "src", 2},
+		{"./src/*/*.c", "src", 3},
+		{"src/main/**/*.java", "src/main", -1},
+		{"src/ma?n/*.java", "src", 3},
+		{"src/{a,b}/*.c", "src", 3},
+		{"src/{a,b/c}/*.c", "src", -1},
+		{"*.{c,h}", ".", 1},
+		{"src/\\*/x", "src", 3},
+		{"/usr/include/*.h", "/usr/include", 3},
+		{"/*.h", "/", 1},
+	}
+	for _, test := range tests {
+		glob, err := compileGlob(test.glob)
+		assert.Nil(t, err)
+		if glob.base != test.base || glob.depth != test.depth {
+			t.Errorf("glob %#v: expected base %#v, depth %d; "+
+				"but got base %#v, depth %d",
+				test.glob, test.base, test.depth, glob.base, glob.depth)
+		}
+	}
+}
+
+func Test_globPattern_mightContain(t *testing.T) {
+	tests := []struct {
+		glob  string
+		dir   string
+		might bool
+	}{
+		{"*.c", ".", true},
+		{"*.c", "src", false},
+		{"*/*.c", "src", true},
+		{"*/*.c", "src/sub", false},
+		{"**/*.c", "src/sub/deeper", true},
+		{"src/*/*.c", ".", true},
+		{"src/*/*.c", "src", true},
+		{"src/*/*.c", "src/a", true},
+		{"src/*/*.c", "src/a/b", false},
+		{"src/*/*.c", "lib", false},
+		{"src/*/*.c", "srcx", false},
+		{"/usr/*.h", ".", false},
+		{"/usr/*.h", "/", true},
+		{"/usr/*.h", "/usr", true},
+		{"/usr/*.h", "/usr/sys", false},
+	}
+	for _, test := range tests {
+		glob, err := compileGlob(test.glob)
+		assert.Nil(t, err)
+		if glob.mightContain(test.dir) != test.might {
+			t.Errorf("glob %#v: mightContain(%#v) should be %v",
+				test.glob, test.dir, test.might)
+		}
+	}
+}
+
+func Test_findGlobs(t *testing.T) {
+	cleanup := testutils.Chtemp()
+	defer cleanup()
+
+	testutils.TouchFiles(
+		"a.c", "b.h",
+		"src/x.c", "src/x.h", "src/sub/y.c", "src/sub/y.txt",
+		"doc/a.txt", "doc/b.txt",
+		"secret/z.c")
+	err := os.Mkdir("src/notafile.c", 0755)
+	assert.Nil(t, err)
+
+	// an unreadable directory that no pattern needs is never walked
+	err = os.Chmod("secret", 0)
+	assert.Nil(t, err)
+	defer os.Chmod("secret", 0755)
+
+	globs, err := compileGlobs([]string{
+		"src/**/*.c", "*.{c,h}", "doc/*.txt", "src/*.?", "nosuchdir/*.c"})
+	assert.Nil(t, err)
+	matches, err := findGlobs(globs, nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]string{
+		{"src/sub/y.c", "src/x.c"},
+		{"a.c", "b.h"},
+		{"doc/a.txt", "doc/b.txt"},
+		{"src/x.c", "src/x.h"},
+		nil,
+	}, matches)
+
+	// but if some pattern needs it, it's an error
+	globs, err = compileGlobs([]string{"*/*.c"})
+	assert.Nil(t, err)
+	_, err = findGlobs(globs, nil, nil)
+	assert.NotNil(t, err)
+
+	// unless it's pruned
+	prune := dirset{"secret": true}
+	matches, err = findGlobs(globs, prune, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]string{{"src/x.c"}}, matches)
+}
+
+// symlinks to directories are followed, but not round in circles
+func Test_findGlobs_symlinks(t *testing.T) {
+	cleanup := testutils.Chtemp()
+	defer cleanup()
+
+	testutils.TouchFiles("real/a.c", "real/sub/b.c")
+	err := os.Symlink("real", "lib")
+	assert.Nil(t, err)
+	err = os.Symlink("..", "real/sub/up")
+	assert.Nil(t, err)
+	err = os.Symlink("nowhere", "real/dangling.c")
+	assert.Nil(t, err)
+
+	globs, err := compileGlobs([]string{"lib/*.c", "**/b.c"})
+	assert.Nil(t, err)
+	matches, err := findGlobs(globs, nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]string{
+		{"lib/a.c", "lib/dangling.c"},
+		{"lib/sub/b.c", "real/sub/b.c"},
+	}, matches)
+}
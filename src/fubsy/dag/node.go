@@ -113,6 +113,32 @@ type Node interface {
 	State() NodeState
 }
 
+// Optional interface for Nodes that can compute their signature more
+// cheaply if they know what it was in a previous build (e.g. a
+// FileNode in hybrid signature mode only rehashes its file if the
+// stat info in the old signature is out of date).
+type SignatureHinter interface {
+	// oldsig is the signature of this node recorded by a previous
+	// build; it only affects subsequent calls to Signature()
+	SetSignatureHint(oldsig []byte)
+}
+
+// Optional interface for Nodes that cache information about the
+// filesystem (e.g. their signature), so a long-running process can
+// tell them to look again (see DAG.Reset()).
+type forgetter interface {
+	forget()
+}
+
+// Optional interface for Nodes that have no content of their own, so
+// their signature is derived from the signatures of their parents
+// (e.g. ActionNode). Nodes don't know their parents, so whoever calls
+// Signature() must first call SetParentSignatures(): names[i] is the
+// name of one parent and sigs[i] is its current signature.
+type DerivedSignatureNode interface {
+	SetParentSignatures(names []string, sigs [][]byte)
+}
+
 // a build rule relates source(s) to target(s) by way of action(s)
 type BuildRule interface {
 	// Run this rule's action(s) to build its targets from their
@@ -128,6 +154,26 @@ type BuildRule interface {
 	ActionString() string
 }
 
+// A BuildRule that should be run again if it fails (e.g. because it
+// runs a flaky test).
+type RetryingRule interface {
+	BuildRule
+
+	// Return how many more times to run this rule after its first
+	// failure before giving up.
+	Retries() int
+}
+
+// A BuildRule that may belong to a pool, which limits how many rules
+// in it can run at once (e.g. to keep memory-hungry links from
+// running together).
+type PooledRule interface {
+	BuildRule
+
+	// Return the name of this rule's pool ("" if none).
+	Pool() string
+}
+
 // Convenient base type for Node implementations -- provides the
 // basics right out of the box. Real Node implementations still have
 // to take care of:
@@ -312,6 +358,11 @@ type StubRule struct {
 	targets  []Node
 	fail     bool
 	executed bool
+
+	// fail only the first failcount times (if fail is false)
+	failcount int
+	retries   int
+	pool      string
 }
 
 func MakeStubRule(callback func(string), target ...Node) *StubRule {
@@ -325,15 +376,38 @@ func (self *StubRule) SetFail(fail bool) {
 	self.fail = fail
 }
 
+// Make this rule fail the next count times it is executed, and then
+// succeed.
+func (self *StubRule) SetFailCount(count int) {
+	self.failcount = count
+}
+
+func (self *StubRule) SetRetries(retries int) {
+	self.retries = retries
+}
+
+func (self *StubRule) SetPool(pool string) {
+	self.pool = pool
+}
+
 func (self *StubRule) Execute() ([]Node, []error) {
 	self.callback(self.targets[0].Name())
 	errs := []error{}
-	if self.fail {
+	if self.fail || self.failcount > 0 {
+		self.failcount--
 		errs = append(errs, errors.New("action failed"))
 	}
 	return self.targets, errs
 }
 
+func (self *StubRule) Retries() int {
+	return self.retries
+}
+
+func (self *StubRule) Pool() string {
+	return self.pool
+}
+
 func (self *StubRule) ActionString() string {
 	return "build " + self.targets[0].String()
 }
@@ -0,0 +1,330 @@
+// Copyright © 2013, Greg Ward. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE.txt file.
+
+package dag
+
+// A small query language for asking questions about the dependency
+// graph without building anything, e.g. "which tests depend on this
+// file?":
+//
+//   type(ActionNode, rdeps(src/util.c))
+//
+// Every query evaluates to a set of nodes. The building blocks are:
+//
+//   NAME            the node called NAME (use "..." to quote names
+//                   containing whitespace, parentheses, or commas)
+//   deps(x)         x and all of its ancestors
+//   rdeps(x)        x and all of its descendants
+//   affected(x)     the final targets that depend on x (or are in x)
+//   somepath(x, y)  the nodes on one path from a node in x to a node
+//                   in y, following parents (so x depends on y); empty
+//                   if there is no such path
+//   type(T, x)      the nodes in x whose type is T (e.g. FileNode)
+//   x + y           union (also: x union y)
+//   x ^ y           intersection (also: x intersect y)
+//   x - y           difference (also: x except y)
+//
+// Binary operators all have the same precedence and associate to the
+// left; use parentheses to group.
+
+import (
+	"fmt"
+	"strings"
+
+	"code.google.com/p/go-bit/bit"
+)
+
+// Evaluate query and return the set of matching nodes.
+func (self *DAG) Query(query string) (*NodeSet, error) {
+	tokens, err := scanQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	parser := &queryParser{dag: self, tokens: tokens}
+	result, err := parser.parseSet()
+	if err == nil && parser.peek().kind != qEOF {
+		err = parser.unexpected()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return (*NodeSet)(result), nil
+}
+
+type queryToken struct {
+	kind   int
+	text   string
+	offset int
+}
+
+// token kinds other than the punctuation characters ( ) ,
+const (
+	qEOF = iota
+	qWORD
+	qSTRING
+)
+
+func scanQuery(query string) ([]queryToken, error) {
+	tokens := []queryToken{}
+	pos := 0
+	for pos < len(query) {
+		ch := query[pos]
+		switch {
+		case ch == ' ' || ch == '\t' || ch == '\n':
+			pos++
+		case ch == '(' || ch == ')' || ch == ',':
+			tokens = append(tokens, queryToken{int(ch), query[pos : pos+1], pos})
+			pos++
+		case ch == '"':
+			end := strings.IndexByte(query[pos+1:], '"')
+			if end == -1 {
+				return nil, fmt.Errorf(
+					"invalid query: unterminated string at offset %d", pos)
+			}
+			text := query[pos+1 : pos+1+end]
+			tokens = append(tokens, queryToken{qSTRING, text, pos})
+			pos += end + 2
+		default:
+			start := pos
+			for pos < len(query) && !strings.ContainsRune(" \t\n(),\"", rune(query[pos])) {
+				pos++
+			}
+			tokens = append(tokens, queryToken{qWORD, query[start:pos], start})
+		}
+	}
+	tokens = append(tokens, queryToken{qEOF, "", len(query)})
+	return tokens, nil
+}
+
+type queryParser struct {
+	dag    *DAG
+	tokens []queryToken
+	pos    int
+}
+
+// binary operators: each computes S = A op B
+var queryOperators = map[string]func(S, A, B *bit.Set) *bit.Set{
+	"+":         (*bit.Set).SetOr,
+	"union":     (*bit.Set).SetOr,
+	"^":         (*bit.Set).SetAnd,
+	"intersect": (*bit.Set).SetAnd,
+	"-":         (*bit.Set).SetAndNot,
+	"except":    (*bit.Set).SetAndNot,
+}
+
+func (self *queryParser) peek() queryToken {
+	return self.tokens[self.pos]
+}
+
+func (self *queryParser) next() queryToken {
+	token := self.tokens[self.pos]
+	if token.kind != qEOF {
+		self.pos++
+	}
+	return token
+}
+
+func (self *queryParser) expect(kind int) (queryToken, error) {
+	if self.peek().kind != kind {
+		return queryToken{}, self.unexpected()
+	}
+	return self.next(), nil
+}
+
+func (self *queryParser) unexpected() error {
+	token := self.peek()
+	if token.kind == qEOF {
+		return fmt.Errorf("invalid query: unexpected end of query")
+	}
+	return fmt.Errorf("invalid query: unexpected '%s' at offset %d",
+		token.text, token.offset)
+}
+
+// set := term { operator term }
+func (self *queryParser) parseSet() (*bit.Set, error) {
+	result, err := self.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		token := self.peek()
+		operator, ok := queryOperators[token.text]
+		if token.kind != qWORD || !ok {
+			return result, nil
+		}
+		self.next()
+		operand, err := self.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		operator(result, result, operand)
+	}
+}
+
+// term := "(" set ")" | function "(" args ")" | name
+func (self *queryParser) parseTerm() (*bit.Set, error) {
+	token := self.peek()
+	if _, ok := queryOperators[token.text]; ok && token.kind == qWORD {
+		return nil, self.unexpected()
+	}
+	switch token.kind {
+	case '(':
+		self.next()
+		result, err := self.parseSet()
+		if err != nil {
+			return nil, err
+		}
+		_, err = self.expect(')')
+		return result, err
+	case qSTRING:
+		self.next()
+		return self.lookup(token.text)
+	case qWORD:
+		self.next()
+		if self.peek().kind == '(' {
+			return self.parseCall(token)
+		}
+		return self.lookup(token.text)
+	}
+	return nil, self.unexpected()
+}
+
+func (self *queryParser) parseCall(function queryToken) (*bit.Set, error) {
+	self.next() // skip "("
+	var result *bit.Set
+	var err error
+	switch function.text {
+	case "deps":
+		result, err = self.parseArg(')')
+		if err == nil {
+			result = self.dag.ancestors(result)
+		}
+	case "rdeps":
+		result, err = self.parseArg(')')
+		if err == nil {
+			result = self.dag.descendants(result)
+		}
+	case "affected":
+		result, err = self.parseArg(')')
+		if err == nil {
+			result = self.dag.descendants(result)
+			result.SetAnd(result, (*bit.Set)(self.dag.FindFinalTargets()))
+		}
+	case "somepath":
+		var from, to *bit.Set
+		from, err = self.parseArg(',')
+		if err == nil {
+			to, err = self.parseArg(')')
+		}
+		if err == nil {
+			result = self.dag.somePath(from, to)
+		}
+	case "type":
+		var typename queryToken
+		typename, err = self.expect(qWORD)
+		if err == nil {
+			_, err = self.expect(',')
+		}
+		if err == nil {
+			result, err = self.parseArg(')')
+		}
+		if err == nil {
+			result = self.dag.filterType(result, typename.text)
+		}
+	default:
+		return nil, fmt.Errorf(
+			"invalid query: unknown function '%s' at offset %d",
+			function.text, function.offset)
+	}
+	return result, err
+}
+
+// parse one function argument, followed by delim (',' or ')')
+func (self *queryParser) parseArg(delim int) (*bit.Set, error) {
+	result, err := self.parseSet()
+	if err != nil {
+		return nil, err
+	}
+	_, err = self.expect(delim)
+	return result, err
+}
+
+func (self *queryParser) lookup(name string) (*bit.Set, error) {
+	id, ok := self.dag.index[name]
+	if !ok {
+		return nil, fmt.Errorf("no such node: '%s'", name)
+	}
+	return bit.New(id), nil
+}
+
+// Return start plus all of its ancestors.
+func (self *DAG) ancestors(start *bit.Set) *bit.Set {
+	return closure(start, self.parents)
+}
+
+// Return start plus all of its descendants.
+func (self *DAG) descendants(start *bit.Set) *bit.Set {
+	return closure(start, self.children)
+}
+
+// Return the set of nodes reachable from start by following edges
+// (including start itself).
+func closure(start *bit.Set, edges []*bit.Set) *bit.Set {
+	result := bit.New().Set(start)
+	todo := bit.New().Set(start)
+	next := bit.New()
+	for !todo.IsEmpty() {
+		id := todo.RemoveMin()
+		next.SetAndNot(edges[id], result)
+		result.SetOr(result, next)
+		todo.SetOr(todo, next)
+	}
+	return result
+}
+
+// Return the nodes on the shortest path from any node in from to any
+// node in to, following parent edges. Return an empty set if there
+// is no such path.
+func (self *DAG) somePath(from, to *bit.Set) *bit.Set {
+	// breadth-first search, remembering how we got to each node
+	previous := make(map[int]int)
+	seen := bit.New().Set(from)
+	queue := []int{}
+	from.Do(func(id int) { queue = append(queue, id) })
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		if to.Contains(id) {
+			result := bit.New(id)
+			for {
+				prev, ok := previous[id]
+				if !ok {
+					return result
+				}
+				result.Add(prev)
+				id = prev
+			}
+		}
+		parents := self.parents[id]
+		for pid, ok := parents.Next(-1); ok; pid, ok = parents.Next(pid) {
+			if !seen.Contains(pid) {
+				seen.Add(pid)
+				previous[pid] = id
+				queue = append(queue, pid)
+			}
+		}
+	}
+	return bit.New()
+}
+
+// Return the nodes in set whose type is typename.
+func (self *DAG) filterType(set *bit.Set, typename string) *bit.Set {
+	result := bit.New()
+	set.Do(func(id int) {
+		if self.nodes[id].Typename() == typename {
+			result.Add(id)
+		}
+	})
+	return result
+}
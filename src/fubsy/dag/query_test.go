@@ -0,0 +1,74 @@
+// Copyright © 2013, Greg Ward. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE.txt file.
+
+package dag
+
+import (
+	"testing"
+
+	"github.com/stretchrcom/testify/assert"
+)
+
+func Test_DAG_Query(t *testing.T) {
+	dag := makeSimpleGraph()
+	tests := []struct {
+		query  string
+		expect string
+	}{
+		{"tool2", "{1}"},
+		{`"util.c"`, "{10}"},
+		{"deps(tool2)", "{1,4,5,9,10,11}"},
+		{"deps(misc.o)", "{3,7,8}"},
+		{"rdeps(util.h)", "{0,1,2,4,5,9}"},
+		{"rdeps(tool1)", "{0}"},
+		{"affected(misc.h)", "{0}"},
+		{"affected(util.h + misc.c)", "{0,1}"},
+		{"somepath(tool1, util.c)", "{0,4,10}"},
+		{"somepath(tool2, misc.c)", "{}"},
+		{"somepath(tool1 + tool2, util.h)", "{0,2,9}"},
+		{"deps(tool1) ^ deps(tool2)", "{4,9,10}"},
+		{"deps(tool1) intersect deps(tool2)", "{4,9,10}"},
+		{"deps(tool1) - deps(tool2)", "{0,2,3,6,7,8}"},
+		{"deps(tool1) except deps(tool2) except misc.h", "{0,2,3,6,8}"},
+		{"tool1 union tool2 + misc.h", "{0,1,7}"},
+		{"rdeps(util.c) - (tool1 + tool2)", "{4,10}"},
+		{"type(StubNode, rdeps(misc.c))", "{0,3,8}"},
+		{"type(FileNode, rdeps(misc.c))", "{}"},
+	}
+	for _, test := range tests {
+		result, err := dag.Query(test.query)
+		if err != nil {
+			t.Errorf("query %s: unexpected error: %s", test.query, err)
+			continue
+		}
+		assert.Equal(t, test.expect, result.String(), "query: "+test.query)
+	}
+}
+
+func Test_DAG_Query_errors(t *testing.T) {
+	dag := makeSimpleGraph()
+	tests := []struct {
+		query  string
+		errmsg string
+	}{
+		{"", "invalid query: unexpected end of query"},
+		{"tool3", "no such node: 'tool3'"},
+		{"deps(tool1", "invalid query: unexpected end of query"},
+		{"deps(tool1))", "invalid query: unexpected ')' at offset 11"},
+		{"tool1 tool2", "invalid query: unexpected 'tool2' at offset 6"},
+		{"tool1 + + tool2", "invalid query: unexpected '+' at offset 8"},
+		{"somepath(tool1)", "invalid query: unexpected ')' at offset 14"},
+		{"type(deps(x), tool1)", "invalid query: unexpected '(' at offset 9"},
+		{"foo(tool1)", "invalid query: unknown function 'foo' at offset 0"},
+		{`"tool1`, "invalid query: unterminated string at offset 0"},
+	}
+	for _, test := range tests {
+		_, err := dag.Query(test.query)
+		if err == nil {
+			t.Errorf("query %s: expected error, but got none", test.query)
+			continue
+		}
+		assert.Equal(t, test.errmsg, err.Error(), "query: "+test.query)
+	}
+}
@@ -0,0 +1,307 @@
+// Copyright © 2013, Greg Ward. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE.txt file.
+
+package dag
+
+// Signature modes: how filesystem nodes decide whether they have
+// changed since the previous build.
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+type SignatureMode byte
+
+const (
+	// hash the entire content of every file (slow but sure: this is
+	// the default)
+	CONTENT SignatureMode = iota
+
+	// only look at modification time, size, and inode number (fast,
+	// but fooled by anything that modifies a file while preserving
+	// that information)
+	TIMESTAMP
+
+	// compare modification time, size, and inode number to the
+	// previous build, and only rehash files where they differ
+	HYBRID
+)
+
+var modenames []string
+
+// signature mode for each node type that supports them; the entry
+// for "" is the default for all types
+var sigmodes map[string]SignatureMode
+
+// node types that support signature modes
+var sigtypes map[string]bool
+
+// hash algorithms available for content signatures, and the one
+// currently selected
+var hashalgos map[string]func() hash.Hash
+var hashalgo string
+
+func init() {
+	modenames = []string{"content", "timestamp", "hybrid"}
+	sigmodes = map[string]SignatureMode{"": CONTENT}
+	sigtypes = map[string]bool{
+		"FileNode": true, "FinderNode": true, "DirNode": true}
+
+	hashalgos = map[string]func() hash.Hash{
+		"fnv":    func() hash.Hash { return fnv.New64a() },
+		"sha1":   sha1.New,
+		"sha256": sha256.New,
+		"sha512": sha512.New,
+	}
+	hashalgo = "fnv"
+}
+
+func (self SignatureMode) String() string {
+	return modenames[int(self)]
+}
+
+// Configure signature modes as requested by the user, e.g. with the
+// --signatures command-line option. Each spec is either MODE, which
+// sets the mode for every node type, or TYPE:MODE, which sets it for
+// one node type only (e.g. "FileNode:hybrid").
+func SetSignatureModes(specs []string) error {
+	bad := []string{}
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		typename := ""
+		modename := spec
+		if idx := strings.Index(spec, ":"); idx >= 0 {
+			typename = spec[:idx]
+			modename = spec[idx+1:]
+		}
+		mode, ok := parseSignatureMode(modename)
+		if !ok || !(typename == "" || sigtypes[typename]) {
+			bad = append(bad, spec)
+			continue
+		}
+		SetSignatureMode(typename, mode)
+	}
+	if len(bad) > 0 {
+		return errors.New("invalid signature mode: " + strings.Join(bad, ", "))
+	}
+	return nil
+}
+
+func parseSignatureMode(name string) (SignatureMode, bool) {
+	for i, modename := range modenames {
+		if modename == name {
+			return SignatureMode(i), true
+		}
+	}
+	return CONTENT, false
+}
+
+// Set the signature mode for nodes of the specified type (as
+// returned by Typename()), or for all types if typename is "".
+func SetSignatureMode(typename string, mode SignatureMode) {
+	sigmodes[typename] = mode
+}
+
+func signatureMode(typename string) SignatureMode {
+	if mode, ok := sigmodes[typename]; ok {
+		return mode
+	}
+	return sigmodes[""]
+}
+
+// number of bytes of stat info in TIMESTAMP and HYBRID signatures:
+// mtime, size, and inode as three big-endian 64-bit integers
+const statsize = 24
+
+// Select the hash algorithm used to compute content signatures
+// (e.g. with the --hash command-line option). Every signature in the
+// build database depends on this, so changing it between builds
+// forces a full rebuild.
+func SetHashAlgorithm(name string) error {
+	if hashalgos[name] == nil {
+		return fmt.Errorf("invalid hash algorithm: %s (must be one of: %s)",
+			name, strings.Join(HashAlgorithms(), ", "))
+	}
+	hashalgo = name
+	return nil
+}
+
+// Return the name of the currently selected hash algorithm.
+func HashAlgorithm() string {
+	return hashalgo
+}
+
+// Return the names of all supported hash algorithms, sorted.
+func HashAlgorithms() []string {
+	names := make([]string, 0, len(hashalgos))
+	for name := range hashalgos {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func newHash() hash.Hash {
+	return hashalgos[hashalgo]()
+}
+
+// Return the size of the signature that fileSignature() computes in
+// the specified mode.
+func fileSignatureSize(mode SignatureMode) int {
+	switch mode {
+	case TIMESTAMP:
+		return statsize
+	case HYBRID:
+		return statsize + newHash().Size()
+	}
+	return newHash().Size()
+}
+
+// Compute the signature of a single file in the specified mode. hint
+// is the signature of the same file from a previous build, or nil if
+// unknown. It only matters in HYBRID mode: if the file's stat info
+// has not changed since hint was computed, reuse the content hash in
+// hint rather than reading the whole file again.
+func fileSignature(filename string, mode SignatureMode, hint []byte) (
+	[]byte, error) {
+	if mode == CONTENT {
+		return hashFile(filename)
+	}
+
+	stat, err := statFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if mode == TIMESTAMP {
+		return stat, nil
+	}
+	if len(hint) == fileSignatureSize(HYBRID) &&
+		bytes.Equal(hint[:statsize], stat) {
+		return hint, nil
+	}
+	content, err := hashFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return append(stat, content...), nil
+}
+
+// Return true if two signatures computed by fileSignature() in the
+// specified mode are different. In HYBRID mode, that means the
+// content hashes differ: a file that has been touched but not
+// modified is unchanged.
+func fileSignatureChanged(mode SignatureMode, oldsig, newsig []byte) bool {
+	if mode == HYBRID &&
+		len(oldsig) == fileSignatureSize(HYBRID) &&
+		len(newsig) == fileSignatureSize(HYBRID) {
+		return !bytes.Equal(oldsig[statsize:], newsig[statsize:])
+	}
+	return !bytes.Equal(oldsig, newsig)
+}
+
+// Append the signature of a list of files to sig: for each file, a
+// hash of its name followed by its signature in the specified mode
+// (see fileSignature()). hint is the previous signature of the same
+// list, if known; entries for unchanged files are reused from it in
+// HYBRID mode.
+func appendFileListSignature(
+	sig []byte, filenames []string, mode SignatureMode, hint []byte) (
+	[]byte, error) {
+	hints := fileListHints(mode, hint)
+	hash := newHash()
+	for _, filename := range filenames {
+		hash.Reset()
+		hash.Write(([]byte)(filename))
+		sig = hash.Sum(sig)
+
+		filesig, err := fileSignature(
+			filename, mode, hints[string(sig[len(sig)-hash.Size():])])
+		if err != nil {
+			return nil, err
+		}
+		sig = append(sig, filesig...)
+	}
+	return sig, nil
+}
+
+// Compare two signatures computed by appendFileListSignature() entry
+// by entry, so that in HYBRID mode touching a file without modifying
+// it does not count as a change.
+func fileListSignatureChanged(mode SignatureMode, oldsig, newsig []byte) bool {
+	namesize := newHash().Size()
+	entrysize := namesize + fileSignatureSize(mode)
+	if len(oldsig) != len(newsig) || len(oldsig)%entrysize != 0 {
+		return !bytes.Equal(oldsig, newsig)
+	}
+	for i := 0; i < len(oldsig); i += entrysize {
+		oldentry := oldsig[i : i+entrysize]
+		newentry := newsig[i : i+entrysize]
+		if !bytes.Equal(oldentry[:namesize], newentry[:namesize]) ||
+			fileSignatureChanged(
+				mode, oldentry[namesize:], newentry[namesize:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Split the signature hint (if any) into per-file signatures, keyed
+// by filename hash. Return nil if there is no hint or it was computed
+// in a different signature mode.
+func fileListHints(mode SignatureMode, hint []byte) map[string][]byte {
+	if mode != HYBRID || len(hint) == 0 {
+		return nil
+	}
+	namesize := newHash().Size()
+	entrysize := namesize + fileSignatureSize(mode)
+	if len(hint)%entrysize != 0 {
+		return nil
+	}
+	hints := make(map[string][]byte)
+	for i := 0; i < len(hint); i += entrysize {
+		entry := hint[i : i+entrysize]
+		hints[string(entry[:namesize])] = entry[namesize:]
+	}
+	return hints
+}
+
+func hashFile(filename string) ([]byte, error) {
+	hash := newHash()
+	err := HashFile(filename, hash)
+	if err != nil {
+		return nil, err
+	}
+	return hash.Sum(make([]byte, 0, hash.Size())), nil
+}
+
+func statFile(filename string) ([]byte, error) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	var inode uint64
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		inode = stat.Ino
+	}
+	buf := make([]byte, statsize)
+	binary.BigEndian.PutUint64(buf[0:8], uint64(info.ModTime().UnixNano()))
+	binary.BigEndian.PutUint64(buf[8:16], uint64(info.Size()))
+	binary.BigEndian.PutUint64(buf[16:24], inode)
+	return buf, nil
+}
@@ -0,0 +1,191 @@
+// Copyright © 2013, Greg Ward. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE.txt file.
+
+package dag
+
+import (
+	"encoding/hex"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchrcom/testify/assert"
+
+	"fubsy/testutils"
+)
+
+func Test_SetSignatureModes(t *testing.T) {
+	defer resetSignatureModes()
+
+	err := SetSignatureModes([]string{})
+	assert.Nil(t, err)
+	assert.Equal(t, CONTENT, signatureMode("FileNode"))
+
+	err = SetSignatureModes([]string{"hybrid", " FinderNode:timestamp", ""})
+	assert.Nil(t, err)
+	assert.Equal(t, HYBRID, signatureMode("FileNode"))
+	assert.Equal(t, TIMESTAMP, signatureMode("FinderNode"))
+
+	err = SetSignatureModes(
+		[]string{"content", "fast", "FileNode:slow", "Bogus:hybrid"})
+	assert.Equal(t,
+		"invalid signature mode: fast, FileNode:slow, Bogus:hybrid",
+		err.Error())
+	assert.Equal(t, CONTENT, signatureMode("FileNode"))
+	assert.Equal(t, TIMESTAMP, signatureMode("FinderNode"))
+}
+
+func Test_SetHashAlgorithm(t *testing.T) {
+	defer SetHashAlgorithm("fnv")
+
+	assert.Equal(t, "fnv", HashAlgorithm())
+	assert.Equal(t, 8, newHash().Size())
+
+	err := SetHashAlgorithm("sha256")
+	assert.Nil(t, err)
+	assert.Equal(t, "sha256", HashAlgorithm())
+	assert.Equal(t, 32, newHash().Size())
+
+	err = SetHashAlgorithm("md4")
+	assert.Equal(t,
+		"invalid hash algorithm: md4 "+
+			"(must be one of: fnv, sha1, sha256, sha512)",
+		err.Error())
+	assert.Equal(t, "sha256", HashAlgorithm())
+}
+
+func Test_FileNode_Signature_sha256(t *testing.T) {
+	cleanup := testutils.Chtemp()
+	defer cleanup()
+	defer SetHashAlgorithm("fnv")
+
+	testutils.Mkfile(".", "stuff", "foo\n")
+	osig, err := NewFileNode("stuff").Signature()
+	assert.Nil(t, err)
+	assert.Equal(t, 8, len(osig))
+
+	SetHashAlgorithm("sha256")
+	nsig, err := NewFileNode("stuff").Signature()
+	assert.Nil(t, err)
+	assert.Equal(t,
+		"b5bb9d8014a0f9b1d61e21e796d78dccdf1352f23cd32812f4850b878ae4944c",
+		hex.EncodeToString(nsig))
+}
+
+func Test_FileNode_Signature_timestamp(t *testing.T) {
+	cleanup := testutils.Chtemp()
+	defer cleanup()
+	defer resetSignatureModes()
+	SetSignatureMode("FileNode", TIMESTAMP)
+
+	testutils.Mkfile(".", "stuff", "foo\n")
+	osig, err := NewFileNode("stuff").Signature()
+	assert.Nil(t, err)
+	assert.Equal(t, statsize, len(osig))
+
+	// same content, different mtime: changed
+	setMtime("stuff", time.Unix(1234567890, 0))
+	node := NewFileNode("stuff")
+	nsig, err := node.Signature()
+	assert.Nil(t, err)
+	assert.True(t, node.Changed(osig, nsig))
+}
+
+func Test_FileNode_Signature_hybrid(t *testing.T) {
+	cleanup := testutils.Chtemp()
+	defer cleanup()
+	defer resetSignatureModes()
+	SetSignatureMode("", HYBRID)
+
+	testutils.Mkfile(".", "stuff", "foo\n")
+	osig, err := NewFileNode("stuff").Signature()
+	assert.Nil(t, err)
+	assert.Equal(t, fileSignatureSize(HYBRID), len(osig))
+
+	// if the stat info in the hint is current, the content hash in
+	// the hint is trusted (i.e. we do not reread the file)
+	hint := make([]byte, len(osig))
+	copy(hint, osig)
+	hint[len(hint)-1]++
+	node := NewFileNode("stuff")
+	node.SetSignatureHint(hint)
+	nsig, err := node.Signature()
+	assert.Nil(t, err)
+	assert.Equal(t, hint, nsig)
+
+	// touch the file without modifying it: the file is rehashed, but
+	// it's unchanged
+	setMtime("stuff", time.Unix(1234567890, 0))
+	node = NewFileNode("stuff")
+	node.SetSignatureHint(hint)
+	nsig, err = node.Signature()
+	assert.Nil(t, err)
+	assert.NotEqual(t, osig, nsig)
+	assert.False(t, node.Changed(osig, nsig))
+
+	// modify the file: changed
+	testutils.Mkfile(".", "stuff", "bar\n")
+	node = NewFileNode("stuff")
+	node.SetSignatureHint(osig)
+	nsig, err = node.Signature()
+	assert.Nil(t, err)
+	assert.True(t, node.Changed(osig, nsig))
+
+	// signature from a different mode: changed
+	SetSignatureMode("", CONTENT)
+	osig, err = NewFileNode("stuff").Signature()
+	assert.Nil(t, err)
+	SetSignatureMode("", HYBRID)
+	assert.True(t, node.Changed(osig, nsig))
+}
+
+func Test_FinderNode_Signature_hybrid(t *testing.T) {
+	cleanup := testutils.Chtemp()
+	defer cleanup()
+	defer resetSignatureModes()
+	SetSignatureMode("FinderNode", HYBRID)
+
+	testutils.TouchFiles("a.c", "b.c", "c.h")
+	finder := NewFinderNode("*.c")
+	osig, err := finder.Signature()
+	assert.Nil(t, err)
+	entrysize := newHash().Size() + fileSignatureSize(HYBRID)
+	assert.Equal(t, 2*entrysize, len(osig))
+
+	// touch one file: signature differs, but the node is unchanged
+	setMtime("b.c", time.Unix(1234567890, 0))
+	finder = NewFinderNode("*.c")
+	finder.SetSignatureHint(osig)
+	nsig, err := finder.Signature()
+	assert.Nil(t, err)
+	assert.NotEqual(t, osig, nsig)
+	assert.False(t, finder.Changed(osig, nsig))
+
+	// modify one file
+	testutils.Mkfile(".", "a.c", "int x;\n")
+	finder = NewFinderNode("*.c")
+	finder.SetSignatureHint(osig)
+	nsig, err = finder.Signature()
+	assert.Nil(t, err)
+	assert.True(t, finder.Changed(osig, nsig))
+
+	// add one file
+	testutils.TouchFiles("d.c")
+	finder = NewFinderNode("*.c")
+	finder.SetSignatureHint(osig)
+	nsig, err = finder.Signature()
+	assert.Nil(t, err)
+	assert.True(t, finder.Changed(osig, nsig))
+}
+
+func setMtime(name string, mtime time.Time) {
+	err := os.Chtimes(name, mtime, mtime)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func resetSignatureModes() {
+	sigmodes = map[string]SignatureMode{"": CONTENT}
+}
@@ -0,0 +1,224 @@
+// Copyright © 2013, Greg Ward. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE.txt file.
+
+package dag
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"syscall"
+
+	"fubsy/types"
+)
+
+// A node that represents the value of a variable (e.g. CFLAGS) or an
+// arbitrary expression, rather than anything in the filesystem. Its
+// signature is the expanded value itself, so changing the value
+// rebuilds everything that depends on it, exactly as though a source
+// file had been modified.
+type ValueNode struct {
+	// name: variable name plus ":value" (so it can't clash with a
+	// filename, and so nodebase.NodeExpand() would leave it alone),
+	// plus a hash of the expression if there is one
+	nodebase
+
+	// variable to look up when this node is expanded (only used if
+	// value is nil)
+	varname string
+
+	// expression whose value this node tracks, or nil to track the
+	// variable varname
+	value types.FuObject
+
+	// the expanded value, computed by NodeExpand(): this is the
+	// signature
+	expvalue []byte
+}
+
+// Lookup and return the value node for varname (or for the
+// expression value, if not nil) in dag. If it doesn't exist, create a
+// new ValueNode, add it to dag, and return it. If it does exist but
+// isn't a ValueNode, return an error.
+func MakeValueNode(dag *DAG, varname string, value types.FuObject) (
+	*ValueNode, error) {
+	node, err := dag.addNodeChecked(NewValueNode(varname, value))
+	if err != nil {
+		return nil, err
+	}
+	return node.(*ValueNode), nil
+}
+
+// Create a node that tracks value, or the value of variable varname
+// if value is nil. Either way, the node is named after varname; but
+// the name of a node that tracks an expression also includes a hash
+// of it, so that different expressions with the same name are
+// different nodes, and neither is confused with the variable.
+func NewValueNode(varname string, value types.FuObject) *ValueNode {
+	name := varname + ":value"
+	if value != nil {
+		hash := sha1.Sum([]byte(value.String()))
+		name += ":" + hex.EncodeToString(hash[:4])
+	}
+	return &ValueNode{
+		nodebase: makenodebase(name),
+		varname:  varname,
+		value:    value,
+	}
+}
+
+func (self *ValueNode) Typename() string {
+	return "ValueNode"
+}
+
+func (self *ValueNode) Equal(other_ types.FuObject) bool {
+	other, ok := other_.(*ValueNode)
+	return ok && other.name == self.name
+}
+
+func (self *ValueNode) Add(other types.FuObject) (types.FuObject, error) {
+	return defaultNodeAdd(self, other)
+}
+
+func (self *ValueNode) List() []types.FuObject {
+	return []types.FuObject{self}
+}
+
+func (self *ValueNode) ActionExpand(
+	ns types.Namespace, ctx *types.ExpandContext) (
+	types.FuObject, error) {
+	return defaultNodeActionExpand(self, ns)
+}
+
+func (self *ValueNode) copy() Node {
+	var c ValueNode = *self
+	return &c
+}
+
+// Compute the value tracked by this node, expanding any variable
+// references in it. Unlike other node types, this does not modify
+// the node's name.
+func (self *ValueNode) NodeExpand(ns types.Namespace) error {
+	if self.expanded {
+		return nil
+	}
+	value := self.value
+	if value == nil {
+		var ok bool
+		value, ok = ns.Lookup(self.varname)
+		if !ok {
+			return fmt.Errorf("undefined variable '%s'", self.varname)
+		}
+	}
+	self.expvalue = []byte{}
+	if value != nil {
+		xvalue, err := value.ActionExpand(ns, nil)
+		if err != nil {
+			return err
+		}
+		self.expvalue = []byte(xvalue.ValueString())
+	}
+	self.expanded = true
+	return nil
+}
+
+// Return the expanded value of this node (only meaningful after
+// NodeExpand()).
+func (self *ValueNode) Value() string {
+	return string(self.expvalue)
+}
+
+func (self *ValueNode) Exists() (bool, error) {
+	// a value always exists, even if it's empty
+	return true, nil
+}
+
+func (self *ValueNode) Signature() ([]byte, error) {
+	if !self.expanded {
+		return nil, fmt.Errorf(
+			"cannot compute signature of %s: not expanded yet", self)
+	}
+	return self.expvalue, nil
+}
+
+// A node that represents an environment variable that actions depend
+// on (e.g. LANG). Its signature is the variable's current value, so
+// targets are rebuilt when it changes.
+type EnvNode struct {
+	// name: variable name plus ":env"
+	nodebase
+
+	varname string
+}
+
+// Lookup and return the node for environment variable varname in
+// dag. If it doesn't exist, create a new EnvNode, add it to dag, and
+// return it. If it does exist but isn't an EnvNode, return an error.
+func MakeEnvNode(dag *DAG, varname string) (*EnvNode, error) {
+	node, err := dag.addNodeChecked(NewEnvNode(varname))
+	if err != nil {
+		return nil, err
+	}
+	return node.(*EnvNode), nil
+}
+
+func NewEnvNode(varname string) *EnvNode {
+	return &EnvNode{
+		nodebase: makenodebase(varname + ":env"),
+		varname:  varname,
+	}
+}
+
+// Return the name of the environment variable tracked by this node.
+func (self *EnvNode) Variable() string {
+	return self.varname
+}
+
+func (self *EnvNode) Typename() string {
+	return "EnvNode"
+}
+
+func (self *EnvNode) Equal(other_ types.FuObject) bool {
+	other, ok := other_.(*EnvNode)
+	return ok && other.name == self.name
+}
+
+func (self *EnvNode) Add(other types.FuObject) (types.FuObject, error) {
+	return defaultNodeAdd(self, other)
+}
+
+func (self *EnvNode) List() []types.FuObject {
+	return []types.FuObject{self}
+}
+
+func (self *EnvNode) ActionExpand(
+	ns types.Namespace, ctx *types.ExpandContext) (
+	types.FuObject, error) {
+	return defaultNodeActionExpand(self, ns)
+}
+
+func (self *EnvNode) copy() Node {
+	var c EnvNode = *self
+	return &c
+}
+
+func (self *EnvNode) NodeExpand(ns types.Namespace) error {
+	// nothing to expand: the variable name is taken literally
+	return nil
+}
+
+func (self *EnvNode) Exists() (bool, error) {
+	// an unset variable is still a perfectly good dependency
+	return true, nil
+}
+
+func (self *EnvNode) Signature() ([]byte, error) {
+	value, ok := syscall.Getenv(self.varname)
+	if !ok {
+		// distinguish unset from empty: environment variables can't
+		// contain NUL bytes
+		return []byte{0}, nil
+	}
+	return []byte(value), nil
+}
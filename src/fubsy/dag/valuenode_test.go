@@ -0,0 +1,117 @@
+// Copyright © 2013, Greg Ward. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE.txt file.
+
+package dag
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchrcom/testify/assert"
+
+	"fubsy/types"
+)
+
+func Test_ValueNode_variable(t *testing.T) {
+	ns := types.NewValueMap()
+	ns.Assign("opt", types.MakeFuString("-O2"))
+	ns.Assign("CFLAGS", types.MakeFuString("-Wall $opt"))
+
+	node := NewValueNode("CFLAGS", nil)
+	assert.Equal(t, "CFLAGS:value", node.Name())
+	_, err := node.Signature()
+	assert.Equal(t,
+		"cannot compute signature of \"CFLAGS:value\": not expanded yet",
+		err.Error())
+
+	err = node.NodeExpand(ns)
+	assert.Nil(t, err)
+	assert.Equal(t, "CFLAGS:value", node.Name())
+	assert.Equal(t, "-Wall -O2", node.Value())
+	sig1, err := node.Signature()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("-Wall -O2"), sig1)
+	exists, err := node.Exists()
+	assert.True(t, exists)
+	assert.Nil(t, err)
+
+	// a different value is a different signature (even if the change
+	// is in a variable referenced by this one)
+	ns.Assign("opt", types.MakeFuString("-O0"))
+	node = NewValueNode("CFLAGS", nil)
+	err = node.NodeExpand(ns)
+	assert.Nil(t, err)
+	sig2, err := node.Signature()
+	assert.Nil(t, err)
+	assert.True(t, node.Changed(sig1, sig2))
+
+	node = NewValueNode("bogus", nil)
+	err = node.NodeExpand(ns)
+	assert.Equal(t, "undefined variable 'bogus'", err.Error())
+}
+
+func Test_ValueNode_expression(t *testing.T) {
+	ns := types.NewValueMap()
+	ns.Assign("version", types.MakeFuString("1.0"))
+
+	value := types.MakeStringList("-DVERSION=$version", "-g")
+	node := NewValueNode("defines", value)
+	assert.Equal(t, "defines:value:a79dd446", node.Name())
+	err := node.NodeExpand(ns)
+	assert.Nil(t, err)
+	sig, err := node.Signature()
+	assert.Nil(t, err)
+	assert.Equal(t, "-DVERSION=1.0 -g", string(sig))
+
+	// an empty value is a perfectly good signature
+	node = NewValueNode("empty", types.MakeFuString(""))
+	err = node.NodeExpand(ns)
+	assert.Nil(t, err)
+	sig, err = node.Signature()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{}, sig)
+
+	// the same expression gets the same node; a different one, or
+	// the variable itself, gets a different node
+	dag := NewDAG()
+	node1, _ := MakeValueNode(dag, "defines", value)
+	node2, _ := MakeValueNode(dag, "defines", types.MakeStringList(
+		"-DVERSION=$version", "-g"))
+	assert.True(t, node1 == node2)
+	node2, _ = MakeValueNode(dag, "defines", types.MakeStringList("-O2"))
+	assert.False(t, node1 == node2)
+	node3, err := MakeValueNode(dag, "defines", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "defines:value", node3.Name())
+	assert.False(t, node1 == node3)
+	assert.False(t, node2 == node3)
+}
+
+func Test_EnvNode_Signature(t *testing.T) {
+	os.Setenv("FUBSY_TEST_VAR", "foo")
+	defer os.Unsetenv("FUBSY_TEST_VAR")
+
+	node := NewEnvNode("FUBSY_TEST_VAR")
+	assert.Equal(t, "FUBSY_TEST_VAR:env", node.Name())
+	assert.Equal(t, "FUBSY_TEST_VAR", node.Variable())
+	exists, err := node.Exists()
+	assert.True(t, exists)
+	assert.Nil(t, err)
+	sig1, err := node.Signature()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("foo"), sig1)
+
+	// empty and unset are different
+	os.Setenv("FUBSY_TEST_VAR", "")
+	sig2, err := node.Signature()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{}, sig2)
+	assert.True(t, node.Changed(sig1, sig2))
+
+	os.Unsetenv("FUBSY_TEST_VAR")
+	sig3, err := node.Signature()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0}, sig3)
+	assert.True(t, node.Changed(sig2, sig3))
+}
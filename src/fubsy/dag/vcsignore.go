@@ -0,0 +1,330 @@
+// Copyright © 2013, Greg Ward. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE.txt file.
+
+package dag
+
+// Support for FinderNodes that honour the ignore files of version
+// control systems (.gitignore and .hgignore), so that <**/*.py>
+// doesn't find files in virtualenvs, build output, editor droppings,
+// etc.
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"fubsy/log"
+)
+
+// directories that always belong to the VCS, never to the project
+var vcsdirs = map[string]bool{".git": true, ".hg": true}
+
+// one line from an ignore file
+type ignoreRule struct {
+	re *regexp.Regexp
+
+	// pattern started with "!": re-include anything it matches
+	negate bool
+
+	// pattern ended with "/": only matches directories
+	dironly bool
+}
+
+// Decides which files are ignored according to the .gitignore files
+// in every directory and the .hgignore file at the top of the tree
+// (the current directory). Each ignore file is read at most once.
+type vcsIgnore struct {
+	// rules read from the ignore file(s) in each directory, keyed by
+	// directory name
+	rules map[string][]ignoreRule
+}
+
+func newVCSIgnore() *vcsIgnore {
+	return &vcsIgnore{rules: make(map[string][]ignoreRule)}
+}
+
+// Return true if path (a file, or a directory if isdir is true)
+// should be ignored. Only considers path itself, not its parent
+// directories: the caller is responsible for not looking inside
+// ignored directories (e.g. by pruning them from a walk).
+func (self *vcsIgnore) ignored(path string, isdir bool) (bool, error) {
+	path = filepath.ToSlash(filepath.Clean(path))
+	if isdir && vcsdirs[filepath.Base(path)] {
+		return true, nil
+	}
+
+	// rules in deeper directories override rules in shallower
+	// directories, and later rules override earlier rules
+	result := false
+	for _, dir := range ancestorDirs(path) {
+		rules, err := self.load(dir)
+		if err != nil {
+			return false, err
+		}
+		relpath := path
+		if dir != "." {
+			relpath = path[len(dir):]
+			relpath = strings.TrimLeft(relpath, "/")
+		}
+		for _, rule := range rules {
+			if (isdir || !rule.dironly) && rule.re.MatchString(relpath) {
+				result = !rule.negate
+			}
+		}
+	}
+	return result, nil
+}
+
+// Return true if path or any of its parent directories should be
+// ignored. This is for when we have a filename without having
+// walked the directories leading up to it (e.g. below a walk root).
+func (self *vcsIgnore) ignoredPath(path string, isdir bool) (bool, error) {
+	path = filepath.ToSlash(filepath.Clean(path))
+	for _, dir := range ancestorDirs(path) {
+		if dir == "." {
+			continue
+		}
+		ignored, err := self.ignored(dir, true)
+		if ignored || err != nil {
+			return ignored, err
+		}
+	}
+	return self.ignored(path, isdir)
+}
+
+// Read the ignore file(s) in dir, unless we have already done so.
+func (self *vcsIgnore) load(dir string) ([]ignoreRule, error) {
+	if rules, ok := self.rules[dir]; ok {
+		return rules, nil
+	}
+	var rules []ignoreRule
+	if dir == "." {
+		hgrules, err := readIgnoreFile(".hgignore", parseHgIgnore)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, hgrules...)
+	}
+	gitrules, err := readIgnoreFile(
+		filepath.Join(dir, ".gitignore"), parseGitIgnore)
+	if err != nil {
+		return nil, err
+	}
+	rules = append(rules, gitrules...)
+	self.rules[dir] = rules
+	return rules, nil
+}
+
+// Return the directories whose ignore files apply to path, from
+// shallowest to deepest: e.g. for "a/b/c" that is {".", "a", "a/b"}.
+func ancestorDirs(path string) []string {
+	var dirs []string
+	if !filepath.IsAbs(path) && !strings.HasPrefix(path, "..") {
+		dirs = append(dirs, ".")
+	}
+	for i := 1; i < len(path); i++ {
+		if path[i] == '/' {
+			dirs = append(dirs, path[:i])
+		}
+	}
+	return dirs
+}
+
+func readIgnoreFile(
+	filename string, parse func(io.Reader) ([]ignoreRule, error)) (
+	[]ignoreRule, error) {
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return parse(file)
+}
+
+// Parse .gitignore syntax: one glob pattern per line, where a leading
+// "!" negates the pattern, a trailing "/" matches only directories, a
+// pattern containing "/" is relative to the directory containing the
+// .gitignore file, and any other pattern matches at any depth.
+func parseGitIgnore(reader io.Reader) ([]ignoreRule, error) {
+	var rules []ignoreRule
+	err := readLines(reader, func(line string) error {
+		line = strings.TrimRight(line, " \t\r")
+		if line == "" || line[0] == '#' {
+			return nil
+		}
+		rule := ignoreRule{}
+		if line[0] == '!' {
+			rule.negate = true
+			line = line[1:]
+		} else if line[0] == '\\' {
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dironly = true
+			line = strings.TrimRight(line, "/")
+		}
+		prefix := "^(.*/)?"
+		if strings.Contains(line, "/") {
+			prefix = "^"
+			line = strings.TrimLeft(line, "/")
+		}
+		re, err := regexp.Compile(prefix + translateIgnoreGlob(line) + "$")
+		if err != nil {
+			// should not happen, but a bad line must not break the
+			// build (see parseHgIgnore())
+			log.Warning(".gitignore: ignoring bad pattern %q: %s", line, err)
+			return nil
+		}
+		rule.re = re
+		rules = append(rules, rule)
+		return nil
+	})
+	return rules, err
+}
+
+// Parse .hgignore syntax: one pattern per line, where "syntax: glob"
+// or "syntax: regexp" sets the syntax of subsequent patterns and a
+// "glob:" or "re:" prefix sets the syntax of one pattern. Neither
+// kind of pattern is rooted: glob patterns match at any depth and
+// regexp patterns match anywhere in the path unless they start with ^.
+func parseHgIgnore(reader io.Reader) ([]ignoreRule, error) {
+	var rules []ignoreRule
+	syntax := "regexp"
+	err := readLines(reader, func(line string) error {
+		if idx := strings.Index(line, "#"); idx >= 0 {
+			line = line[:idx]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			return nil
+		}
+		if strings.HasPrefix(line, "syntax:") {
+			syntax = strings.TrimSpace(line[len("syntax:"):])
+			return nil
+		}
+		cursyntax := syntax
+		if strings.HasPrefix(line, "glob:") {
+			cursyntax = "glob"
+			line = line[len("glob:"):]
+		} else if strings.HasPrefix(line, "re:") {
+			cursyntax = "regexp"
+			line = line[len("re:"):]
+		}
+
+		var pattern string
+		switch cursyntax {
+		case "glob":
+			pattern = "(^|/)" + translateIgnoreGlob(line) + "$"
+		case "regexp", "re":
+			pattern = line
+		default:
+			// silently ignore unknown syntax (e.g. "rootglob"), rather
+			// than ignoring files that the user did not ask us to
+			return nil
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			// e.g. Perl syntax that Go does not support: as with
+			// translateIgnoreGlob(), don't refuse to build because of
+			// a file that is not ours
+			log.Warning(".hgignore: ignoring bad pattern %q: %s", line, err)
+			return nil
+		}
+		rules = append(rules, ignoreRule{re: re})
+		return nil
+	})
+	return rules, err
+}
+
+func readLines(reader io.Reader, handle func(line string) error) error {
+	breader := bufio.NewReader(reader)
+	var err error
+	for err == nil {
+		var line string
+		line, err = breader.ReadString('\n')
+		if len(line) > 0 {
+			herr := handle(strings.TrimRight(line, "\n"))
+			if herr != nil {
+				return herr
+			}
+		}
+	}
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+// Translate a glob pattern from an ignore file to a regular
+// expression. Unlike translateGlob(), this does not reject bad syntax:
+// a '[' that does not start a valid character class (e.g. "[!]" or
+// "[z-a]") is taken literally, since it's not our file and we don't
+// want to refuse to build because of it.
+func translateIgnoreGlob(glob string) string {
+	re := []byte{}
+	for i := 0; i < len(glob); i++ {
+		ch := glob[i]
+		switch {
+		case strings.HasPrefix(glob[i:], "**/"):
+			re = append(re, "(.*/)?"...)
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			re = append(re, ".*"...)
+			i++
+		case ch == '*':
+			re = append(re, "[^/]*"...)
+		case ch == '?':
+			re = append(re, "[^/]"...)
+		case ch == '\\' && i+1 < len(glob):
+			i++
+			re = append(re, regexp.QuoteMeta(glob[i:i+1])...)
+		case ch == '[':
+			class, end := translateIgnoreClass(glob, i)
+			if class == "" {
+				re = append(re, regexp.QuoteMeta("[")...)
+				continue
+			}
+			re = append(re, class...)
+			i = end
+		default:
+			re = append(re, regexp.QuoteMeta(string(ch))...)
+		}
+	}
+	return string(re)
+}
+
+// Translate the character class that starts at glob[start] (a '[')
+// to a regular expression. Return the translation and the index of
+// the closing ']', or "" if there is no valid class there. As in
+// fnmatch(3), a ']' right after "[" or "[!" is part of the class.
+func translateIgnoreClass(glob string, start int) (string, int) {
+	i := start + 1
+	negate := i < len(glob) && glob[i] == '!'
+	if negate {
+		i++
+	}
+	first := i
+	if i < len(glob) && glob[i] == ']' {
+		i++
+	}
+	end := strings.Index(glob[i:], "]")
+	if end < 0 {
+		return "", 0
+	}
+	end += i
+	class := "["
+	if negate {
+		class += "^"
+	}
+	class += strings.Replace(glob[first:end], "\\", "\\\\", -1) + "]"
+	if _, err := regexp.Compile(class); err != nil {
+		return "", 0
+	}
+	return class, end
+}
@@ -0,0 +1,211 @@
+// Copyright © 2013, Greg Ward. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE.txt file.
+
+package dag
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchrcom/testify/assert"
+
+	"fubsy/testutils"
+)
+
+func Test_parseGitIgnore(t *testing.T) {
+	input := "# comment\n" +
+		"\n" +
+		"*.pyc\n" +
+		"/build\n" +
+		"venv/\n" +
+		"doc/**/*.html\n" +
+		"!keep.pyc\n" +
+		"\\#notcomment\n"
+	rules, err := parseGitIgnore(strings.NewReader(input))
+	assert.Nil(t, err)
+	assert.Equal(t, 6, len(rules))
+
+	tests := []struct {
+		rule  int
+		path  string
+		isdir bool
+		match bool
+	}{
+		{0, "foo.pyc", false, true},
+		{0, "a/b/foo.pyc", false, true},
+		{0, "foo.py", false, false},
+		{1, "build", true, true},
+		{1, "src/build", true, false},
+		{2, "venv", true, true},
+		{2, "a/venv", true, true},
+		{3, "doc/x.html", false, true},
+		{3, "doc/a/b/x.html", false, true},
+		{3, "src/doc/x.html", false, false},
+		{4, "a/keep.pyc", false, true},
+		{5, "#notcomment", false, true},
+	}
+	for i, test := range tests {
+		rule := rules[test.rule]
+		actual := rule.re.MatchString(test.path)
+		if actual != test.match {
+			t.Errorf("test %d: rule %d (%s) vs %s: expected %v",
+				i, test.rule, rule.re, test.path, test.match)
+		}
+	}
+	assert.True(t, rules[2].dironly)
+	assert.True(t, rules[4].negate)
+}
+
+// malformed character classes are taken literally, rather than
+// breaking the build
+func Test_parseGitIgnore_bad_class(t *testing.T) {
+	input := "[!]\n" +
+		"[z-a].o\n" +
+		"[unterminated\n" +
+		"[!a-c].o\n" +
+		"[]x]\n"
+	rules, err := parseGitIgnore(strings.NewReader(input))
+	assert.Nil(t, err)
+	assert.Equal(t, 5, len(rules))
+
+	tests := []struct {
+		rule  int
+		path  string
+		match bool
+	}{
+		{0, "[!]", true},
+		{0, "a", false},
+		{1, "[z-a].o", true},
+		{1, "b.o", false},
+		{2, "[unterminated", true},
+		{3, "d.o", true},
+		{3, "b.o", false},
+		{4, "]", true},
+		{4, "x", true},
+		{4, "y", false},
+	}
+	for i, test := range tests {
+		rule := rules[test.rule]
+		actual := rule.re.MatchString(test.path)
+		if actual != test.match {
+			t.Errorf("test %d: rule %d (%s) vs %s: expected %v",
+				i, test.rule, rule.re, test.path, test.match)
+		}
+	}
+}
+
+func Test_parseHgIgnore(t *testing.T) {
+	input := "\\.orig$  # backups\n" +
+		"syntax: glob\n" +
+		"*.pyc\n" +
+		"re:^tmp/\n" +
+		"syntax: rootglob\n" +
+		"whatever\n"
+	rules, err := parseHgIgnore(strings.NewReader(input))
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(rules))
+	assert.True(t, rules[0].re.MatchString("a/b.c.orig"))
+	assert.True(t, rules[1].re.MatchString("a/b.pyc"))
+	assert.False(t, rules[1].re.MatchString("a/b.pyc.txt"))
+	assert.True(t, rules[2].re.MatchString("tmp/foo"))
+	assert.False(t, rules[2].re.MatchString("a/tmp/foo"))
+
+	// patterns that Go cannot compile (e.g. Perl lookahead) are
+	// skipped rather than failing the build
+	rules, err = parseHgIgnore(strings.NewReader("foo(\n^(?!src/)\n\\.o$\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(rules))
+	assert.True(t, rules[0].re.MatchString("a/b.o"))
+}
+
+func Test_vcsIgnore_ignored(t *testing.T) {
+	cleanup := testutils.Chtemp()
+	defer cleanup()
+
+	err := os.Mkdir("src", 0755)
+	assert.Nil(t, err)
+	testutils.Mkfile(".", ".gitignore", "*.log\n/out/\n")
+	testutils.Mkfile("src", ".gitignore", "gen/\n!keep.log\n")
+	testutils.Mkfile(".", ".hgignore", "syntax: glob\n*~\n")
+
+	ignore := newVCSIgnore()
+	tests := []struct {
+		path    string
+		isdir   bool
+		ignored bool
+	}{
+		{"a.log", false, true},
+		{"a.c", false, false},
+		{"a.c~", false, true},
+		{"out", true, true},
+		{"out", false, false},
+		{"src/out", true, false},
+		{"src/gen", true, true},
+		{"src/x.log", false, true},
+		{"src/keep.log", false, false},
+		{"lib/gen", true, false},
+		{".git", true, true},
+		{"sub/.hg", true, true},
+	}
+	for _, test := range tests {
+		actual, err := ignore.ignored(test.path, test.isdir)
+		assert.Nil(t, err)
+		if actual != test.ignored {
+			t.Errorf("ignored(%#v, %v): expected %v, but got %v",
+				test.path, test.isdir, test.ignored, actual)
+		}
+	}
+
+	// ignoredPath() also considers parent directories
+	ignored, err := ignore.ignoredPath("src/gen/foo.c", false)
+	assert.Nil(t, err)
+	assert.True(t, ignored)
+	ignored, err = ignore.ignoredPath("src/foo.c", false)
+	assert.Nil(t, err)
+	assert.False(t, ignored)
+}
+
+func Test_FinderNode_FindFiles_vcsignore(t *testing.T) {
+	cleanup := testutils.Chtemp()
+	defer cleanup()
+
+	testutils.TouchFiles(
+		"main.py", "main.pyc",
+		"lib/util.py", "lib/util.pyc", "lib/junk/stuff.py",
+		"venv/lib/site.py",
+		".git/hooks/hook.py")
+	testutils.Mkfile(".", ".gitignore", "*.pyc\nvenv/\n")
+	testutils.Mkfile("lib", ".gitignore", "junk\n")
+
+	finder := NewFinderNode("**/*.py*")
+	assertExpand(t, nil, []string{
+		".git/hooks/hook.py",
+		"lib/junk/stuff.py",
+		"lib/util.py",
+		"lib/util.pyc",
+		"main.py",
+		"main.pyc",
+		"venv/lib/site.py",
+	}, finder)
+
+	finder = NewFinderNode("**/*.py*")
+	finder = finder.VCSIgnore()
+	assert.Equal(t, "**/*.py*.vcsignore()", finder.Name())
+	assert.Equal(t, "<**/*.py*>.vcsignore()", finder.String())
+	assertExpand(t, nil, []string{"lib/util.py", "main.py"}, finder)
+
+	// ignored directories are pruned, i.e. never walked
+	err := os.Chmod("venv/lib", 0)
+	assert.Nil(t, err)
+	defer os.Chmod("venv/lib", 0755)
+	finder = NewFinderNode("**/*.py", "*/*/*.py")
+	finder = finder.VCSIgnore()
+	assertExpand(t, nil, []string{"lib/util.py", "main.py"}, finder)
+
+	// a plain FinderNode fails on the unreadable directory
+	finder = NewFinderNode("**/*.py")
+	_, err = finder.FindFiles()
+	assert.NotNil(t, err)
+}
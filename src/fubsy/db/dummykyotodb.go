@@ -33,6 +33,18 @@ func (self KyotoDB) WriteNode(nodename string, record *BuildRecord) error {
 	panic("fake implementation")
 }
 
+func (self KyotoDB) LookupValue(key string) ([]byte, error) {
+	panic("fake implementation")
+}
+
+func (self KyotoDB) WriteValue(key string, value []byte) error {
+	panic("fake implementation")
+}
+
+func (self KyotoDB) CheckHashAlgorithm(hashalg string) (bool, error) {
+	panic("fake implementation")
+}
+
 func (self KyotoDB) Dump(writer io.Writer, indent string) {
 	panic("fake implementation")
 }
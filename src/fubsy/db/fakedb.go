@@ -13,11 +13,13 @@ import (
 // persistent, so only suitable for use in test code.
 type FakeDB struct {
 	parents map[string]*BuildRecord
+	values  map[string][]byte
 }
 
 func NewFakeDB() *FakeDB {
 	return &FakeDB{
 		parents: make(map[string]*BuildRecord),
+		values:  make(map[string][]byte),
 	}
 }
 
@@ -39,6 +41,15 @@ func (self *FakeDB) WriteNode(name string, record *BuildRecord) error {
 	return nil
 }
 
+func (self *FakeDB) LookupValue(key string) ([]byte, error) {
+	return self.values[key], nil
+}
+
+func (self *FakeDB) WriteValue(key string, value []byte) error {
+	self.values[key] = value
+	return nil
+}
+
 func (self *FakeDB) Dump(writer io.Writer, indent string) {
 	for node, record := range self.parents {
 		fmt.Fprintf(writer, "%s%s:\n", indent, node)
@@ -27,6 +27,7 @@ type KyotoDB struct {
 // key prefixes (to allow multiple namespaces in a single database)
 const PREFIX_META = "\x00\x00\x00\x00"
 const PREFIX_NODE = "\x00\x00\x00\x01"
+const PREFIX_VALUE = "\x00\x00\x00\x02"
 
 // database version numbers: a database created by this code has
 // version set to CURRENT_VERSION, and we can open databases where
@@ -101,6 +102,20 @@ func (self KyotoDB) WriteNode(nodename string, record *BuildRecord) error {
 	return nil
 }
 
+func (self KyotoDB) LookupValue(key string) ([]byte, error) {
+	log.Debug(log.DB, "loading value %s", key)
+	val, err := self.kcdb.Get(makekey(PREFIX_VALUE, key))
+	if val == nil && (err == nil || kyotoNoRecord(err)) {
+		return nil, nil
+	}
+	return val, err
+}
+
+func (self KyotoDB) WriteValue(key string, value []byte) error {
+	log.Debug(log.DB, "writing value %s", key)
+	return self.kcdb.Set(makekey(PREFIX_VALUE, key), value)
+}
+
 func (self KyotoDB) Dump(writer io.Writer, indent string) {
 	curs := self.kcdb.Cursor()
 	defer curs.Del()
@@ -177,6 +192,51 @@ func (self KyotoDB) checkVersion(
 	return err
 }
 
+// Make sure the signatures in this database were computed with the
+// specified hash algorithm. If not (e.g. the user has selected a
+// different algorithm since the last build), discard every node
+// record so that everything is rebuilt from scratch, and remember the
+// new algorithm. Return true if records were discarded.
+func (self KyotoDB) CheckHashAlgorithm(hashalg string) (bool, error) {
+	key := makekey(PREFIX_META, "hash")
+	val, err := self.kcdb.Get(key)
+	if err != nil && !kyotoNoRecord(err) {
+		return false, err
+	}
+	if err == nil && string(val) == hashalg {
+		return false, nil
+	}
+
+	// Either the algorithm changed or it was never recorded. In the
+	// latter case, any existing node records are from a version of
+	// Fubsy that did not record it, so they cannot be trusted either.
+	// (N.B. cannot use MatchPrefix() here: our keys contain NUL bytes.)
+	reset := false
+	curs := self.kcdb.Cursor()
+	defer curs.Del()
+	err = curs.Jump()
+	for err == nil {
+		var ckey []byte
+		ckey, err = curs.GetKey(false)
+		if err != nil {
+			break
+		}
+		if bytes.HasPrefix(ckey, []byte(PREFIX_NODE)) {
+			log.Debug(log.DB, "discarding record for node %s (hash: %q -> %q)",
+				ckey[4:], val, hashalg)
+			err = curs.Remove() // implicitly advances the cursor
+			reset = true
+		} else {
+			err = curs.Step()
+		}
+	}
+	if !kyotoNoRecord(err) {
+		return reset, err
+	}
+	err = self.kcdb.Set(key, []byte(hashalg))
+	return reset, err
+}
+
 func makekey(prefix, name string) []byte {
 	key := make([]byte, 4+len(name))
 	copy(key, prefix)
@@ -124,6 +124,54 @@ func Test_KyotoDB_checkVersion(t *testing.T) {
 	}
 }
 
+func Test_KyotoDB_CheckHashAlgorithm(t *testing.T) {
+	cleanup := testutils.Chtemp()
+	defer cleanup()
+
+	db, err := OpenKyotoDB("test.kch", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// brand-new empty DB: record the algorithm, nothing to discard
+	reset, err := db.CheckHashAlgorithm("fnv")
+	assert.Nil(t, err)
+	assert.False(t, reset)
+	val, err := db.kcdb.Get(makekey(PREFIX_META, "hash"))
+	assert.Nil(t, err)
+	assert.Equal(t, "fnv", string(val))
+
+	rec := NewBuildRecord()
+	rec.SetTargetSignature([]byte{1, 2, 3})
+	db.WriteNode("foo", rec)
+	db.WriteNode("bar", rec)
+
+	// same algorithm: records are kept
+	reset, err = db.CheckHashAlgorithm("fnv")
+	assert.Nil(t, err)
+	assert.False(t, reset)
+	rec2, err := db.LookupNode("foo")
+	assert.Nil(t, err)
+	assert.True(t, rec.Equal(rec2))
+
+	// different algorithm: all node records are discarded, but
+	// metadata survives
+	reset, err = db.CheckHashAlgorithm("sha256")
+	assert.Nil(t, err)
+	assert.True(t, reset)
+	rec2, err = db.LookupNode("foo")
+	assert.Nil(t, err)
+	assert.Nil(t, rec2)
+	rec2, err = db.LookupNode("bar")
+	assert.Nil(t, err)
+	assert.Nil(t, rec2)
+	val, err = db.kcdb.Get(makekey(PREFIX_META, "hash"))
+	assert.Nil(t, err)
+	assert.Equal(t, "sha256", string(val))
+	_, err = db.kcdb.Get(makekey(PREFIX_META, "version"))
+	assert.Nil(t, err)
+}
+
 func Test_KyotoDB_key_prefix(t *testing.T) {
 	// make sure we write the key exactly as expected, byte-for-byte
 	cleanup := testutils.Chtemp()
@@ -181,3 +229,33 @@ func Test_KyotoDB_error(t *testing.T) {
 	assert.Equal(t,
 		"could not open no/such/directory/db.kch: no repository", err.Error())
 }
+
+func Test_KyotoDB_values(t *testing.T) {
+	cleanup := testutils.Chtemp()
+	defer cleanup()
+
+	db, err := OpenKyotoDB("test.kch", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := db.LookupValue("foo")
+	assert.Nil(t, value)
+	assert.Nil(t, err)
+
+	err = db.WriteValue("foo", []byte("bar\n"))
+	assert.Nil(t, err)
+	// values and nodes do not collide
+	record, err := db.LookupNode("foo")
+	assert.Nil(t, record)
+	assert.Nil(t, err)
+
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = OpenKyotoDB("test.kch", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err = db.LookupValue("foo")
+	assert.Nil(t, err)
+	assert.Equal(t, "bar\n", string(value))
+}
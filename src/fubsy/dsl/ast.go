@@ -113,8 +113,9 @@ type ASTAssignment struct {
 // (children is a list of ASTNode, one per action)
 type ASTBuildRule struct {
 	astbase
-	targets ASTExpression
-	sources ASTExpression
+	targets   ASTExpression
+	sources   ASTExpression
+	orderonly ASTExpression // nil if rule has no order-only sources
 	children
 }
 
@@ -162,6 +163,7 @@ type ASTString struct {
 type ASTFileFinder struct {
 	astbase
 	patterns []string
+	excludes []string
 }
 
 func (self children) Dump(writer io.Writer, indent string) {
@@ -365,13 +367,15 @@ func (self *ASTAssignment) Expression() ASTExpression {
 func NewASTBuildRule(
 	targets ASTExpression,
 	sources ASTExpression,
+	orderonly ASTExpression,
 	block *ASTBlock) *ASTBuildRule {
 	location := mergeLocations(targets, block)
 	return &ASTBuildRule{
-		astbase:  astbase{location},
-		targets:  targets,
-		sources:  sources,
-		children: block.children}
+		astbase:   astbase{location},
+		targets:   targets,
+		sources:   sources,
+		orderonly: orderonly,
+		children:  block.children}
 }
 
 func (self *ASTBuildRule) Dump(writer io.Writer, indent string) {
@@ -380,6 +384,10 @@ func (self *ASTBuildRule) Dump(writer io.Writer, indent string) {
 	self.targets.Dump(writer, indent+"  ")
 	fmt.Fprintf(writer, "%ssources:\n", indent)
 	self.sources.Dump(writer, indent+"  ")
+	if self.orderonly != nil {
+		fmt.Fprintf(writer, "%sorder-only:\n", indent)
+		self.orderonly.Dump(writer, indent+"  ")
+	}
 	fmt.Fprintf(writer, "%sactions:\n", indent)
 	self.children.Dump(writer, indent)
 	fmt.Fprintf(writer, "%s}\n", indent)
@@ -390,6 +398,8 @@ func (self *ASTBuildRule) Equal(other_ ASTNode) bool {
 		return other != nil &&
 			self.targets.Equal(other.targets) &&
 			self.sources.Equal(other.sources) &&
+			(self.orderonly == nil) == (other.orderonly == nil) &&
+			(self.orderonly == nil || self.orderonly.Equal(other.orderonly)) &&
 			self.children.Equal(other.children)
 	}
 	return false
@@ -403,6 +413,12 @@ func (self *ASTBuildRule) Sources() ASTExpression {
 	return self.sources
 }
 
+// Return the expression for this rule's order-only sources, or nil
+// if it has none.
+func (self *ASTBuildRule) OrderOnly() ASTExpression {
+	return self.orderonly
+}
+
 func (self *ASTBuildRule) Actions() []ASTNode {
 	return self.children
 }
@@ -620,25 +636,35 @@ func NewASTFileFinder(patterns []string, location ...Locatable) *ASTFileFinder {
 }
 
 func (self *ASTFileFinder) Dump(writer io.Writer, indent string) {
-	fmt.Fprintln(writer,
-		indent+"ASTFileFinder["+strings.Join(self.patterns, " ")+"]")
+	fmt.Fprintln(writer, indent+"ASTFileFinder"+self.String())
 }
 
 func (self *ASTFileFinder) Equal(other_ ASTNode) bool {
 	if other, ok := other_.(*ASTFileFinder); ok {
-		return other != nil && reflect.DeepEqual(self.patterns, other.patterns)
+		return other != nil &&
+			reflect.DeepEqual(self.patterns, other.patterns) &&
+			reflect.DeepEqual(self.excludes, other.excludes)
 	}
 	return false
 }
 
 func (self *ASTFileFinder) String() string {
-	return "[" + strings.Join(self.patterns, " ") + "]"
+	result := "[" + strings.Join(self.patterns, " ")
+	for _, pattern := range self.excludes {
+		result += " !" + pattern
+	}
+	return result + "]"
 }
 
 func (self *ASTFileFinder) Patterns() []string {
 	return self.patterns
 }
 
+// Return the exclude patterns (without the leading "!").
+func (self *ASTFileFinder) Excludes() []string {
+	return self.excludes
+}
+
 func toStrings(expressions []ASTExpression) []string {
 	result := make([]string, len(expressions))
 	for i, expr := range expressions {
@@ -49,8 +49,9 @@ const BADTOKEN = -1
 %type <expr> filefinder
 %type <tokenlist> patternlist
 
-%token <token> IMPORT PLUGIN INLINE NAME QSTRING FILEPATTERN R3BRACE
-%token <token> '(' ')' '[' ']' '<' '>' '{' '}'
+%token <token> IMPORT PLUGIN INLINE NAME QSTRING FILEPATTERN EXCLUDEPATTERN
+%token <token> R3BRACE
+%token <token> '(' ')' '[' ']' '<' '>' '{' '}' '|'
 %token EOL EOF PLUGIN L3BRACE R3BRACE
 
 %%
@@ -156,7 +157,12 @@ buildrule:
 	{
 		// some actions could be invalid: we check those in check.go
 		// after parsing is done
-		$$ = NewASTBuildRule($1, $3, $4.(*ASTBlock))
+		$$ = NewASTBuildRule($1, $3, nil, $4.(*ASTBlock))
+	}
+|	expr ':' expr '|' expr block
+	{
+		// sources after '|' are order-only
+		$$ = NewASTBuildRule($1, $3, $5, $6.(*ASTBlock))
 	}
 
 expr:
@@ -181,7 +187,14 @@ primaryexpr:
 filefinder:
 	'<' patternlist '>'
 	{
-		$$ = NewASTFileFinder(extractText($2), $1, $3)
+		parser := fulex.(*Parser)
+		finder := newFileFinderFromTokens($2, $1, $3)
+		if len(finder.patterns) == 0 {
+			parser.SetError(parser.NewSyntaxError(
+				"filefinder must have at least one include pattern"))
+		} else {
+			$$ = finder
+		}
 	}
 
 patternlist:
@@ -189,10 +202,18 @@ patternlist:
 	{
 		$$ = append($1, $2)
 	}
+|	patternlist EXCLUDEPATTERN
+	{
+		$$ = append($1, $2)
+	}
 |	FILEPATTERN
 	{
 		$$ = []token {$1}
 	}
+|	EXCLUDEPATTERN
+	{
+		$$ = []token {$1}
+	}
 
 list:
 	'[' ']'
@@ -297,6 +318,23 @@ func (self *Parser) NewSyntaxError(message string) *SyntaxError {
 	}
 }
 
+// Split the tokens inside <...> into include patterns (FILEPATTERN)
+// and exclude patterns (EXCLUDEPATTERN, minus the leading "!").
+func newFileFinderFromTokens(
+	tokens []token, location ...Locatable) *ASTFileFinder {
+	var includes, excludes []string
+	for _, token := range tokens {
+		if token.id == EXCLUDEPATTERN {
+			excludes = append(excludes, token.text[1:])
+		} else {
+			includes = append(includes, token.text)
+		}
+	}
+	finder := NewASTFileFinder(includes, location...)
+	finder.excludes = excludes
+	return finder
+}
+
 func extractText(tokens []token) []string {
 	text := make([]string, len(tokens))
 	for i, token := range tokens {
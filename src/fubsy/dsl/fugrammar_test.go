@@ -337,6 +337,48 @@ func Test_fuParse_filefinder(t *testing.T) {
 	assertParses(t, expect, tokens)
 }
 
+func Test_fuParse_filefinder_exclude(t *testing.T) {
+	// parse "main { x = <!test/* **/*.c !*_gen.c> }"
+	tokens := []minitok{
+		{NAME, "main"},
+		{'{', "{"},
+		{EOL, "\n"},
+		{NAME, "x"},
+		{'=', "="},
+		{'<', "<"},
+		{EXCLUDEPATTERN, "!test/*"},
+		{FILEPATTERN, "**/*.c"},
+		{EXCLUDEPATTERN, "!*_gen.c"},
+		{'>', ">"},
+		{EOL, "\n"},
+		{'}', "}"},
+		{EOL, ""},
+		{EOF, ""},
+	}
+	expect := &ASTRoot{
+		children: []ASTNode{
+			&ASTPhase{
+				name: "main",
+				children: []ASTNode{
+					&ASTAssignment{
+						target: "x",
+						expr: &ASTFileFinder{
+							patterns: []string{"**/*.c"},
+							excludes: []string{"test/*", "*_gen.c"},
+						}}}}}}
+	assertParses(t, expect, tokens)
+
+	// only exclude patterns: error
+	tokens = append(tokens[:7], tokens[8:]...)
+	parser := NewParser(toklist(tokens))
+	fuParse(parser)
+	err := parser.syntaxerror
+	assert.NotNil(t, err)
+	assert.Equal(t,
+		"filefinder must have at least one include pattern (near '>')",
+		err.Error())
+}
+
 func Test_fuParse_buildrule_1(t *testing.T) {
 	// parse:
 	// main {
@@ -383,6 +425,47 @@ func Test_fuParse_buildrule_1(t *testing.T) {
 	assertParses(t, expect, tokens)
 }
 
+func Test_fuParse_buildrule_orderonly(t *testing.T) {
+	// parse:
+	// main {
+	//   a: "x" | d {
+	//     "foo bar"
+	//   }
+	// }
+	tokens := []minitok{
+		{NAME, "main"},
+		{'{', "{"},
+		{EOL, "\n"},
+		{NAME, "a"},
+		{':', ":"},
+		{QSTRING, "\"x\""},
+		{'|', "|"},
+		{NAME, "d"},
+		{'{', "{"},
+		{EOL, "\n"},
+		{QSTRING, "\"foo bar\""},
+		{EOL, "\n"},
+		{'}', "}"},
+		{EOL, "\n"},
+		{'}', "}"},
+		{EOL, ""},
+		{EOF, ""},
+	}
+	expect := &ASTRoot{
+		children: []ASTNode{
+			&ASTPhase{
+				name: "main",
+				children: []ASTNode{
+					&ASTBuildRule{
+						targets:   &ASTName{name: "a"},
+						sources:   &ASTString{value: "x"},
+						orderonly: &ASTName{name: "d"},
+						children: []ASTNode{
+							&ASTString{value: "foo bar"},
+						}}}}}}
+	assertParses(t, expect, tokens)
+}
+
 func Test_fuParse_valid_inline(t *testing.T) {
 	tokens := []minitok{
 		{PLUGIN, "plugin"},
@@ -94,6 +94,20 @@ func TestScan_filefinder(t *testing.T) {
 		29, 29, 3)
 }
 
+func TestScan_filefinder_exclude(t *testing.T) {
+	input := "<src/**/*.c !**/test_*.c !gen/*>!"
+	expect := []minitok{
+		{'<', "<"},
+		{FILEPATTERN, "src/**/*.c"},
+		{EXCLUDEPATTERN, "!**/test_*.c"},
+		{EXCLUDEPATTERN, "!gen/*"},
+		{'>', ">"},
+		{BADTOKEN, "!"},
+		{EOL, ""},
+	}
+	assertScan(t, expect, scan(input))
+}
+
 func TestScan_valid_2(t *testing.T) {
 	input := "main{\"foo\"<bar( )baz>} #ignore"
 	expect := []minitok{
@@ -0,0 +1,100 @@
+// Copyright © 2013, Greg Ward. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE.txt file.
+
+package events
+
+// Package events writes a machine-readable record of what happens
+// during a build, for IDEs, CI dashboards, and the like to consume as
+// it happens. Each event is one JSON object on a line by itself,
+// with at least two keys: "event" (what happened, e.g.
+// "action_start") and "time" (when, in RFC 3339 format). The other
+// keys depend on the event. A nil *Stream is valid and discards
+// everything, so callers need not check whether events are enabled.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"fubsy/log"
+)
+
+type Stream struct {
+	lock   sync.Mutex
+	writer io.Writer
+
+	// nil if we did not open writer ourselves (so must not close it)
+	closer io.Closer
+}
+
+// the event-specific keys and values of one event
+type Fields map[string]interface{}
+
+func NewStream(writer io.Writer) *Stream {
+	return &Stream{writer: writer}
+}
+
+// Open the event stream described by spec: either "fd:N" for an
+// already-open file descriptor (e.g. a pipe set up by whoever ran
+// Fubsy), or the name of a file to create.
+func Open(spec string) (*Stream, error) {
+	if strings.HasPrefix(spec, "fd:") {
+		fd, err := strconv.Atoi(spec[3:])
+		if err != nil || fd < 0 {
+			return nil, fmt.Errorf(
+				"invalid event stream '%s': expected fd:N, "+
+					"where N is a file descriptor", spec)
+		}
+		file := os.NewFile(uintptr(fd), spec)
+		return &Stream{writer: file}, nil
+	}
+	file, err := os.Create(spec)
+	if err != nil {
+		return nil, err
+	}
+	return &Stream{writer: file, closer: file}, nil
+}
+
+// Write one event to the stream. Errors are reported as warnings (at
+// most once), since a broken event stream should not break the
+// build.
+func (self *Stream) Emit(event string, fields Fields) {
+	if self == nil {
+		return
+	}
+	record := make(Fields, len(fields)+2)
+	for key, value := range fields {
+		record[key] = value
+	}
+	record["event"] = event
+	record["time"] = time.Now().Format(time.RFC3339Nano)
+	data, err := json.Marshal(record)
+	if err != nil {
+		panic(err) // only if a caller passed a value JSON can't encode
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.writer == nil {
+		return
+	}
+	_, err = self.writer.Write(append(data, '\n'))
+	if err != nil {
+		log.Warning("error writing build events (no more will be written): %s",
+			err)
+		self.writer = nil
+	}
+}
+
+func (self *Stream) Close() error {
+	if self == nil || self.closer == nil {
+		return nil
+	}
+	return self.closer.Close()
+}
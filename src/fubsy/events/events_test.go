@@ -0,0 +1,73 @@
+// Copyright © 2013, Greg Ward. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE.txt file.
+
+package events
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchrcom/testify/assert"
+
+	"fubsy/testutils"
+)
+
+func Test_Stream_Emit(t *testing.T) {
+	buf := &bytes.Buffer{}
+	stream := NewStream(buf)
+	stream.Emit("node_state", Fields{"node": "foo.o", "state": "BUILT"})
+	stream.Emit("build_summary", Fields{"ok": true, "built": 1})
+
+	lines := strings.Split(buf.String(), "\n")
+	assert.Equal(t, 3, len(lines))
+	assert.Equal(t, "", lines[2])
+
+	var event map[string]interface{}
+	err := json.Unmarshal([]byte(lines[0]), &event)
+	assert.Nil(t, err)
+	_, err = time.Parse(time.RFC3339Nano, event["time"].(string))
+	assert.Nil(t, err)
+	delete(event, "time")
+	expect := map[string]interface{}{
+		"event": "node_state", "node": "foo.o", "state": "BUILT"}
+	assert.Equal(t, expect, event)
+
+	assert.True(t, strings.HasPrefix(lines[1],
+		`{"built":1,"event":"build_summary","ok":true,"time":`))
+
+	// a nil stream discards everything
+	stream = nil
+	stream.Emit("build_start", nil)
+	assert.Nil(t, stream.Close())
+}
+
+func Test_Open(t *testing.T) {
+	cleanup := testutils.Chtemp()
+	defer cleanup()
+
+	stream, err := Open("events.json")
+	assert.Nil(t, err)
+	stream.Emit("build_start", Fields{"targets": []string{"foo"}})
+	assert.Nil(t, stream.Close())
+	data, err := ioutil.ReadFile("events.json")
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(string(data),
+		`{"event":"build_start","targets":["foo"],"time":`))
+
+	stream, err = Open("fd:2")
+	assert.Nil(t, err)
+	assert.Nil(t, stream.Close()) // must not close stderr!
+
+	_, err = Open("fd:x")
+	assert.Equal(t,
+		"invalid event stream 'fd:x': expected fd:N, "+
+			"where N is a file descriptor",
+		err.Error())
+	_, err = Open("nonexistent/events.json")
+	assert.NotNil(t, err)
+}
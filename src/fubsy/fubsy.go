@@ -8,13 +8,16 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"strings"
 
 	"github.com/ogier/pflag"
 
 	"fubsy/build"
+	"fubsy/dag"
 	"fubsy/dsl"
+	"fubsy/events"
 	"fubsy/log"
 	"fubsy/runtime"
 )
@@ -24,6 +27,54 @@ type args struct {
 	scriptFile  string
 	debugTopics []string
 	verbosity   uint
+	sigModes    []string
+	hashAlg     string
+	gitRange    string // for --affected-by-git
+	watch       bool
+	eventSpec   string // for --events
+
+	// subcommand to run instead of building (e.g. "targets"), or ""
+	command string
+
+	// options for "targets"
+	listAll  bool
+	listTree bool
+
+	// options for "graph"
+	graphFormat string
+}
+
+// subcommands: if the first non-option argument is one of these, it's
+// a command rather than a target to build ("build" is the same as no
+// command, for building targets that are named like a command)
+var commands = map[string]bool{
+	"build":   true,
+	"targets": true,
+	"graph":   true,
+	"query":   true,
+	"log":     true,
+}
+
+// options that only apply to some subcommands ("build" includes no
+// command at all)
+var commandOptions = map[string][]string{
+	"all":    {"targets"},
+	"tree":   {"targets"},
+	"format": {"graph"},
+
+	// options for building; those that affect whether targets are
+	// up to date also apply to "targets"
+	"keep-going":      {"build"},
+	"jobs":            {"build"},
+	"hermetic":        {"build"},
+	"affected-by":     {"build"},
+	"affected-by-git": {"build"},
+	"watch":           {"build"},
+	"trace":           {"build"},
+	"events":          {"build"},
+	"check-all":       {"build", "targets"},
+	"signatures":      {"build", "targets"},
+	"hash":            {"build", "targets"},
 }
 
 func main() {
@@ -44,6 +95,24 @@ func main() {
 		fmt.Fprintln(os.Stderr, "fubsy: error: "+err.Error())
 		os.Exit(2)
 	}
+	err = dag.SetSignatureModes(args.sigModes)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "fubsy: error: "+err.Error())
+		os.Exit(2)
+	}
+	err = dag.SetHashAlgorithm(args.hashAlg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "fubsy: error: "+err.Error())
+		os.Exit(2)
+	}
+	if args.gitRange != "" {
+		changed, err := gitChangedFiles(args.gitRange)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "fubsy: error: "+err.Error())
+			os.Exit(2)
+		}
+		args.options.AffectedBy = append(args.options.AffectedBy, changed...)
+	}
 
 	ast, errors := dsl.Parse(script)
 	if ast == nil && len(errors) == 0 {
@@ -54,13 +123,52 @@ func main() {
 	log.DebugDump(log.AST, ast)
 
 	rt := runtime.NewRuntime(args.options, script, ast)
-	errors = rt.RunScript()
+	if args.eventSpec != "" {
+		stream, err := events.Open(args.eventSpec)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "fubsy: error: "+err.Error())
+			os.Exit(2)
+		}
+		defer stream.Close()
+		rt.SetEvents(stream)
+	}
+	switch args.command {
+	case "targets":
+		errors = rt.ListTargets(os.Stdout, args.listAll, args.listTree)
+	case "graph":
+		errors = rt.WriteGraph(os.Stdout, args.graphFormat)
+	case "query":
+		if len(args.options.Targets) == 0 {
+			fmt.Fprintln(os.Stderr, "fubsy: error: query: no query expression")
+			os.Exit(2)
+		}
+		query := strings.Join(args.options.Targets, " ")
+		errors = rt.RunQuery(os.Stdout, query)
+	case "log":
+		if len(args.options.Targets) == 0 {
+			fmt.Fprintln(os.Stderr, "fubsy: error: log: no target specified")
+			os.Exit(2)
+		}
+		errors = rt.ShowLogs(os.Stdout, args.options.Targets)
+	default:
+		if args.watch {
+			errors = rt.Watch()
+		} else {
+			errors = rt.RunScript()
+		}
+	}
 	checkErrors("error:", errors)
 }
 
 func usage() {
-	fmt.Printf("Usage: %s [options] [target ...]\n", filepath.Base(os.Args[0]))
+	prog := filepath.Base(os.Args[0])
+	fmt.Printf("Usage: %s [options] [build] [target ...]\n", prog)
+	fmt.Printf("   or: %s [options] targets [--all] [--tree] [target ...]\n", prog)
+	fmt.Printf("   or: %s [options] graph [--format=dot|json] [target ...]\n", prog)
+	fmt.Printf("   or: %s [options] query EXPR\n", prog)
+	fmt.Printf("   or: %s [options] log TARGET ...\n", prog)
 	topics := strings.Join(log.TopicNames(), ", ")
+	hashalgs := strings.Join(dag.HashAlgorithms(), ", ")
 	help := `
 Build out-of-date targets from sources by executing actions defined in
 a build script according to the dependencies between sources and
@@ -68,13 +176,63 @@ targets.
 
 Options:
   -k, --keep-going         continue building even when some targets fail
+  -j N, --jobs=N           run up to N build rules at once (default: 1);
+                           use pools to limit rules that must not all
+                           run together
   --check-all              check all files for changes, not just sources
+  --hermetic               run actions with only the environment
+                           variables declared by the build script
+  --signatures=MODE,...    how to detect changed files: one of
+                           content (hash every file), timestamp (compare
+                           mtime, size, and inode), or hybrid (only
+                           rehash files whose timestamp has changed);
+                           use TYPE:MODE to set the mode for one node
+                           type (e.g. FileNode:hybrid)
+  --hash=ALG               hash algorithm for file signatures: one of
+                           ` + hashalgs + ` (default: fnv); changing it
+                           forces a full rebuild
+  --affected-by=FILE,...   only build the requested targets (default: all
+                           final targets) that depend on the named files
+  --affected-by-git=RANGE  like --affected-by, for the files changed in a
+                           git revision range (e.g. origin/master..HEAD)
+  --watch                  after building, watch source files and the
+                           build script, and rebuild when they change
+                           (Linux only)
+  --trace=FILE             record how long each step of the build takes
+                           in FILE (Chrome trace format, for
+                           about:tracing), and summarize the slowest
+                           actions and the critical path
+  --events=FILE|fd:N       report the progress of the build as a stream
+                           of JSON objects (one per line) written to
+                           FILE or to file descriptor N
   -f FILE, --file=FILE     read build script from FILE (default: main.fubsy)
   -v, --verbose            print more informative messages
   -q, --quiet              suppress all non-error output
   --debug=TOPIC,...        print detailed debug info about TOPIC: one of
                            ` + topics + `
-                           (specify multiple topics as a comma-separated list)`
+                           (specify multiple topics as a comma-separated list)
+
+Commands:
+  build                    build the named targets (default: all final
+                           targets); only needed if the first target is
+                           named like a command, e.g. "fubsy build log"
+  targets                  list final targets and aliases (or the named
+                           targets) with their build rules and whether
+                           they are up to date, without building anything
+    --all                  list every target, not just final targets
+    --tree                 show each target's dependencies below it
+  graph                    write the dependency graph of the final targets
+                           (or the named targets) to standard output
+    --format=FORMAT        dot (for Graphviz; the default) or json
+  query                    list the nodes matching EXPR, which combines
+                           node names with deps(x), rdeps(x),
+                           affected(x), somepath(x, y), type(TYPE, x),
+                           and the set operators + (union), ^
+                           (intersection), and - (difference); e.g. to
+                           find the tests that depend on foo.c:
+                             fubsy query 'type(ActionNode, rdeps(foo.c))'
+  log                      show the output of the commands that last
+                           built each TARGET`
 
 	fmt.Println(help)
 }
@@ -83,15 +241,41 @@ func parseArgs() args {
 	result := args{}
 	pflag.Usage = usage
 	pflag.BoolVarP(&result.options.KeepGoing, "keep-going", "k", false, "")
+	pflag.IntVarP(&result.options.Jobs, "jobs", "j", 1, "")
 	pflag.BoolVar(&result.options.CheckAll, "check-all", false, "")
+	pflag.BoolVar(&result.options.Hermetic, "hermetic", false, "")
+	pflag.StringVar(&result.hashAlg, "hash", dag.HashAlgorithm(), "")
 	pflag.StringVarP(&result.scriptFile, "file", "f", "", "")
 	verbose := pflag.BoolP("verbose", "v", false, "")
 	quiet := pflag.BoolP("quiet", "q", false, "")
 	topics := pflag.String("debug", "", "")
+	sigmodes := pflag.String("signatures", "", "")
+	affected := pflag.String("affected-by", "", "")
+	pflag.StringVar(&result.gitRange, "affected-by-git", "", "")
+	pflag.BoolVar(&result.watch, "watch", false, "")
+	pflag.StringVar(&result.options.TraceFile, "trace", "", "")
+	pflag.StringVar(&result.eventSpec, "events", "", "")
+	pflag.BoolVar(&result.listAll, "all", false, "")
+	pflag.BoolVar(&result.listTree, "tree", false, "")
+	pflag.StringVar(&result.graphFormat, "format", "dot", "")
 	pflag.Parse()
 	if *topics != "" {
 		result.debugTopics = strings.Split(*topics, ",")
 	}
+	if *sigmodes != "" {
+		result.sigModes = strings.Split(*sigmodes, ",")
+	}
+	setflags := []string{}
+	pflag.Visit(func(flag *pflag.Flag) {
+		setflags = append(setflags, flag.Name)
+		// even an empty list means "only build affected targets"
+		if flag.Name == "affected-by" || flag.Name == "affected-by-git" {
+			result.options.AffectedBy = []string{}
+		}
+	})
+	if *affected != "" {
+		result.options.AffectedBy = strings.Split(*affected, ",")
+	}
 
 	// argh: really, we just want a callback for each occurence of -q
 	// or -v, which decrements or increments verbosity
@@ -103,10 +287,48 @@ func parseArgs() args {
 		result.verbosity = 1
 	}
 
-	result.options.Targets = pflag.Args()
+	result.command, result.options.Targets = splitCommand(pflag.Args())
+	err := checkCommandOptions(result.command, setflags)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "fubsy: error: "+err.Error())
+		os.Exit(2)
+	}
 	return result
 }
 
+// Split the non-option arguments into the subcommand (or "" if there
+// is none) and its arguments.
+func splitCommand(args []string) (string, []string) {
+	if len(args) > 0 && commands[args[0]] {
+		return args[0], args[1:]
+	}
+	return "", args
+}
+
+// Return an error if any of the options in setflags does not apply
+// to command, rather than silently ignoring it.
+func checkCommandOptions(command string, setflags []string) error {
+	if command == "" {
+		command = "build"
+	}
+	for _, name := range setflags {
+		owners, ok := commandOptions[name]
+		if !ok {
+			continue
+		}
+		allowed := false
+		for _, owner := range owners {
+			allowed = allowed || owner == command
+		}
+		if !allowed {
+			return fmt.Errorf(
+				"--%s can only be used with the '%s' command",
+				name, strings.Join(owners, "' or '"))
+		}
+	}
+	return nil
+}
+
 func findScript(script string) (string, error) {
 	if script != "" {
 		// user specified the script on the command line
@@ -134,6 +356,24 @@ func findScript(script string) (string, error) {
 		"main.fubsy not found (and no other *.fubsy files found)")
 }
 
+// Return the files changed in revrange, relative to the current
+// directory (i.e. relative to the build script).
+func gitChangedFiles(revrange string) ([]string, error) {
+	cmd := exec.Command("git", "diff", "--name-only", "--relative", revrange)
+	cmd.Stderr = os.Stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git diff %s: %s", revrange, err)
+	}
+	changed := []string{}
+	for _, line := range strings.Split(string(output), "\n") {
+		if line != "" {
+			changed = append(changed, line)
+		}
+	}
+	return changed, nil
+}
+
 func isFile(name string) bool {
 	fileinfo, err := os.Stat(name)
 	if err != nil {
@@ -68,3 +68,56 @@ func remove(name string) {
 		panic(err)
 	}
 }
+
+func Test_splitCommand(t *testing.T) {
+	command, targets := splitCommand([]string{})
+	assert.Equal(t, "", command)
+	assert.Equal(t, []string{}, targets)
+
+	command, targets = splitCommand([]string{"app", "graph"})
+	assert.Equal(t, "", command)
+	assert.Equal(t, []string{"app", "graph"}, targets)
+
+	command, targets = splitCommand([]string{"graph", "app"})
+	assert.Equal(t, "graph", command)
+	assert.Equal(t, []string{"app"}, targets)
+
+	// "build" lets the user build targets named like a command
+	command, targets = splitCommand([]string{"build", "log", "graph"})
+	assert.Equal(t, "build", command)
+	assert.Equal(t, []string{"log", "graph"}, targets)
+}
+
+func Test_checkCommandOptions(t *testing.T) {
+	assert.Nil(t, checkCommandOptions("", []string{"keep-going", "file"}))
+	assert.Nil(t, checkCommandOptions("targets", []string{"all", "tree"}))
+	assert.Nil(t, checkCommandOptions("graph", []string{"format"}))
+
+	err := checkCommandOptions("", []string{"keep-going", "all"})
+	assert.Equal(t,
+		"--all can only be used with the 'targets' command", err.Error())
+	err = checkCommandOptions("build", []string{"tree"})
+	assert.Equal(t,
+		"--tree can only be used with the 'targets' command", err.Error())
+	err = checkCommandOptions("targets", []string{"format"})
+	assert.Equal(t,
+		"--format can only be used with the 'graph' command", err.Error())
+
+	// build options don't apply to other commands, except those that
+	// decide whether targets are up to date
+	assert.Nil(t, checkCommandOptions("build", []string{"jobs", "watch"}))
+	assert.Nil(t, checkCommandOptions("targets", []string{"signatures"}))
+	for _, command := range []string{"targets", "graph", "query", "log"} {
+		err = checkCommandOptions(command, []string{"file", "jobs"})
+		assert.Equal(t,
+			"--jobs can only be used with the 'build' command", err.Error())
+		err = checkCommandOptions(command, []string{"affected-by-git"})
+		assert.Equal(t,
+			"--affected-by-git can only be used with the 'build' command",
+			err.Error())
+	}
+	err = checkCommandOptions("query", []string{"signatures"})
+	assert.Equal(t,
+		"--signatures can only be used with the 'build' or 'targets' command",
+		err.Error())
+}
@@ -5,12 +5,18 @@
 package runtime
 
 import (
-	//"fmt"
+	"bytes"
+	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"strings"
+	"syscall"
+	"time"
 
+	"fubsy/build"
 	"fubsy/dsl"
+	"fubsy/events"
 	"fubsy/log"
 	"fubsy/types"
 )
@@ -39,11 +45,10 @@ type SequenceAction struct {
 type CommandAction struct {
 	actionbase
 
-	// as read from the build script, without variables expanded
+	// as read from the build script, without variables expanded (the
+	// expanded command is local to each Execute(), since the same
+	// action can run for several targets at once)
 	raw types.FuObject
-
-	// with all variables expanded, ready to execute
-	expanded types.FuObject
 }
 
 // an action that evaluates an expression and assigns the result to a
@@ -117,12 +122,15 @@ func (self *CommandAction) String() string {
 func (self *CommandAction) Execute(rt *Runtime) []error {
 	//fmt.Println(self.raw)
 
-	var err error
-	self.expanded, err = self.raw.ActionExpand(rt.Namespace(), nil)
+	expanded, err := self.raw.ActionExpand(rt.Namespace(), nil)
 	if err != nil {
 		return []error{err}
 	}
-	log.Info("%s", self.expanded.ValueString())
+	command := expanded.ValueString()
+	log.Info("%s", command)
+	target := rt.currentTarget()
+	rt.events.Emit("action_start", events.Fields{
+		"target": target, "command": command})
 
 	// Run commands with the shell because people expect redirection,
 	// pipes, etc. to work from their build scripts. (And besides, all
@@ -133,22 +141,169 @@ func (self *CommandAction) Execute(rt *Runtime) []error {
 	// program being run.)
 	// XXX can we mitigate security risks of using the shell?
 	// XXX what about Windows?
-	// XXX for parallel builds: gather stdout and stderr, accumulate
-	// them in order but still distinguishing them, and dump them to
-	// our stdout/stderr when the command finishes
-	// XXX the error message doesn't say which command failed (and if
-	// it did, it would probably say "/bin/sh", which is useless): can
-	// we do better?
-	cmd := exec.Command("/bin/sh", "-c", self.expanded.ValueString())
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	err = cmd.Run()
+	// XXX for parallel builds: accumulate stdout and stderr in order
+	// (as we already do for the action log) but still distinguishing
+	// them, and dump them to our stdout/stderr when the command
+	// finishes
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Env = rt.actionEnvironment()
+	if rt.rule != nil && rt.rule.timeout > 0 {
+		// in its own process group, so a timeout kills everything the
+		// command started (not just the shell)
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	}
+	stdouts := []io.Writer{os.Stdout}
+	stderrs := []io.Writer{os.Stderr}
+	if rt.actionlog != nil {
+		fmt.Fprintf(rt.actionlog, "$ %s\n", command)
+		stdouts = append(stdouts, rt.actionlog)
+		stderrs = append(stderrs, rt.actionlog)
+	}
+	var stdout, stderr *outputEvents
+	if rt.events != nil {
+		stdout = &outputEvents{rt.events, target, "stdout", nil}
+		stderr = &outputEvents{rt.events, target, "stderr", nil}
+		stdouts = append(stdouts, stdout)
+		stderrs = append(stderrs, stderr)
+	}
+	cmd.Stdout = joinWriters(stdouts)
+	cmd.Stderr = joinWriters(stderrs)
+	var timeout time.Duration
+	if rt.rule != nil {
+		timeout = rt.rule.timeout
+	}
+	start := time.Now()
+	timedout := false
+	err = cmd.Start()
+	if err == nil {
+		timedout, err = waitTimeout(cmd, timeout)
+	}
+	var actionerr *build.ActionError
 	if err != nil {
-		return []error{err}
+		actionerr = rt.actionError(command, err)
+		if timedout {
+			actionerr.Timeout = timeout
+		}
+	}
+	if rt.events != nil {
+		stdout.flush()
+		stderr.flush()
+		fields := events.Fields{
+			"target":      target,
+			"command":     command,
+			"exit_status": 0,
+			"duration":    time.Since(start).Seconds(),
+		}
+		if actionerr != nil {
+			fields["exit_status"] = actionerr.ExitStatus
+			fields["error"] = err.Error()
+			if actionerr.Signal != 0 {
+				fields["signal"] = actionerr.Signal.String()
+			}
+			if timedout {
+				fields["timeout"] = timeout.Seconds()
+			}
+		}
+		rt.events.Emit("action_finish", fields)
+	}
+	if actionerr != nil {
+		return []error{actionerr}
 	}
 	return nil
 }
 
+// Wait for cmd (already started) to finish. If it runs longer than
+// timeout (and timeout is not 0), kill its whole process group and
+// return true (along with the error from Wait()).
+func waitTimeout(cmd *exec.Cmd, timeout time.Duration) (bool, error) {
+	if timeout <= 0 {
+		return false, cmd.Wait()
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return false, err
+	case <-timer.C:
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		return true, <-done
+	}
+}
+
+// Like io.MultiWriter, but avoid wrapping a single writer: if that
+// writer is an *os.File (e.g. our stdout), the child process can
+// write to it directly (and see that it's a terminal). When a rule
+// is saving an action log, there is always more than one writer, so
+// its commands write to a pipe: tools that only color their output
+// on a terminal (e.g. gcc) will not, unless forced to. That is the
+// price of having a log.
+func joinWriters(writers []io.Writer) io.Writer {
+	if len(writers) == 1 {
+		return writers[0]
+	}
+	return io.MultiWriter(writers...)
+}
+
+// Describe the failure of command, which returned err from Run(), in
+// the context of the build rule currently executing (if any).
+func (self *Runtime) actionError(command string, err error) *build.ActionError {
+	actionerr := &build.ActionError{Command: command, ExitStatus: -1, Err: err}
+	if exiterr, ok := err.(*exec.ExitError); ok {
+		status := exiterr.ProcessState.Sys().(syscall.WaitStatus)
+		if status.Exited() {
+			actionerr.ExitStatus = status.ExitStatus()
+		} else if status.Signaled() {
+			actionerr.Signal = status.Signal()
+		}
+	}
+	if self.rule != nil {
+		actionerr.Targets = self.rule.targets.Nodes()
+		actionerr.Location = self.rule.location
+	}
+	return actionerr
+}
+
+// A Writer that reports each line written to it as an
+// "action_output" event.
+type outputEvents struct {
+	stream *events.Stream
+	target string
+	name   string // "stdout" or "stderr"
+
+	// incomplete last line, waiting for more output
+	partial []byte
+}
+
+func (self *outputEvents) Write(data []byte) (int, error) {
+	self.partial = append(self.partial, data...)
+	for {
+		idx := bytes.IndexByte(self.partial, '\n')
+		if idx == -1 {
+			break
+		}
+		self.emit(self.partial[:idx])
+		self.partial = self.partial[idx+1:]
+	}
+	return len(data), nil
+}
+
+// report the last line of output, if it did not end with newline
+func (self *outputEvents) flush() {
+	if len(self.partial) > 0 {
+		self.emit(self.partial)
+		self.partial = nil
+	}
+}
+
+func (self *outputEvents) emit(line []byte) {
+	self.stream.Emit("action_output", events.Fields{
+		"target": self.target, "stream": self.name, "line": string(line)})
+}
+
 func (self *AssignmentAction) String() string {
 	return self.assignment.Target() + " = ..."
 	//return self.assignment.String()
@@ -168,6 +323,9 @@ func (self *FunctionCallAction) Execute(rt *Runtime) []error {
 		return errs
 	}
 	args, errs = rt.expandArgs(args)
+	if len(errs) > 0 {
+		return errs
+	}
 	_, errs = rt.evaluateCall(callable, args, logFunctionCall)
 	return errs
 }
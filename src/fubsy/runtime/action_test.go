@@ -5,11 +5,23 @@
 package runtime
 
 import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/stretchrcom/testify/assert"
 
+	"fubsy/build"
+	"fubsy/dag"
 	"fubsy/dsl"
+	"fubsy/events"
+	"fubsy/testutils"
+	"fubsy/types"
 )
 
 func Test_SequenceAction_create(t *testing.T) {
@@ -41,3 +53,152 @@ func Test_SequenceAction_create(t *testing.T) {
 		"ls -lR foo/bar",
 		action.subactions[0].(*CommandAction).raw.ValueString())
 }
+
+func Test_CommandAction_hermetic(t *testing.T) {
+	cleanup := testutils.Chtemp()
+	defer cleanup()
+
+	os.Setenv("FUBSY_TEST_DECLARED", "yes")
+	os.Setenv("FUBSY_TEST_RULE", "also")
+	os.Setenv("FUBSY_TEST_UNDECLARED", "leak")
+	defer os.Unsetenv("FUBSY_TEST_DECLARED")
+	defer os.Unsetenv("FUBSY_TEST_RULE")
+	defer os.Unsetenv("FUBSY_TEST_UNDECLARED")
+
+	// "set" is a shell builtin, so this works even though PATH is not
+	// declared (and Fubsy would expand $FUBSY_TEST_... itself)
+	action := NewCommandAction(types.MakeFuString("set > out.txt"))
+	rt := minimalRuntime()
+	rt.envvars = []string{"FUBSY_TEST_DECLARED", "FUBSY_TEST_UNSET"}
+	rt.ruleenv = []string{"FUBSY_TEST_RULE", "FUBSY_TEST_DECLARED"}
+
+	// by default, actions inherit the whole environment
+	errs := action.Execute(rt)
+	assert.Equal(t, 0, len(errs))
+	out := readFile("out.txt")
+	assert.True(t, strings.Contains(out, "FUBSY_TEST_DECLARED"))
+	assert.True(t, strings.Contains(out, "FUBSY_TEST_RULE"))
+	assert.True(t, strings.Contains(out, "FUBSY_TEST_UNDECLARED"))
+
+	rt.options.Hermetic = true
+	assert.Equal(t,
+		[]string{"FUBSY_TEST_DECLARED=yes", "FUBSY_TEST_RULE=also"},
+		rt.actionEnvironment())
+	errs = action.Execute(rt)
+	assert.Equal(t, 0, len(errs))
+	out = readFile("out.txt")
+	assert.True(t, strings.Contains(out, "FUBSY_TEST_DECLARED"))
+	assert.True(t, strings.Contains(out, "FUBSY_TEST_RULE"))
+	assert.False(t, strings.Contains(out, "FUBSY_TEST_UNDECLARED"))
+}
+
+func readFile(filename string) string {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		panic(err)
+	}
+	return string(data)
+}
+
+func Test_CommandAction_events(t *testing.T) {
+	cleanup := testutils.Chtemp()
+	defer cleanup()
+
+	// stdout and stderr are read concurrently, so only write to one
+	// of them
+	command := "echo hello > /dev/null; echo out; printf 'more\\nlast'; exit 3"
+	action := NewCommandAction(types.MakeFuString(command))
+	rt := minimalRuntime()
+	buf := &bytes.Buffer{}
+	rt.SetEvents(events.NewStream(buf))
+	rt.rule = NewBuildRule(rt, []dag.Node{dag.NewFileNode("foo")}, nil)
+	errs := action.Execute(rt)
+	assert.Equal(t, 1, len(errs))
+
+	actual := []map[string]interface{}{}
+	decoder := json.NewDecoder(buf)
+	for decoder.More() {
+		var event map[string]interface{}
+		err := decoder.Decode(&event)
+		assert.Nil(t, err)
+		delete(event, "time")
+		if event["event"] == "action_finish" {
+			assert.True(t, event["duration"].(float64) > 0)
+			delete(event, "duration")
+		}
+		actual = append(actual, event)
+	}
+	expect := []map[string]interface{}{
+		{"event": "action_start", "target": "foo", "command": command},
+		{"event": "action_output", "target": "foo",
+			"stream": "stdout", "line": "out"},
+		{"event": "action_output", "target": "foo",
+			"stream": "stdout", "line": "more"},
+		{"event": "action_output", "target": "foo",
+			"stream": "stdout", "line": "last"},
+		{"event": "action_finish", "target": "foo", "command": command,
+			"exit_status": float64(3), "error": "exit status 3"},
+	}
+	assert.Equal(t, expect, actual)
+}
+
+func Test_CommandAction_failure(t *testing.T) {
+	cleanup := testutils.Chtemp()
+	defer cleanup()
+
+	rt := parseScript(t, "test.fubsy",
+		"main {\n  \"foo\": \"foo.c\" {\n    \"exit 3\"\n  }\n}\n")
+	errs := rt.runMainPhase()
+	testutils.NoErrors(t, errs)
+	rule := rt.dag.Lookup("foo").BuildRule().(*BuildRule)
+	_, errs = rule.Execute()
+	assert.Equal(t, 1, len(errs))
+	actionerr := errs[0].(*build.ActionError)
+	assert.Equal(t, "exit 3", actionerr.Command)
+	assert.Equal(t, 3, actionerr.ExitStatus)
+	assert.Equal(t, syscall.Signal(0), actionerr.Signal)
+	assert.Equal(t, []dag.Node{rt.dag.Lookup("foo")}, actionerr.Targets)
+	assert.Equal(t, "test.fubsy:2-4: ", actionerr.Location.ErrorPrefix())
+	assert.Equal(t,
+		"test.fubsy:2-4: command exited with status 3: exit 3",
+		actionerr.Error())
+
+	// no build rule executing: no targets or location
+	action := NewCommandAction(types.MakeFuString("kill -TERM $$"))
+	errs = action.Execute(rt)
+	assert.Equal(t, 1, len(errs))
+	actionerr = errs[0].(*build.ActionError)
+	assert.Equal(t, -1, actionerr.ExitStatus)
+	assert.Equal(t, syscall.SIGTERM, actionerr.Signal)
+	assert.Equal(t, 0, len(actionerr.Targets))
+	assert.Nil(t, actionerr.Location)
+	assert.Equal(t,
+		"command killed by signal terminated: kill -TERM $$",
+		actionerr.Error())
+}
+
+func Test_CommandAction_timeout(t *testing.T) {
+	cleanup := testutils.Chtemp()
+	defer cleanup()
+
+	// the background sleep must die too, or we would wait for it to
+	// close stdout
+	rt := parseScript(t, "test.fubsy",
+		"main {\n  \"foo\": \"foo.c\" {\n"+
+			"    timeout = \"200ms\"\n"+
+			"    \"sleep 10 & sleep 10\"\n  }\n}\n")
+	errs := rt.runMainPhase()
+	testutils.NoErrors(t, errs)
+	rule := rt.dag.Lookup("foo").BuildRule().(*BuildRule)
+	start := time.Now()
+	_, errs = rule.Execute()
+	assert.True(t, time.Since(start) < 5*time.Second)
+	assert.Equal(t, 1, len(errs))
+	actionerr := errs[0].(*build.ActionError)
+	assert.Equal(t, 200*time.Millisecond, actionerr.Timeout)
+	assert.Equal(t, syscall.SIGKILL, actionerr.Signal)
+	assert.Equal(t,
+		"test.fubsy:2-5: command timed out after 200ms: "+
+			"sleep 10 & sleep 10",
+		actionerr.Error())
+}
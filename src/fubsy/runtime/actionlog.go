@@ -0,0 +1,108 @@
+// Copyright © 2013, Greg Ward. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE.txt file.
+
+package runtime
+
+// Action logs: everything printed by the commands that built each
+// target is saved in .fubsy/logs, so the user can look at it later
+// with "fubsy log TARGET" (e.g. to see the warnings from a compile
+// that scrolled away long ago).
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const logDir = ".fubsy/logs"
+
+// the log of one target, written to by the commands of the build
+// rule that builds it (stdout and stderr concurrently, hence the
+// lock)
+type actionLog struct {
+	lock sync.Mutex
+	file *os.File
+}
+
+// Return the name of the file that holds target's log. Every target
+// gets a flat filename in logDir, escaped so that no two targets
+// share a log (e.g. "a" and "a/b" cannot both be files) and no
+// target's log is a directory (e.g. "." or "..").
+func logFilename(target string) string {
+	name := url.QueryEscape(filepath.Clean(target))
+	if strings.HasPrefix(name, ".") {
+		name = "%2E" + name[1:]
+	}
+	return filepath.Join(logDir, name)
+}
+
+// Create (or truncate) the log file shared by targets: the first
+// target's log is written, and every other target's log is a hard
+// link to it.
+func openActionLog(targets []string) (*actionLog, error) {
+	err := os.MkdirAll(logDir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	filename := logFilename(targets[0])
+	file, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	for _, target := range targets[1:] {
+		link := logFilename(target)
+		err = os.Remove(link)
+		if err == nil || os.IsNotExist(err) {
+			err = os.Link(filename, link)
+		}
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return &actionLog{file: file}, nil
+}
+
+func (self *actionLog) Write(data []byte) (int, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.file.Write(data)
+}
+
+func (self *actionLog) Close() error {
+	return self.file.Close()
+}
+
+// Copy the saved action log of each of targets to writer (with a
+// header naming the target if there is more than one).
+func (self *Runtime) ShowLogs(writer io.Writer, targets []string) []error {
+	var errs []error
+	for i, target := range targets {
+		file, err := os.Open(logFilename(target))
+		if os.IsNotExist(err) {
+			errs = append(errs, fmt.Errorf(
+				"no log for target '%s' (has it been built?)", target))
+			continue
+		} else if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if len(targets) > 1 {
+			if i > 0 {
+				fmt.Fprintln(writer)
+			}
+			fmt.Fprintf(writer, "==> %s <==\n", target)
+		}
+		_, err = io.Copy(writer, file)
+		file.Close()
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
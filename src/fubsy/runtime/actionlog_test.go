@@ -0,0 +1,101 @@
+// Copyright © 2013, Greg Ward. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE.txt file.
+
+package runtime
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchrcom/testify/assert"
+
+	"fubsy/dag"
+	"fubsy/dsl"
+	"fubsy/testutils"
+)
+
+func Test_logFilename(t *testing.T) {
+	assert.Equal(t, ".fubsy/logs/foo.o", logFilename("foo.o"))
+	assert.Equal(t, ".fubsy/logs/obj%2Ffoo.o", logFilename("./obj//foo.o"))
+	assert.Equal(t, ".fubsy/logs/%2Ftmp%2Ffoo", logFilename("/tmp/foo"))
+	assert.Equal(t, ".fubsy/logs/%2E.%2Ffoo", logFilename("../foo"))
+	assert.Equal(t, ".fubsy/logs/%2E", logFilename("."))
+	assert.Equal(t, ".fubsy/logs/%2Efubsy", logFilename(".fubsy"))
+
+	// no target's log gets in the way of another's
+	assert.Equal(t, ".fubsy/logs/a", logFilename("a"))
+	assert.Equal(t, ".fubsy/logs/a%2Fb", logFilename("a/b"))
+	assert.Equal(t, ".fubsy/logs/a%252Fb", logFilename("a%2Fb"))
+}
+
+func Test_BuildRule_Execute_actionlog(t *testing.T) {
+	cleanup := testutils.Chtemp()
+	defer cleanup()
+
+	rt := minimalRuntime()
+	targets := []dag.Node{dag.NewFileNode("obj/foo.o")}
+	sources := []dag.Node{dag.NewFileNode("foo.c")}
+	rule := NewBuildRule(rt, targets, sources)
+	action := NewSequenceAction()
+	action.AddCommand(dsl.NewASTString("\"echo compiling $SOURCE\""))
+	action.AddCommand(dsl.NewASTString("\"echo warning >&2\""))
+	rule.action = action
+	_, errs := rule.Execute()
+	testutils.NoErrors(t, errs)
+	assert.Nil(t, rt.actionlog)
+
+	expect := "" +
+		"$ echo compiling foo.c\n" +
+		"compiling foo.c\n" +
+		"$ echo warning >&2\n" +
+		"warning\n"
+	assert.Equal(t, expect, readFile(".fubsy/logs/obj%2Ffoo.o"))
+
+	buf := &bytes.Buffer{}
+	errs = rt.ShowLogs(buf, []string{"obj/foo.o"})
+	testutils.NoErrors(t, errs)
+	assert.Equal(t, expect, buf.String())
+
+	// building again replaces the old log
+	action = NewSequenceAction()
+	action.AddCommand(dsl.NewASTString("\"true\""))
+	rule.action = action
+	_, errs = rule.Execute()
+	testutils.NoErrors(t, errs)
+	assert.Equal(t, "$ true\n", readFile(".fubsy/logs/obj%2Ffoo.o"))
+
+	testutils.TouchFiles(".fubsy/logs/bar")
+	buf.Reset()
+	errs = rt.ShowLogs(buf, []string{"./obj/foo.o", "bar", "baz"})
+	assert.Equal(t, 1, len(errs))
+	assert.Equal(t,
+		"no log for target 'baz' (has it been built?)", errs[0].Error())
+	assert.Equal(t, "==> ./obj/foo.o <==\n$ true\n\n==> bar <==\n", buf.String())
+}
+
+func Test_BuildRule_Execute_actionlog_targets(t *testing.T) {
+	cleanup := testutils.Chtemp()
+	defer cleanup()
+
+	// every target of a rule gets the log, including targets (like
+	// "a") that are directories of other targets (like "a/b")
+	rt := minimalRuntime()
+	targets := []dag.Node{
+		dag.NewFileNode("a/b"), dag.NewFileNode("a"), dag.NewFileNode("."),
+	}
+	sources := []dag.Node{dag.NewFileNode("foo.c")}
+	rule := NewBuildRule(rt, targets, sources)
+	action := NewSequenceAction()
+	action.AddCommand(dsl.NewASTString("\"echo hello\""))
+	rule.action = action
+	_, errs := rule.Execute()
+	testutils.NoErrors(t, errs)
+
+	for _, target := range []string{"a/b", "a", "."} {
+		buf := &bytes.Buffer{}
+		errs = rt.ShowLogs(buf, []string{target})
+		testutils.NoErrors(t, errs)
+		assert.Equal(t, "$ echo hello\nhello\n", buf.String())
+	}
+}
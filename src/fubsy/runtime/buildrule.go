@@ -7,8 +7,13 @@ package runtime
 import (
 	"errors"
 	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
 
 	"fubsy/dag"
+	"fubsy/dsl"
 	"fubsy/log"
 	"fubsy/types"
 )
@@ -20,6 +25,23 @@ type BuildRule struct {
 	action  Action
 	locals  types.ValueMap
 	attrs   types.ValueMap
+
+	// nodes that must be built before targets, but whose changes do
+	// not make targets stale (not included in $SOURCES)
+	orderonly []dag.Node
+
+	// where the rule was defined (nil if not defined by a build rule
+	// in the script, e.g. by build())
+	location dsl.Location
+
+	// kill any command that runs longer than this (0 for no limit)
+	timeout time.Duration
+
+	// run the rule again up to this many times if it fails
+	retries int
+
+	// name of the pool this rule belongs to ("" if none)
+	pool string
 }
 
 func NewBuildRule(runtime *Runtime, targets, sources []dag.Node) *BuildRule {
@@ -34,32 +56,280 @@ func NewBuildRule(runtime *Runtime, targets, sources []dag.Node) *BuildRule {
 	return rule
 }
 
+// Execute this rule's actions. In a parallel build, several rules
+// can execute at once, so this works on a copy of the runtime with
+// its own value stack and per-rule state (see Runtime.forRule()).
 func (self *BuildRule) Execute() ([]dag.Node, []error) {
-	stack := self.runtime.stack
 	locals := types.NewValueMap()
-	stack.Push(locals)
-	defer stack.Pop()
-
 	self.setLocals(locals)
+	rt := self.runtime.forRule(self, locals)
 	log.Debug(log.BUILD, "value stack:")
-	log.DebugDump(log.BUILD, stack)
-	err := self.action.Execute(self.runtime)
-	return self.targets.Nodes(), err
+	log.DebugDump(log.BUILD, rt.stack)
+
+	// every target gets the log of its commands' output
+	targets := self.targets.Nodes()
+	names := make([]string, len(targets))
+	for i, target := range targets {
+		names[i] = target.Name()
+	}
+	actionlog, logerr := openActionLog(names)
+	if logerr != nil {
+		log.Warning("cannot save action log: %s", logerr)
+	} else {
+		rt.actionlog = actionlog
+		defer actionlog.Close()
+	}
+	err := self.action.Execute(rt)
+	return targets, err
+}
+
+func (self *BuildRule) Retries() int {
+	return self.retries
+}
+
+func (self *BuildRule) Pool() string {
+	return self.pool
+}
+
+// Set one of the attributes that control how this rule is executed,
+// e.g. from 'timeout = "5m"' in the rule's body. "timeout" kills any
+// command that runs longer than that: either a number of seconds or
+// a Go duration like "90s". "retries" is how many times to run the
+// rule again if it fails. "pool" names the pool (declared by pool())
+// that limits how many rules like this one can run at once.
+func (self *BuildRule) setAttribute(name string, value types.FuObject) error {
+	svalue := value.ValueString()
+	switch name {
+	case "timeout":
+		timeout, err := parseTimeout(svalue)
+		if err != nil {
+			return err
+		}
+		self.timeout = timeout
+	case "retries":
+		retries, err := strconv.Atoi(svalue)
+		if err != nil || retries < 0 {
+			return fmt.Errorf(
+				"invalid retries '%s' (expected a non-negative integer)",
+				svalue)
+		}
+		self.retries = retries
+	case "pool":
+		if self.runtime.pools[svalue] == nil {
+			return fmt.Errorf(
+				"undefined pool '%s' (declare it with pool() first)", svalue)
+		}
+		self.pool = svalue
+	default:
+		return fmt.Errorf("unknown build rule attribute '%s'", name)
+	}
+	self.attrs[name] = value
+	return nil
+}
+
+func parseTimeout(value string) (time.Duration, error) {
+	var timeout time.Duration
+	seconds, err := strconv.Atoi(value)
+	if err == nil {
+		timeout = time.Duration(seconds) * time.Second
+	} else {
+		timeout, err = time.ParseDuration(value)
+	}
+	if err != nil || timeout < 0 {
+		return 0, fmt.Errorf(
+			"invalid timeout '%s' (expected a number of seconds, "+
+				"or a duration like \"90s\" or \"5m\")", value)
+	}
+	return timeout, nil
+}
+
+// true if name is assigned to set a rule attribute, rather than a
+// local variable, when it appears in a rule's body
+func isRuleAttribute(name string) bool {
+	return name == "timeout" || name == "retries" || name == "pool"
 }
 
 func (self *BuildRule) ActionString() string {
 	return self.action.String()
 }
 
+// Return the location in the build script where this rule was
+// defined, or nil if unknown.
+func (self *BuildRule) Location() dsl.Location {
+	return self.location
+}
+
 func (self *BuildRule) setLocals(ns types.Namespace) {
+	// value, environment, and tool nodes (e.g. an explicit dependency
+	// on CFLAGS, LANG, or gcc) are not inputs to the rule's actions,
+	// so keep them out of $SOURCES
+	sources := self.sources
+	inputs := make([]dag.Node, 0, len(sources.Nodes()))
+	for _, node := range sources.Nodes() {
+		switch node.(type) {
+		case *dag.ValueNode, *dag.EnvNode, *dag.ToolNode:
+		default:
+			inputs = append(inputs, node)
+		}
+	}
+	if len(inputs) < len(sources.Nodes()) {
+		sources = dag.ListNodeFromNodes(inputs)
+	}
+
 	ns.Assign("TARGETS", self.targets)
-	ns.Assign("SOURCES", self.sources)
+	ns.Assign("SOURCES", sources)
 
 	// these are really only meaningful for rules with one target or
 	// one source... but such rules are pretty common, so these are
 	// frequently handy
 	ns.Assign("TARGET", self.targets.Nodes()[0])
-	ns.Assign("SOURCE", self.sources.Nodes()[0])
+	if len(sources.Nodes()) > 0 {
+		ns.Assign("SOURCE", sources.Nodes()[0])
+	}
+}
+
+// Return the names of the environment variables that this rule
+// explicitly depends on (i.e. its EnvNode sources).
+func (self *BuildRule) envNames() []string {
+	names := []string{}
+	for _, node := range self.sources.Nodes() {
+		if envnode, ok := node.(*dag.EnvNode); ok {
+			names = append(names, envnode.Variable())
+		}
+	}
+	return names
+}
+
+// Return the programs run by this rule's command strings: the first
+// word of each command, after skipping any leading variable
+// assignments ("LANG=C sort ..."). Variable references in that word
+// are expanded using ns; a word that can't be expanded (e.g. because
+// it refers to $TARGET, which only exists while the rule is running)
+// is skipped. Shell builtins like cd are skipped too. The caller must
+// resolve the names to actual executables.
+func (self *BuildRule) toolNames(ns types.Namespace) []string {
+	seen := make(map[string]bool)
+	names := []string{}
+
+	var visit func(action Action)
+	visit = func(action_ Action) {
+		switch action := action_.(type) {
+		case *SequenceAction:
+			for _, sub := range action.subactions {
+				visit(sub)
+			}
+		case *CommandAction:
+			word := commandWord(action.raw.ValueString())
+			_, word, err := types.ExpandString(word, ns, nil)
+			if err != nil {
+				return
+			}
+			// the expanded value might be quoted, or several words
+			// (e.g. CC = "ccache gcc")
+			word = commandWord(strings.Trim(word, "'\""))
+			if word != "" && !shellBuiltins[word] && !seen[word] {
+				seen[word] = true
+				names = append(names, word)
+			}
+		}
+	}
+	if self.action != nil {
+		visit(self.action)
+	}
+	return names
+}
+
+// shell builtins and keywords that can start a command, and which
+// therefore do not name a program that we could depend on
+var shellBuiltins = map[string]bool{
+	".": true, ":": true, "[": true, "alias": true, "break": true,
+	"case": true, "cd": true, "continue": true, "echo": true,
+	"eval": true, "exec": true, "exit": true, "export": true,
+	"false": true, "for": true, "if": true, "printf": true,
+	"pwd": true, "read": true, "return": true, "set": true,
+	"shift": true, "test": true, "trap": true, "true": true,
+	"umask": true, "unset": true, "until": true, "wait": true,
+	"while": true,
+}
+
+// Return the first word of a shell command, ignoring leading variable
+// assignments. Stops at whitespace or any shell metacharacter that
+// could end a word.
+func commandWord(command string) string {
+	for {
+		command = strings.TrimLeft(command, " \t\n")
+		end := strings.IndexAny(command, " \t\n;&|<>()")
+		if end == -1 {
+			end = len(command)
+		}
+		word := command[:end]
+		eq := strings.Index(word, "=")
+		if eq <= 0 || strings.ContainsAny(word[:eq], "$/{") {
+			return word
+		}
+		command = command[end:]
+	}
+}
+
+// Return the names of all variables referenced by this rule's
+// command strings, except for those that are local to the rule:
+// $TARGET, $SOURCES, etc., and anything assigned by the rule's own
+// actions before the command that uses it.
+func (self *BuildRule) referencedNames() []string {
+	locals := map[string]bool{
+		"TARGET": true, "TARGETS": true, "SOURCE": true, "SOURCES": true}
+	seen := make(map[string]bool)
+	names := []string{}
+
+	var visit func(action Action)
+	visit = func(action_ Action) {
+		switch action := action_.(type) {
+		case *SequenceAction:
+			for _, sub := range action.subactions {
+				visit(sub)
+			}
+		case *AssignmentAction:
+			locals[action.assignment.Target()] = true
+		case *CommandAction:
+			recorder := &nameRecorder{}
+			types.ExpandString(action.raw.ValueString(), recorder, nil)
+			for _, name := range recorder.names {
+				if !locals[name] && !seen[name] {
+					seen[name] = true
+					names = append(names, name)
+				}
+			}
+		}
+	}
+	if self.action != nil {
+		visit(self.action)
+	}
+	return names
+}
+
+// A Namespace that records every name looked up in it, and claims
+// that every name is defined with no value: passing one to
+// types.ExpandString() reports every variable referenced by a string
+// without expanding any of them.
+type nameRecorder struct {
+	names []string
+}
+
+func (self *nameRecorder) Lookup(name string) (types.FuObject, bool) {
+	self.names = append(self.names, name)
+	return nil, true
+}
+
+func (self *nameRecorder) Assign(name string, value types.FuObject) {
+	panic("nameRecorder is read-only")
+}
+
+func (self *nameRecorder) ForEach(
+	callback func(name string, value types.FuObject) error) error {
+	return nil
+}
+
+func (self *nameRecorder) Dump(writer io.Writer, indent string) {
 }
 
 // Implement FuObject so we can expose BuildRules to the DSL
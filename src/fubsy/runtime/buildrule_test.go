@@ -10,6 +10,7 @@ import (
 	"github.com/stretchrcom/testify/assert"
 
 	"fubsy/dag"
+	"fubsy/dsl"
 	"fubsy/types"
 )
 
@@ -50,3 +51,78 @@ func Test_BuildRule_setLocals(t *testing.T) {
 	assert.Equal(t, 2, len(val.List()))
 	assert.Equal(t, `["bar", "qux"]`, val.String())
 }
+
+func Test_BuildRule_setLocals_value(t *testing.T) {
+	targets := []dag.Node{dag.NewStubNode("foo")}
+	sources := []dag.Node{
+		dag.NewValueNode("CFLAGS", nil),
+		dag.NewStubNode("bar"),
+		dag.NewStubNode("qux")}
+	ns := types.NewValueMap()
+	rule := NewBuildRule(nil, targets, sources)
+	rule.setLocals(ns)
+
+	// value nodes are not inputs, so they're not in $SOURCES
+	val, ok := ns.Lookup("SOURCES")
+	assert.True(t, ok)
+	assert.Equal(t, `["bar", "qux"]`, val.String())
+	val, ok = ns.Lookup("SOURCE")
+	assert.True(t, ok)
+	assert.Equal(t, "bar", val.ValueString())
+
+	// but they are still parents of the rule
+	assert.Equal(t, 3, len(rule.sources.Nodes()))
+}
+
+func Test_BuildRule_referencedNames(t *testing.T) {
+	action := NewSequenceAction()
+	action.AddCommand(dsl.NewASTString("\"cc $CFLAGS -o $TARGET $SOURCES\""))
+	action.AddAssignment(dsl.NewASTAssignment(
+		"tmp", dsl.NewASTString("\"foo\"")))
+	action.AddCommand(dsl.NewASTString("\"strip ${tmp} $TARGET $LDFLAGS $CFLAGS\""))
+	targets := []dag.Node{dag.NewStubNode("foo")}
+	rule := NewBuildRule(nil, targets, targets)
+	rule.action = action
+
+	assert.Equal(t, []string{"CFLAGS", "LDFLAGS"}, rule.referencedNames())
+}
+
+func Test_commandWord(t *testing.T) {
+	tests := []struct {
+		command string
+		word    string
+	}{
+		{"gcc -c foo.c", "gcc"},
+		{"  /usr/bin/gcc -c foo.c", "/usr/bin/gcc"},
+		{"$CC -c $SOURCE", "$CC"},
+		{"${CC} -c $SOURCE", "${CC}"},
+		{"LANG=C FOO=bar sort -u", "sort"},
+		{"./gen<in>out", "./gen"},
+		{"make;echo done", "make"},
+		{"a=b", ""},
+		{"", ""},
+	}
+	for _, test := range tests {
+		actual := commandWord(test.command)
+		if actual != test.word {
+			t.Errorf("commandWord(%#v): expected %#v, but got %#v",
+				test.command, test.word, actual)
+		}
+	}
+}
+
+func Test_BuildRule_toolNames(t *testing.T) {
+	action := NewSequenceAction()
+	action.AddCommand(dsl.NewASTString("\"$CC -c -o $TARGET $SOURCE\""))
+	action.AddCommand(dsl.NewASTString("\"cd foo && make\""))
+	action.AddCommand(dsl.NewASTString("\"$TARGET --selftest\""))
+	action.AddCommand(dsl.NewASTString("\"LANG=C ./gen\""))
+	action.AddCommand(dsl.NewASTString("\"ccache -s\""))
+	targets := []dag.Node{dag.NewStubNode("foo")}
+	rule := NewBuildRule(nil, targets, targets)
+	rule.action = action
+
+	ns := types.NewValueMap()
+	ns.Assign("CC", types.MakeFuString("ccache gcc"))
+	assert.Equal(t, []string{"ccache", "./gen"}, rule.toolNames(ns))
+}
@@ -9,7 +9,10 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strconv"
+	"strings"
 
+	"fubsy/build"
 	"fubsy/dag"
 	"fubsy/types"
 )
@@ -78,11 +81,27 @@ func defineBuiltins() BuiltinList {
 		types.NewVariadicFunction("println", 0, -1, fn_println),
 		types.NewVariadicFunction("mkdir", 0, -1, fn_mkdir),
 		types.NewVariadicFunction("remove", 0, -1, fn_remove),
+		types.NewVariadicFunction("copy", 2, -1, fn_copy),
+		types.NewVariadicFunction("move", 2, -1, fn_move),
+		types.NewVariadicFunction("touch", 0, -1, fn_touch),
+		types.NewFixedFunction("symlink", 2, fn_symlink),
+		types.NewVariadicFunction("chmod", 1, -1, fn_chmod),
+		types.NewFixedFunction("write_file", 2, fn_write_file),
+		types.NewVariadicFunction("tar", 1, -1, fn_tar),
+		types.NewVariadicFunction("zip", 1, -1, fn_zip),
 
 		types.NewFixedFunction("build", 3, fn_build),
+		types.NewVariadicFunction("buildenv", 1, -1, fn_buildenv),
+		types.NewVariadicFunction("shell", 1, -1, fn_shell),
+		types.NewFixedFunction("alias", 2, fn_alias),
+		types.NewFixedFunction("pool", 2, fn_pool),
 
 		// node factories
 		types.NewFixedFunction("FileNode", 1, fn_FileNode),
+		types.NewFixedFunction("DirNode", 1, fn_DirNode),
+		types.NewVariadicFunction("ValueNode", 1, 2, fn_ValueNode),
+		types.NewFixedFunction("EnvNode", 1, fn_EnvNode),
+		types.NewFixedFunction("ToolNode", 1, fn_ToolNode),
 		types.NewFixedFunction("ActionNode", 1, fn_ActionNode),
 	}
 	return BuiltinList{builtins}
@@ -155,16 +174,132 @@ func fn_build(argsource types.ArgSource) (types.FuObject, []error) {
 
 	rule := NewBuildRule(rt, targets, sources)
 	rule.action = action
+	for name, value := range argsource.KeywordArgs() {
+		err := rule.setAttribute(name, value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("build(): %s", err))
+		}
+	}
 
 	return rule, errs
 }
 
+// alias(name, nodes) makes name a phony target that builds nodes
+// (e.g. alias("test", testnodes) so users can run "fubsy test").
+// Calling it again with the same name adds more nodes to the alias.
+func fn_alias(argsource types.ArgSource) (types.FuObject, []error) {
+	rt := argsource.(RuntimeArgs).runtime
+	args := argsource.Args()
+	name := args[0].ValueString()
+	nodes := rt.nodify(args[1])
+	if len(nodes) == 0 {
+		return nil, []error{
+			fmt.Errorf("alias(): no nodes to alias as '%s'", name)}
+	}
+	alias, err := dag.MakeAliasNode(rt.dag, name)
+	if err != nil {
+		return nil, []error{fmt.Errorf("alias(): %s", err)}
+	}
+	rt.dag.AddManyParents([]dag.Node{alias}, nodes)
+	return alias, nil
+}
+
+// pool(name, capacity) declares a pool that lets at most capacity of
+// the build rules assigned to it (with 'pool = name') run at once,
+// e.g. pool("link", "2") to keep memory-hungry links from running
+// together.
+func fn_pool(argsource types.ArgSource) (types.FuObject, []error) {
+	rt := argsource.(RuntimeArgs).runtime
+	args := argsource.Args()
+	name := args[0].ValueString()
+	capacity, err := strconv.Atoi(args[1].ValueString())
+	if err != nil || capacity < 1 {
+		return nil, []error{fmt.Errorf(
+			"pool(): invalid capacity '%s' for pool '%s' "+
+				"(expected a positive integer)", args[1].ValueString(), name)}
+	}
+	if rt.pools[name] != nil {
+		return nil, []error{
+			fmt.Errorf("pool(): pool '%s' already declared", name)}
+	}
+	rt.pools[name] = build.NewPool(name, capacity)
+	return nil, nil
+}
+
+// buildenv(name, ...) declares environment variables that every
+// target in the build depends on (and, with --hermetic, the only ones
+// that actions see).
+func fn_buildenv(argsource types.ArgSource) (types.FuObject, []error) {
+	rt := argsource.(RuntimeArgs).runtime
+	for _, arg := range argsource.Args() {
+		rt.envvars = append(rt.envvars, arg.ValueString())
+	}
+	return nil, nil
+}
+
 func fn_FileNode(argsource types.ArgSource) (types.FuObject, []error) {
 	name := argsource.Args()[0].ValueString()
 	graph := argsource.(RuntimeArgs).Graph()
 	return dag.MakeFileNode(graph, name), nil
 }
 
+func fn_DirNode(argsource types.ArgSource) (types.FuObject, []error) {
+	name := argsource.Args()[0].ValueString()
+	graph := argsource.(RuntimeArgs).Graph()
+	node, err := dag.MakeDirNode(graph, name)
+	if err != nil {
+		return nil, []error{fmt.Errorf("DirNode(): %s", err)}
+	}
+	return node, nil
+}
+
+// ValueNode(name) tracks the value of variable 'name';
+// ValueNode(name, value) tracks an arbitrary value under that name.
+func fn_ValueNode(argsource types.ArgSource) (types.FuObject, []error) {
+	args := argsource.Args()
+	name := args[0].ValueString()
+	var value types.FuObject
+	if len(args) > 1 {
+		value = args[1]
+	}
+	graph := argsource.(RuntimeArgs).Graph()
+	node, err := dag.MakeValueNode(graph, name, value)
+	if err != nil {
+		return nil, []error{fmt.Errorf("ValueNode(): %s", err)}
+	}
+	return node, nil
+}
+
+func fn_EnvNode(argsource types.ArgSource) (types.FuObject, []error) {
+	name := argsource.Args()[0].ValueString()
+	graph := argsource.(RuntimeArgs).Graph()
+	node, err := dag.MakeEnvNode(graph, name)
+	if err != nil {
+		return nil, []error{fmt.Errorf("EnvNode(): %s", err)}
+	}
+	return node, nil
+}
+
+// ToolNode(name) declares that a rule runs program 'name', searching
+// PATH for it unless name includes a directory.
+func fn_ToolNode(argsource types.ArgSource) (types.FuObject, []error) {
+	name := argsource.Args()[0].ValueString()
+	filename := name
+	if !strings.Contains(name, "/") {
+		var err error
+		filename, err = lookPath(name)
+		if err != nil {
+			return nil, []error{err}
+		}
+	}
+	graph := argsource.(RuntimeArgs).Graph()
+	node, err := dag.MakeToolNode(graph, filename)
+	if err != nil {
+		return nil, []error{fmt.Errorf("ToolNode(): %s", err)}
+	}
+	return node, nil
+}
+
 func fn_ActionNode(argsource types.ArgSource) (types.FuObject, []error) {
 	basename := argsource.Args()[0].ValueString()
 	graph := argsource.(RuntimeArgs).Graph()
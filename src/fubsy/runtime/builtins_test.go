@@ -12,6 +12,7 @@ import (
 	"sort"
 	"syscall"
 	"testing"
+	"time"
 
 	"github.com/stretchrcom/testify/assert"
 
@@ -279,6 +280,21 @@ func Test_FileNode(t *testing.T) {
 	assert.True(t, node0 == node1)
 }
 
+func Test_DirNode(t *testing.T) {
+	args := RuntimeArgs{
+		BasicArgs: types.MakeBasicArgs(nil, types.MakeStringList("classes").List(), nil),
+		runtime:   minimalRuntime(),
+	}
+	node0, errs := fn_DirNode(args)
+	assert.Equal(t, 0, len(errs))
+
+	_ = node0.(*dag.DirNode)
+	assert.Equal(t, "classes", node0.(dag.Node).Name())
+
+	node1, errs := fn_DirNode(args)
+	assert.True(t, node0 == node1)
+}
+
 func Test_ActionNode(t *testing.T) {
 	args := RuntimeArgs{
 		BasicArgs: types.MakeBasicArgs(nil, types.MakeStringList("test/x").List(), nil),
@@ -294,3 +310,103 @@ func Test_ActionNode(t *testing.T) {
 	node1, errs := fn_ActionNode(args)
 	assert.True(t, node0 == node1)
 }
+
+func Test_alias(t *testing.T) {
+	rt := minimalRuntime()
+	makeArgs := func(name string, nodes ...string) RuntimeArgs {
+		args := []types.FuObject{
+			types.MakeFuString(name), types.MakeStringList(nodes...)}
+		return RuntimeArgs{
+			BasicArgs: types.MakeBasicArgs(nil, args, nil),
+			runtime:   rt,
+		}
+	}
+	parentNames := func(node types.FuObject) []string {
+		names := []string{}
+		for _, parent := range rt.dag.ParentNodes(node.(dag.Node)) {
+			names = append(names, parent.Name())
+		}
+		return names
+	}
+
+	alias0, errs := fn_alias(makeArgs("test", "a.test", "b.test"))
+	assert.Equal(t, 0, len(errs))
+	_ = alias0.(*dag.AliasNode)
+	assert.Equal(t, "test", alias0.(dag.Node).Name())
+	assert.Equal(t, []string{"a.test", "b.test"},
+		parentNames(alias0))
+
+	// same name: same node, more parents
+	alias1, errs := fn_alias(makeArgs("test", "c.test"))
+	assert.Equal(t, 0, len(errs))
+	assert.True(t, alias0 == alias1)
+	assert.Equal(t, []string{"a.test", "b.test", "c.test"},
+		parentNames(alias0))
+
+	// a string naming an alias refers to the alias, not a file
+	alias2, errs := fn_alias(makeArgs("check", "test", "lint.out"))
+	assert.Equal(t, 0, len(errs))
+	assert.True(t, rt.dag.ParentNodes(alias2.(dag.Node))[0] == alias0)
+
+	_, errs = fn_alias(makeArgs("empty"))
+	assert.Equal(t, 1, len(errs))
+	assert.Equal(t, "alias(): no nodes to alias as 'empty'", errs[0].Error())
+
+	// an alias cannot take over some other kind of node
+	_, errs = fn_alias(makeArgs("a.test", "c.test"))
+	assert.Equal(t, 1, len(errs))
+	assert.Equal(t,
+		"alias(): cannot create alias 'a.test': "+
+			"there is already a FileNode with that name",
+		errs[0].Error())
+}
+
+func Test_build_kwargs(t *testing.T) {
+	rt := minimalRuntime()
+	args := []types.FuObject{
+		types.MakeFuString("test.out"),
+		types.MakeFuString("test"),
+		types.MakeFuString("./test > $TARGET"),
+	}
+	kwargs := types.NewValueMap()
+	kwargs["timeout"] = types.MakeFuString("300")
+	kwargs["retries"] = types.MakeFuString("1")
+	argsource := RuntimeArgs{
+		BasicArgs: types.MakeBasicArgs(nil, args, kwargs),
+		runtime:   rt,
+	}
+	rule, errs := fn_build(argsource)
+	assert.Equal(t, 0, len(errs))
+	assert.Equal(t, 5*time.Minute, rule.(*BuildRule).timeout)
+	assert.Equal(t, 1, rule.(*BuildRule).Retries())
+
+	kwargs["retries"] = types.MakeFuString("-1")
+	kwargs["bogus"] = types.MakeFuString("x")
+	delete(kwargs, "timeout")
+	_, errs = fn_build(argsource)
+	assert.Equal(t, 2, len(errs))
+}
+
+func Test_pool(t *testing.T) {
+	rt := minimalRuntime()
+	makeArgs := func(name string, capacity string) RuntimeArgs {
+		args := []types.FuObject{
+			types.MakeFuString(name), types.MakeFuString(capacity)}
+		return RuntimeArgs{
+			BasicArgs: types.MakeBasicArgs(nil, args, nil),
+			runtime:   rt,
+		}
+	}
+
+	_, errs := fn_pool(makeArgs("link", "2"))
+	assert.Equal(t, 0, len(errs))
+	assert.Equal(t, 2, rt.pools["link"].Capacity())
+
+	_, errs = fn_pool(makeArgs("link", "3"))
+	assert.Equal(t, "pool(): pool 'link' already declared", errs[0].Error())
+	_, errs = fn_pool(makeArgs("test", "0"))
+	assert.Equal(t,
+		"pool(): invalid capacity '0' for pool 'test' "+
+			"(expected a positive integer)",
+		errs[0].Error())
+}
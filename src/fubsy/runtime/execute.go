@@ -7,6 +7,7 @@ package runtime
 import (
 	"fmt"
 
+	"fubsy/build"
 	"fubsy/dag"
 	"fubsy/dsl"
 	"fubsy/types"
@@ -19,13 +20,20 @@ import (
 // actions in the build phase.
 
 // node represents code like "NAME = EXPR": evaluate EXPR and store
-// the result in self's namespace
+// the result in self's namespace. In a parallel build, assignments in
+// a build rule always create a local variable of the rule, even if
+// there is a global with the same name: rules that run at the same
+// time must not change each other's variables.
 func (self *Runtime) assign(node *dsl.ASTAssignment) []error {
 	value, err := self.evaluate(node.Expression())
 	if err != nil {
 		return err
 	}
-	self.stack.Assign(node.Target(), value)
+	if self.rule != nil && self.options.Jobs > 1 {
+		self.stack.Inner().Assign(node.Target(), value)
+	} else {
+		self.stack.Assign(node.Target(), value)
+	}
 	return nil
 }
 
@@ -40,7 +48,11 @@ func (self *Runtime) evaluate(
 	case *dsl.ASTName:
 		result, errs = self.evaluateName(expr)
 	case *dsl.ASTFileFinder:
-		result = dag.NewFinderNode(expr.Patterns()...)
+		finder := dag.NewFinderNode(expr.Patterns()...)
+		if len(expr.Excludes()) > 0 {
+			finder = finder.Exclude(expr.Excludes()...)
+		}
+		result = finder
 	case *dsl.ASTAdd:
 		result, errs = self.evaluateAdd(expr)
 	case *dsl.ASTFunctionCall:
@@ -215,6 +227,14 @@ func MakeLocationError(loc dsl.Locatable, err error) error {
 	if _, ok := err.(LocationError); ok {
 		return err
 	}
+	// a failed command (e.g. from shell()) has room for the location
+	// in its own error object
+	if actionerr, ok := err.(*build.ActionError); ok {
+		if actionerr.Location == nil {
+			actionerr.Location = loc.Location()
+		}
+		return actionerr
+	}
 	return LocationError{loc.Location(), err}
 }
 
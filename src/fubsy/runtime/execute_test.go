@@ -35,6 +35,34 @@ func Test_assign(t *testing.T) {
 	assert.False(t, ok)
 }
 
+// in a build rule, assigning to a global changes it, except in a
+// parallel build, where it defines a local instead
+func Test_assign_rule(t *testing.T) {
+	node := dsl.NewASTAssignment("a", stringnode("bar"))
+	for _, jobs := range []int{1, 2} {
+		rt := minimalRuntime()
+		rt.options.Jobs = jobs
+		rt.Namespace().Assign("a", types.MakeFuString("foo"))
+		rule := NewBuildRule(rt, []dag.Node{dag.NewFileNode("x")}, nil)
+		locals := types.NewValueMap()
+		rulert := rt.forRule(rule, locals)
+
+		errs := rulert.assign(node)
+		assert.Equal(t, 0, len(errs))
+		value, _ := rulert.Lookup("a")
+		assert.Equal(t, "bar", value.ValueString())
+		global, _ := rt.Lookup("a")
+		local, _ := locals.Lookup("a")
+		if jobs == 1 {
+			assert.Equal(t, "bar", global.ValueString())
+			assert.Nil(t, local)
+		} else {
+			assert.Equal(t, "foo", global.ValueString())
+			assert.Equal(t, "bar", local.ValueString())
+		}
+	}
+}
+
 // evaluate simple expressions (no operators)
 func Test_evaluate_simple(t *testing.T) {
 	// the expression "meep" evaluates to the string "meep"
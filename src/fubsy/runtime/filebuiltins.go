@@ -0,0 +1,465 @@
+// Copyright © 2013, Greg Ward. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE.txt file.
+
+package runtime
+
+// Builtin functions that work on files: copy(), move(), touch(), and
+// friends. They do in-process what build scripts would otherwise do
+// by running cp, mv, touch, tar, etc., which is faster (no shell for
+// each of a thousand small files) and does not depend on what
+// programs are installed. Like mkdir() and remove(), they keep going
+// after an error and report every error they encounter. Any argument
+// may be a list (e.g. $SOURCES), which is treated as if each element
+// had been passed separately.
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"fubsy/types"
+)
+
+// copy(source, ..., dest) copies files (or whole directory trees)
+// like "cp -R": if there are several sources, or dest is a directory
+// (or ends with "/"), each source is copied into dest (which is
+// created if necessary); otherwise the single source is copied to
+// dest. File modes are preserved.
+func fn_copy(argsource types.ArgSource) (types.FuObject, []error) {
+	errs := make([]error, 0)
+	sources, dest, err := sourcesAndDest("copy", argsource.Args())
+	if err != nil {
+		return nil, append(errs, err)
+	}
+	for _, source := range sources {
+		err = copyTree(source, dest(source))
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return nil, errs
+}
+
+// move(source, ..., dest) renames files or directories like "mv",
+// with the same rules as copy() for where each source ends up.
+// Moving between filesystems copies the source and then removes it.
+func fn_move(argsource types.ArgSource) (types.FuObject, []error) {
+	errs := make([]error, 0)
+	sources, dest, err := sourcesAndDest("move", argsource.Args())
+	if err != nil {
+		return nil, append(errs, err)
+	}
+	for _, source := range sources {
+		err = moveFile(source, dest(source))
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return nil, errs
+}
+
+// touch(file, ...) creates each file (empty) if it does not exist,
+// and sets its modification time to now.
+func fn_touch(argsource types.ArgSource) (types.FuObject, []error) {
+	errs := make([]error, 0)
+	now := time.Now()
+	for _, name := range argNames(argsource.Args()) {
+		file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE, 0644)
+		if err == nil {
+			file.Close()
+			err = os.Chtimes(name, now, now)
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return nil, errs
+}
+
+// symlink(target, link) creates a symbolic link called link that
+// points to target, replacing link if it is already a symlink (like
+// "ln -sf").
+func fn_symlink(argsource types.ArgSource) (types.FuObject, []error) {
+	args := argsource.Args()
+	target := args[0].ValueString()
+	link := args[1].ValueString()
+	info, err := os.Lstat(link)
+	if err == nil && info.Mode()&os.ModeSymlink != 0 {
+		err = os.Remove(link)
+		if err != nil {
+			return nil, []error{err}
+		}
+	}
+	err = os.Symlink(target, link)
+	if err != nil {
+		return nil, []error{err}
+	}
+	return nil, nil
+}
+
+// chmod(mode, file, ...) changes the permissions of each file to
+// mode, an octal number like "755" or "2775" (setuid, setgid, and
+// sticky bits included).
+func fn_chmod(argsource types.ArgSource) (types.FuObject, []error) {
+	args := argsource.Args()
+	modestr := args[0].ValueString()
+	bits, err := strconv.ParseUint(modestr, 8, 32)
+	if err != nil || bits > 07777 {
+		return nil, []error{fmt.Errorf(
+			"chmod(): invalid mode '%s' (expected an octal number like 755)",
+			modestr)}
+	}
+	// os.FileMode keeps the special bits apart from the permissions
+	mode := os.FileMode(bits & 0777)
+	if bits&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if bits&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if bits&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	errs := make([]error, 0)
+	for _, name := range argNames(args[1:]) {
+		err = os.Chmod(name, mode)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return nil, errs
+}
+
+// write_file(filename, content) creates (or replaces) filename,
+// containing exactly content.
+func fn_write_file(argsource types.ArgSource) (types.FuObject, []error) {
+	args := argsource.Args()
+	err := ioutil.WriteFile(
+		args[0].ValueString(), []byte(args[1].ValueString()), 0644)
+	if err != nil {
+		return nil, []error{err}
+	}
+	return nil, nil
+}
+
+// tar(archive, file, ...) creates a tar archive containing each file
+// (and, for directories, everything in them). archive is compressed
+// with gzip if its name ends with ".tar.gz" or ".tgz".
+func fn_tar(argsource types.ArgSource) (types.FuObject, []error) {
+	args := argsource.Args()
+	archive := args[0].ValueString()
+	err := writeArchive(archive, argNames(args[1:]), newTarWriter)
+	if err != nil {
+		return nil, []error{err}
+	}
+	return nil, nil
+}
+
+// zip(archive, file, ...) creates a zip archive containing each file
+// (and, for directories, everything in them).
+func fn_zip(argsource types.ArgSource) (types.FuObject, []error) {
+	args := argsource.Args()
+	archive := args[0].ValueString()
+	err := writeArchive(archive, argNames(args[1:]), newZipWriter)
+	if err != nil {
+		return nil, []error{err}
+	}
+	return nil, nil
+}
+
+// Return the string value of every arg, expanding lists into their
+// elements.
+func argNames(args []types.FuObject) []string {
+	names := make([]string, 0, len(args))
+	for _, arg := range args {
+		for _, elem := range arg.List() {
+			names = append(names, elem.ValueString())
+		}
+	}
+	return names
+}
+
+// Split the args of copy() or move() into the list of sources and a
+// function that says where each source should go.
+func sourcesAndDest(fname string, args []types.FuObject) (
+	[]string, func(string) string, error) {
+	names := argNames(args)
+	if len(names) < 2 {
+		return nil, nil, fmt.Errorf(
+			"%s(): need at least one source and a destination", fname)
+	}
+	sources := names[:len(names)-1]
+	dest := names[len(names)-1]
+	info, err := os.Stat(dest)
+	intodir := len(sources) > 1 ||
+		strings.HasSuffix(dest, "/") ||
+		(err == nil && info.IsDir())
+	if !intodir {
+		return sources, func(string) string { return dest }, nil
+	}
+	err = os.MkdirAll(dest, 0755)
+	if err != nil {
+		return nil, nil, err
+	}
+	destfunc := func(source string) string {
+		return filepath.Join(dest, filepath.Base(source))
+	}
+	return sources, destfunc, nil
+}
+
+// Copy source, which may be a file, a symlink, or a directory tree,
+// to dest.
+func copyTree(source, dest string) error {
+	err := checkCopy(source, dest)
+	if err != nil {
+		return err
+	}
+	return filepath.Walk(source,
+		func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(source, path)
+			if err != nil {
+				return err
+			}
+			target := filepath.Join(dest, rel)
+			mode := info.Mode()
+			switch {
+			case mode.IsDir():
+				return os.MkdirAll(target, mode.Perm())
+			case mode&os.ModeSymlink != 0:
+				link, err := os.Readlink(path)
+				if err != nil {
+					return err
+				}
+				os.Remove(target)
+				return os.Symlink(link, target)
+			case mode.IsRegular():
+				return copyFile(path, target, mode.Perm())
+			}
+			return fmt.Errorf("copy(): cannot copy %s: not a regular file", path)
+		})
+}
+
+// Refuse to copy source onto itself, which would truncate it, or a
+// directory into itself, which would never finish (like cp does).
+func checkCopy(source, dest string) error {
+	sinfo, err := os.Stat(source)
+	if err != nil {
+		// let the caller report it (or copy a dangling symlink)
+		return nil
+	}
+	dinfo, err := os.Stat(dest)
+	if err == nil && os.SameFile(sinfo, dinfo) {
+		return fmt.Errorf("copy(): %s and %s are the same file", source, dest)
+	}
+	if !sinfo.IsDir() {
+		return nil
+	}
+	dir, err := filepath.Abs(dest)
+	if err != nil {
+		return err
+	}
+	for parent := filepath.Dir(dir); parent != dir; parent = filepath.Dir(dir) {
+		dir = parent
+		dinfo, err = os.Stat(dir)
+		if err == nil && os.SameFile(sinfo, dinfo) {
+			return fmt.Errorf(
+				"copy(): cannot copy directory %s into itself (%s)", source, dest)
+		}
+	}
+	return nil
+}
+
+func copyFile(source, dest string, mode os.FileMode) error {
+	infile, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer infile.Close()
+	outfile, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(outfile, infile)
+	if err != nil {
+		outfile.Close()
+		return err
+	}
+	err = outfile.Close()
+	if err != nil {
+		return err
+	}
+	// in case dest already existed, or the umask got in the way
+	return os.Chmod(dest, mode)
+}
+
+func moveFile(source, dest string) error {
+	err := os.Rename(source, dest)
+	if linkerr, ok := err.(*os.LinkError); ok && linkerr.Err == syscall.EXDEV {
+		err = copyTree(source, dest)
+		if err == nil {
+			err = os.RemoveAll(source)
+		}
+	}
+	return err
+}
+
+// the part of writing a tar or zip file that depends on the format
+type archiveWriter interface {
+	// add the file described by info to the archive as name
+	add(name string, path string, info os.FileInfo) error
+	Close() error
+}
+
+// Create archive with writer (newTarWriter or newZipWriter) and add
+// every file under each of names to it. On failure, the incomplete
+// archive is removed.
+func writeArchive(
+	archive string,
+	names []string,
+	newWriter func(filename string, file io.Writer) archiveWriter) error {
+	file, err := os.Create(archive)
+	if err != nil {
+		return err
+	}
+	writer := newWriter(archive, file)
+	for _, name := range names {
+		err = filepath.Walk(name,
+			func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				if filepath.Clean(path) == filepath.Clean(archive) {
+					return nil // don't archive the archive
+				}
+				return writer.add(filepath.ToSlash(path), path, info)
+			})
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = writer.Close()
+	}
+	if err == nil {
+		err = file.Close()
+	} else {
+		file.Close()
+	}
+	if err != nil {
+		os.Remove(archive)
+	}
+	return err
+}
+
+type tarWriter struct {
+	writer *tar.Writer
+	gzip   *gzip.Writer // nil if not compressing
+}
+
+func newTarWriter(filename string, file io.Writer) archiveWriter {
+	self := &tarWriter{}
+	if strings.HasSuffix(filename, ".tar.gz") ||
+		strings.HasSuffix(filename, ".tgz") {
+		self.gzip = gzip.NewWriter(file)
+		file = self.gzip
+	}
+	self.writer = tar.NewWriter(file)
+	return self
+}
+
+func (self *tarWriter) add(name string, path string, info os.FileInfo) error {
+	link := ""
+	if info.Mode()&os.ModeSymlink != 0 {
+		var err error
+		link, err = os.Readlink(path)
+		if err != nil {
+			return err
+		}
+	}
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	if info.IsDir() {
+		header.Name += "/"
+	}
+	err = self.writer.WriteHeader(header)
+	if err != nil || !info.Mode().IsRegular() {
+		return err
+	}
+	return copyInto(self.writer, path)
+}
+
+func (self *tarWriter) Close() error {
+	err := self.writer.Close()
+	if err == nil && self.gzip != nil {
+		err = self.gzip.Close()
+	}
+	return err
+}
+
+type zipWriter struct {
+	writer *zip.Writer
+}
+
+func newZipWriter(filename string, file io.Writer) archiveWriter {
+	return &zipWriter{zip.NewWriter(file)}
+}
+
+func (self *zipWriter) add(name string, path string, info os.FileInfo) error {
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	if info.IsDir() {
+		header.Name += "/"
+	} else {
+		header.Method = zip.Deflate
+	}
+	out, err := self.writer.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		// zip stores a symlink as a file containing its target
+		link, err := os.Readlink(path)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(out, link)
+		return err
+	} else if info.Mode().IsRegular() {
+		return copyInto(out, path)
+	}
+	return nil
+}
+
+func (self *zipWriter) Close() error {
+	return self.writer.Close()
+}
+
+// Copy the contents of the file at path to writer.
+func copyInto(writer io.Writer, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(writer, file)
+	return err
+}
@@ -0,0 +1,324 @@
+// Copyright © 2013, Greg Ward. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE.txt file.
+
+package runtime
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchrcom/testify/assert"
+
+	"fubsy/testutils"
+	"fubsy/types"
+)
+
+func fileArgs(names ...string) RuntimeArgs {
+	return RuntimeArgs{
+		BasicArgs: types.MakeBasicArgs(
+			nil, types.MakeStringList(names...).List(), nil),
+	}
+}
+
+func Test_copy(t *testing.T) {
+	cleanup := testutils.Chtemp()
+	defer cleanup()
+
+	testutils.Mkdirs("src/sub")
+	writeFile("src/a.txt", "a\n", 0600)
+	writeFile("src/sub/b.sh", "b\n", 0755)
+
+	// single file to a new name
+	_, errs := fn_copy(fileArgs("src/a.txt", "a.bak"))
+	testutils.NoErrors(t, errs)
+	assert.Equal(t, "a\n", readFile("a.bak"))
+	assert.Equal(t, os.FileMode(0600), fileMode("a.bak"))
+
+	// several sources, including a directory tree: into dest
+	_, errs = fn_copy(fileArgs("src/a.txt", "src/sub", "dist"))
+	testutils.NoErrors(t, errs)
+	assert.Equal(t, []string{"a.txt", "sub"}, dirContents("dist"))
+	assert.Equal(t, "b\n", readFile("dist/sub/b.sh"))
+	assert.Equal(t, os.FileMode(0755), fileMode("dist/sub/b.sh"))
+
+	// one source into an existing directory; a list counts as
+	// several args
+	args := RuntimeArgs{BasicArgs: types.MakeBasicArgs(nil, []types.FuObject{
+		types.MakeStringList("src/sub/b.sh"),
+		types.MakeFuString("src")}, nil)}
+	_, errs = fn_copy(args)
+	testutils.NoErrors(t, errs)
+	assert.Equal(t, []string{"a.txt", "b.sh", "sub"}, dirContents("src"))
+
+	// keep going after errors
+	_, errs = fn_copy(fileArgs("bogus", "src/a.txt", "bogus2", "out/"))
+	assert.Equal(t, 2, len(errs))
+	assert.Equal(t, "lstat bogus: no such file or directory", errs[0].Error())
+	assert.Equal(t, []string{"a.txt"}, dirContents("out"))
+
+	// refuse to copy a file onto itself or a directory into itself
+	_, errs = fn_copy(fileArgs("src/a.txt", "src"))
+	assert.Equal(t,
+		"copy(): src/a.txt and src/a.txt are the same file", errs[0].Error())
+	assert.Equal(t, "a\n", readFile("src/a.txt"))
+	_, errs = fn_copy(fileArgs("src", "src/sub/new"))
+	assert.Equal(t,
+		"copy(): cannot copy directory src into itself (src/sub/new)",
+		errs[0].Error())
+	_, errs = fn_copy(fileArgs("src", "src/sub/"))
+	assert.Equal(t, 1, len(errs))
+	assert.Equal(t, []string{"b.sh"}, dirContents("src/sub"))
+
+	args = RuntimeArgs{BasicArgs: types.MakeBasicArgs(nil, []types.FuObject{
+		types.MakeStringList(), types.MakeFuString("out")}, nil)}
+	_, errs = fn_copy(args)
+	assert.Equal(t,
+		"copy(): need at least one source and a destination",
+		errs[0].Error())
+}
+
+func Test_move(t *testing.T) {
+	cleanup := testutils.Chtemp()
+	defer cleanup()
+
+	testutils.TouchFiles("a", "b", "c/d")
+	_, errs := fn_move(fileArgs("a", "a2"))
+	testutils.NoErrors(t, errs)
+	_, errs = fn_move(fileArgs("b", "c", "e"))
+	testutils.NoErrors(t, errs)
+	assert.Equal(t, []string{"a2", "e"}, dirContents("."))
+	assert.Equal(t, []string{"b", "c"}, dirContents("e"))
+	assert.Equal(t, []string{"d"}, dirContents("e/c"))
+
+	_, errs = fn_move(fileArgs("bogus", "x"))
+	assert.Equal(t, 1, len(errs))
+}
+
+func Test_touch(t *testing.T) {
+	cleanup := testutils.Chtemp()
+	defer cleanup()
+
+	writeFile("old", "data", 0644)
+	past := time.Now().Add(-time.Hour)
+	os.Chtimes("old", past, past)
+
+	_, errs := fn_touch(fileArgs("old", "new", "bogus/new"))
+	assert.Equal(t, 1, len(errs))
+	assert.Equal(t, "data", readFile("old"))
+	assert.Equal(t, "", readFile("new"))
+	info, err := os.Stat("old")
+	assert.Nil(t, err)
+	assert.True(t, info.ModTime().After(past.Add(time.Minute)))
+}
+
+func Test_symlink(t *testing.T) {
+	cleanup := testutils.Chtemp()
+	defer cleanup()
+
+	_, errs := fn_symlink(fileArgs("libfoo.so.1", "libfoo.so"))
+	testutils.NoErrors(t, errs)
+	_, errs = fn_symlink(fileArgs("libfoo.so.2", "libfoo.so"))
+	testutils.NoErrors(t, errs)
+	link, err := os.Readlink("libfoo.so")
+	assert.Nil(t, err)
+	assert.Equal(t, "libfoo.so.2", link)
+
+	// won't replace a real file
+	testutils.TouchFiles("real")
+	_, errs = fn_symlink(fileArgs("libfoo.so.2", "real"))
+	assert.Equal(t, 1, len(errs))
+}
+
+func Test_chmod(t *testing.T) {
+	cleanup := testutils.Chtemp()
+	defer cleanup()
+
+	testutils.TouchFiles("a", "b")
+	_, errs := fn_chmod(fileArgs("750", "a", "b", "c"))
+	assert.Equal(t, 1, len(errs))
+	assert.Equal(t, os.FileMode(0750), fileMode("a"))
+	assert.Equal(t, os.FileMode(0750), fileMode("b"))
+
+	// the setuid, setgid, and sticky bits are not just dropped
+	testutils.Mkdirs("tmp")
+	_, errs = fn_chmod(fileArgs("4750", "a"))
+	testutils.NoErrors(t, errs)
+	_, errs = fn_chmod(fileArgs("3775", "tmp"))
+	testutils.NoErrors(t, errs)
+	info, err := os.Stat("a")
+	assert.Nil(t, err)
+	assert.Equal(t, os.ModeSetuid|0750, info.Mode())
+	info, err = os.Stat("tmp")
+	assert.Nil(t, err)
+	assert.Equal(t, os.ModeDir|os.ModeSetgid|os.ModeSticky|0775, info.Mode())
+
+	_, errs = fn_chmod(fileArgs("u+x", "a"))
+	assert.Equal(t,
+		"chmod(): invalid mode 'u+x' (expected an octal number like 755)",
+		errs[0].Error())
+}
+
+func Test_write_file(t *testing.T) {
+	cleanup := testutils.Chtemp()
+	defer cleanup()
+
+	_, errs := fn_write_file(fileArgs("version.h", "#define VERSION 3\n"))
+	testutils.NoErrors(t, errs)
+	assert.Equal(t, "#define VERSION 3\n", readFile("version.h"))
+
+	_, errs = fn_write_file(fileArgs("bogus/version.h", ""))
+	assert.Equal(t, 1, len(errs))
+}
+
+func Test_tar(t *testing.T) {
+	cleanup := testutils.Chtemp()
+	defer cleanup()
+
+	testutils.Mkdirs("dist/bin")
+	writeFile("dist/bin/app", "app", 0755)
+	writeFile("README", "readme", 0644)
+	os.Symlink("bin/app", "dist/app")
+
+	for _, archive := range []string{"dist.tar", "dist.tar.gz"} {
+		_, errs := fn_tar(fileArgs(archive, "README", "dist"))
+		testutils.NoErrors(t, errs)
+
+		file, err := os.Open(archive)
+		assert.Nil(t, err)
+		var reader io.Reader = file
+		if archive == "dist.tar.gz" {
+			reader, err = gzip.NewReader(file)
+			assert.Nil(t, err)
+		}
+		treader := tar.NewReader(reader)
+		names := []string{}
+		contents := map[string]string{}
+		for {
+			header, err := treader.Next()
+			if err == io.EOF {
+				break
+			}
+			assert.Nil(t, err)
+			names = append(names, header.Name)
+			data, _ := ioutil.ReadAll(treader)
+			contents[header.Name] = string(data)
+			if header.Name == "dist/app" {
+				assert.Equal(t, "bin/app", header.Linkname)
+			}
+		}
+		file.Close()
+		assert.Equal(t,
+			[]string{"README", "dist/", "dist/app", "dist/bin/", "dist/bin/app"},
+			names)
+		assert.Equal(t, "app", contents["dist/bin/app"])
+	}
+
+	// a failed archive is not left behind
+	_, errs := fn_tar(fileArgs("bad.tar", "README", "bogus"))
+	assert.Equal(t, 1, len(errs))
+	_, err := os.Stat("bad.tar")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func Test_zip(t *testing.T) {
+	cleanup := testutils.Chtemp()
+	defer cleanup()
+
+	testutils.Mkdirs("dist/bin")
+	writeFile("dist/bin/app", "app", 0755)
+
+	// the archive is not added to itself
+	_, errs := fn_zip(fileArgs("dist/dist.zip", "dist"))
+	testutils.NoErrors(t, errs)
+
+	reader, err := zip.OpenReader("dist/dist.zip")
+	assert.Nil(t, err)
+	defer reader.Close()
+	names := []string{}
+	for _, file := range reader.File {
+		names = append(names, file.Name)
+		if file.Name == "dist/bin/app" {
+			assert.Equal(t, os.FileMode(0755), file.Mode().Perm())
+			rc, err := file.Open()
+			assert.Nil(t, err)
+			data, _ := ioutil.ReadAll(rc)
+			rc.Close()
+			assert.Equal(t, "app", string(data))
+		}
+	}
+	sort.Strings(names)
+	assert.Equal(t, []string{"dist/", "dist/bin/", "dist/bin/app"}, names)
+}
+
+// file builtins are most useful as actions in build rules
+func Test_copy_action(t *testing.T) {
+	cleanup := testutils.Chtemp()
+	defer cleanup()
+
+	rt := parseScript(t, "test.fubsy", ""+
+		"main {\n"+
+		"  \"dist/app.conf\": \"app.conf\" {\n"+
+		"    mkdir(\"dist\")\n"+
+		"    copy(SOURCE, \"$TARGET.new\")\n"+
+		"    move(\"$TARGET.new\", TARGET)\n"+
+		"  }\n"+
+		"}\n")
+	errs := rt.runMainPhase()
+	testutils.NoErrors(t, errs)
+	writeFile("app.conf", "debug = 1\n", 0644)
+
+	rule := rt.dag.Lookup("dist/app.conf").BuildRule().(*BuildRule)
+	_, errs = rule.Execute()
+	testutils.NoErrors(t, errs)
+	assert.Equal(t, "debug = 1\n", readFile("dist/app.conf"))
+	assert.Equal(t, []string{"app.conf"}, dirContents("dist"))
+}
+
+// errors expanding the arguments are reported, not passed on as nil
+func Test_FunctionCallAction_expand_error(t *testing.T) {
+	cleanup := testutils.Chtemp()
+	defer cleanup()
+
+	rt := parseScript(t, "test.fubsy", ""+
+		"main {\n"+
+		"  \"dist/app.conf\": \"app.conf\" {\n"+
+		"    copy(\"$nosuch\", \"dist/\")\n"+
+		"  }\n"+
+		"}\n")
+	errs := rt.runMainPhase()
+	testutils.NoErrors(t, errs)
+
+	rule := rt.dag.Lookup("dist/app.conf").BuildRule().(*BuildRule)
+	_, errs = rule.Execute()
+	assert.Equal(t, 1, len(errs))
+	assert.Equal(t, "undefined variable 'nosuch' in string", errs[0].Error())
+	_, err := os.Stat("dist")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func writeFile(name string, content string, mode os.FileMode) {
+	err := ioutil.WriteFile(name, []byte(content), mode)
+	if err != nil {
+		panic(err)
+	}
+	err = os.Chmod(name, mode)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func fileMode(name string) os.FileMode {
+	info, err := os.Stat(name)
+	if err != nil {
+		panic(err)
+	}
+	return info.Mode().Perm()
+}
@@ -0,0 +1,153 @@
+// Copyright © 2013, Greg Ward. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE.txt file.
+
+package runtime
+
+// Implementation of "fubsy graph": export the dependency graph for
+// other tools (Graphviz, code review, homegrown scripts) to consume.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"fubsy/dag"
+)
+
+// formats supported by WriteGraph()
+var graphFormats = map[string]func(io.Writer, []graphNode, []graphEdge) error{
+	"dot":  writeDOT,
+	"json": writeJSON,
+}
+
+// one node in the exported graph
+type graphNode struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	State    string `json:"state"`
+	Rule     string `json:"rule,omitempty"`
+	Action   string `json:"action,omitempty"`
+	isSource bool
+}
+
+// one edge in the exported graph, from a parent to its child
+type graphEdge struct {
+	From      string `json:"from"`
+	To        string `json:"to"`
+	OrderOnly bool   `json:"orderonly,omitempty"`
+}
+
+// Run the build script up to the end of the main phase and write the
+// expanded dependency graph to writer in the specified format ("dot"
+// or "json"). Only the targets requested by the user (default: all
+// final targets) and their ancestors are included.
+func (self *Runtime) WriteGraph(writer io.Writer, format string) []error {
+	write, ok := graphFormats[format]
+	if !ok {
+		return []error{fmt.Errorf(
+			"unknown graph format '%s' (must be one of: dot, json)", format)}
+	}
+	errs := self.loadGraph()
+	if len(errs) > 0 {
+		return errs
+	}
+	nodes, edges, errs := self.exportGraph()
+	if len(errs) > 0 {
+		return errs
+	}
+	err := write(writer, nodes, edges)
+	if err != nil {
+		return []error{err}
+	}
+	return nil
+}
+
+// Walk the ancestors of the requested targets and convert them to a
+// list of nodes (in topological order) and edges.
+func (self *Runtime) exportGraph() ([]graphNode, []graphEdge, []error) {
+	goal, errs := self.dag.MatchTargets(self.options.Targets)
+	if len(errs) > 0 {
+		return nil, nil, errs
+	}
+
+	nodes := []graphNode{}
+	edges := []graphEdge{}
+	visit := func(node dag.Node) error {
+		gnode := graphNode{
+			Name:     node.Name(),
+			Type:     node.Typename(),
+			State:    node.State().String(),
+			Rule:     ruleLocation(node),
+			isSource: node.State() == dag.SOURCE,
+		}
+		if node.BuildRule() != nil {
+			gnode.Action = node.BuildRule().ActionString()
+		}
+		nodes = append(nodes, gnode)
+		for _, parent := range self.dag.ParentNodes(node) {
+			edges = append(edges, graphEdge{
+				From:      parent.Name(),
+				To:        node.Name(),
+				OrderOnly: self.dag.IsOrderOnly(node, parent),
+			})
+		}
+		return nil
+	}
+	err := self.dag.DFS(goal, visit)
+	if err != nil {
+		return nil, nil, []error{err}
+	}
+	return nodes, edges, nil
+}
+
+func writeDOT(writer io.Writer, nodes []graphNode, edges []graphEdge) error {
+	lines := []string{"digraph fubsy {"}
+	for _, node := range nodes {
+		attrs := []string{
+			"label=" + dotQuote(node.Name),
+			"type=" + dotQuote(node.Type),
+			"state=" + dotQuote(node.State),
+		}
+		if node.Rule != "" {
+			attrs = append(attrs, "rule="+dotQuote(node.Rule))
+		}
+		if node.isSource {
+			attrs = append(attrs, "shape=box")
+		}
+		lines = append(lines, fmt.Sprintf("    %s [%s];",
+			dotQuote(node.Name), strings.Join(attrs, ", ")))
+	}
+	for _, edge := range edges {
+		attrs := ""
+		if edge.OrderOnly {
+			attrs = " [style=dashed]"
+		}
+		lines = append(lines, fmt.Sprintf("    %s -> %s%s;",
+			dotQuote(edge.From), dotQuote(edge.To), attrs))
+	}
+	lines = append(lines, "}\n")
+	_, err := io.WriteString(writer, strings.Join(lines, "\n"))
+	return err
+}
+
+// quote s as a DOT identifier
+func dotQuote(s string) string {
+	s = strings.Replace(s, "\\", "\\\\", -1)
+	s = strings.Replace(s, "\"", "\\\"", -1)
+	return "\"" + s + "\""
+}
+
+func writeJSON(writer io.Writer, nodes []graphNode, edges []graphEdge) error {
+	graph := struct {
+		Nodes []graphNode `json:"nodes"`
+		Edges []graphEdge `json:"edges"`
+	}{nodes, edges}
+	data, err := json.MarshalIndent(graph, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(append(data, '\n'))
+	return err
+}
@@ -0,0 +1,95 @@
+// Copyright © 2013, Greg Ward. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE.txt file.
+
+package runtime
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchrcom/testify/assert"
+)
+
+func graphRuntime(t *testing.T) *Runtime {
+	script := "" +
+		"main {\n" +
+		"  \"obj/a.o\": \"a.c\" | DirNode(\"obj\") {\n" +
+		"    \"./compile $SOURCE\"\n" +
+		"  }\n" +
+		"  \"doc.html\": \"doc.txt\" {\n" +
+		"    \"./format $SOURCE\"\n" +
+		"  }\n" +
+		"}\n"
+	rt := parseScript(t, "test.fubsy", script)
+	errs := rt.runMainPhase()
+	assert.Equal(t, 0, len(errs))
+	errs = rt.finishGraph()
+	assert.Equal(t, 0, len(errs))
+	return rt
+}
+
+func Test_Runtime_exportGraph_dot(t *testing.T) {
+	rt := graphRuntime(t)
+	rt.options.Targets = []string{"obj/a.o"}
+	nodes, edges, errs := rt.exportGraph()
+	assert.Equal(t, 0, len(errs))
+
+	var buf bytes.Buffer
+	err := writeDOT(&buf, nodes, edges)
+	assert.Nil(t, err)
+	expect := `digraph fubsy {
+    "obj" [label="obj", type="DirNode", state="SOURCE", shape=box];
+    "a.c" [label="a.c", type="FileNode", state="SOURCE", shape=box];
+    "obj/a.o" [label="obj/a.o", type="FileNode", state="UNKNOWN", rule="test.fubsy:2-4"];
+    "obj" -> "obj/a.o" [style=dashed];
+    "a.c" -> "obj/a.o";
+}
+`
+	assert.Equal(t, expect, buf.String())
+}
+
+func Test_Runtime_exportGraph_json(t *testing.T) {
+	rt := graphRuntime(t)
+	rt.options.Targets = []string{"doc.html"}
+	nodes, edges, errs := rt.exportGraph()
+	assert.Equal(t, 0, len(errs))
+
+	var buf bytes.Buffer
+	err := writeJSON(&buf, nodes, edges)
+	assert.Nil(t, err)
+	expect := `{
+  "nodes": [
+    {
+      "name": "doc.txt",
+      "type": "FileNode",
+      "state": "SOURCE"
+    },
+    {
+      "name": "doc.html",
+      "type": "FileNode",
+      "state": "UNKNOWN",
+      "rule": "test.fubsy:5-7",
+      "action": "\"./format $SOURCE\""
+    }
+  ],
+  "edges": [
+    {
+      "from": "doc.txt",
+      "to": "doc.html"
+    }
+  ]
+}
+`
+	assert.Equal(t, expect, buf.String())
+}
+
+func Test_Runtime_WriteGraph_badformat(t *testing.T) {
+	rt := graphRuntime(t)
+	var buf bytes.Buffer
+	errs := rt.WriteGraph(&buf, "svg")
+	assert.Equal(t, 1, len(errs))
+	assert.Equal(t,
+		"unknown graph format 'svg' (must be one of: dot, json)",
+		errs[0].Error())
+}
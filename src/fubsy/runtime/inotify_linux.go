@@ -0,0 +1,108 @@
+// Copyright © 2013, Greg Ward. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE.txt file.
+
+// +build linux
+
+package runtime
+
+// Implementation of watcher using Linux's inotify API.
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"fubsy/log"
+)
+
+const inotifyMask = syscall.IN_CLOSE_WRITE | syscall.IN_CREATE |
+	syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO |
+	syscall.IN_ATTRIB
+
+type inotifyWatcher struct {
+	fd int
+
+	// watch descriptor -> watched directory (the reader goroutine
+	// consults this while watch() adds to it)
+	lock sync.Mutex
+	dirs map[int]string
+
+	changes chan string
+}
+
+func newWatcher() (watcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	self := &inotifyWatcher{
+		fd:      fd,
+		dirs:    make(map[int]string),
+		changes: make(chan string, 100),
+	}
+	go self.read()
+	return self, nil
+}
+
+func (self *inotifyWatcher) watch(dir string) error {
+	wd, err := syscall.InotifyAddWatch(self.fd, dir, inotifyMask)
+	if err != nil {
+		return &os.PathError{Op: "inotify_add_watch", Path: dir, Err: err}
+	}
+	self.lock.Lock()
+	self.dirs[wd] = dir
+	self.lock.Unlock()
+	return nil
+}
+
+func (self *inotifyWatcher) events() <-chan string {
+	return self.changes
+}
+
+// Read inotify events forever, translating each one to the name of
+// the file that changed. If the kernel's event queue overflows, send
+// "" to mean "anything might have changed".
+func (self *inotifyWatcher) read() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := syscall.Read(self.fd, buf)
+		if err == syscall.EINTR {
+			continue
+		} else if err != nil || n <= 0 {
+			log.Warning("error reading inotify events: %v", err)
+			close(self.changes)
+			return
+		}
+
+		offset := 0
+		for offset+syscall.SizeofInotifyEvent <= n {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			start := offset + syscall.SizeofInotifyEvent
+			offset = start + int(event.Len)
+			if event.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				self.changes <- ""
+				continue
+			}
+
+			self.lock.Lock()
+			dir, ok := self.dirs[int(event.Wd)]
+			if event.Mask&syscall.IN_IGNORED != 0 {
+				// watch removed (e.g. directory deleted)
+				delete(self.dirs, int(event.Wd))
+			}
+			self.lock.Unlock()
+			if !ok || event.Len == 0 {
+				continue
+			}
+
+			name := buf[start:offset]
+			for len(name) > 0 && name[len(name)-1] == 0 {
+				name = name[:len(name)-1]
+			}
+			self.changes <- filepath.Join(dir, string(name))
+		}
+	}
+}
@@ -0,0 +1,37 @@
+// Copyright © 2013, Greg Ward. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE.txt file.
+
+// +build linux
+
+package runtime
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchrcom/testify/assert"
+
+	"fubsy/testutils"
+)
+
+func Test_inotifyWatcher(t *testing.T) {
+	tmpdir, cleanup := testutils.Mktemp()
+	defer cleanup()
+
+	watcher, err := newWatcher()
+	assert.Nil(t, err)
+	err = watcher.watch(tmpdir)
+	assert.Nil(t, err)
+	err = watcher.watch(filepath.Join(tmpdir, "nonexistent"))
+	assert.NotNil(t, err)
+
+	testutils.Mkfile(tmpdir, "foo.c", "int x;\n")
+	select {
+	case name := <-watcher.events():
+		assert.Equal(t, filepath.Join(tmpdir, "foo.c"), name)
+	case <-time.After(5 * time.Second):
+		t.Error("timed out waiting for inotify event")
+	}
+}
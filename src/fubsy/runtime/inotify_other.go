@@ -0,0 +1,18 @@
+// Copyright © 2013, Greg Ward. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE.txt file.
+
+// +build !linux
+
+package runtime
+
+// Dummy watcher for platforms where we don't (yet) know how to watch
+// the filesystem.
+
+import (
+	"errors"
+)
+
+func newWatcher() (watcher, error) {
+	return nil, errors.New("--watch is only supported on Linux")
+}
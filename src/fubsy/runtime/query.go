@@ -0,0 +1,29 @@
+// Copyright © 2013, Greg Ward. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE.txt file.
+
+package runtime
+
+import (
+	"fmt"
+	"io"
+)
+
+// Run the build script up to the end of the main phase, evaluate
+// query against the dependency graph (see dag.Query() for the
+// syntax), and write the names of matching nodes to writer, one per
+// line.
+func (self *Runtime) RunQuery(writer io.Writer, query string) []error {
+	errs := self.loadGraph()
+	if len(errs) > 0 {
+		return errs
+	}
+	result, err := self.dag.Query(query)
+	if err != nil {
+		return []error{err}
+	}
+	for _, node := range self.dag.NodesIn(result) {
+		fmt.Fprintln(writer, node.Name())
+	}
+	return nil
+}
@@ -14,17 +14,29 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"strings"
+	"sync"
+	"syscall"
 
 	"fubsy/build"
 	"fubsy/dag"
 	"fubsy/db"
 	"fubsy/dsl"
+	"fubsy/events"
 	"fubsy/log"
 	"fubsy/plugins"
+	"fubsy/trace"
 	"fubsy/types"
 )
 
+// how many of the slowest actions to list after a traced build
+const slowestActions = 10
+
+// how to find programs on PATH (replaceable for testing)
+var lookPath = exec.LookPath
+
 type Runtime struct {
 	options build.BuildOptions
 	script  string // filename
@@ -33,6 +45,30 @@ type Runtime struct {
 	builtins BuiltinList
 	stack    *types.ValueStack
 	dag      *dag.DAG
+
+	// environment variables that every build rule depends on (as
+	// declared by buildenv())
+	envvars []string
+
+	// environment variables declared by the build rule currently
+	// executing (set by BuildRule.Execute())
+	ruleenv []string
+
+	// the build rule currently executing, and where to save the
+	// output of its commands (both set by BuildRule.Execute())
+	rule      *BuildRule
+	actionlog *actionLog
+
+	// where to report build events (nil for nowhere)
+	events *events.Stream
+
+	// records how long everything takes (nil unless the user asked
+	// for a trace with --trace)
+	tracer *trace.Tracer
+
+	// pools declared by pool(), which limit how many of the build
+	// rules assigned to each one can run at once
+	pools map[string]*build.Pool
 }
 
 func NewRuntime(
@@ -48,6 +84,11 @@ func NewRuntime(
 	locals := types.NewValueMap()
 	stack.Push(locals)
 
+	var tracer *trace.Tracer
+	if options.TraceFile != "" {
+		tracer = trace.NewTracer()
+	}
+
 	return &Runtime{
 		options:  options,
 		script:   script,
@@ -55,6 +96,8 @@ func NewRuntime(
 		builtins: builtins,
 		stack:    &stack,
 		dag:      dag.NewDAG(),
+		tracer:   tracer,
+		pools:    make(map[string]*build.Pool),
 	}
 }
 
@@ -67,27 +110,47 @@ func minimalRuntime() *Runtime {
 	return &Runtime{
 		stack: &stack,
 		dag:   dag.NewDAG(),
+		pools: make(map[string]*build.Pool),
 	}
 }
 
+// Report the progress of the build phase to stream.
+func (self *Runtime) SetEvents(stream *events.Stream) {
+	self.events = stream
+}
+
 func (self *Runtime) RunScript() []error {
 	var errors []error
 	for _, plugin := range self.ast.FindImports() {
 		log.Debug(log.PLUGINS, "loading plugin '%s'", strings.Join(plugin, "."))
 	}
 
-	errors = self.runInlinePlugins()
+	errors = self.loadGraph()
 	if len(errors) > 0 {
 		return errors
 	}
 
-	errors = self.runMainPhase()
+	errors = self.runBuildPhase()
+	return errors
+}
+
+// Run everything that comes before building targets: inline plugins
+// and the main phase, then finish constructing the dependency graph.
+// Commands that inspect the graph (e.g. "fubsy targets") call this
+// and then stop.
+func (self *Runtime) loadGraph() []error {
+	errors := self.runInlinePlugins()
 	if len(errors) > 0 {
 		return errors
 	}
 
-	errors = self.runBuildPhase()
-	return errors
+	span := self.tracer.Begin(0, "phase", "main phase")
+	errors = self.runMainPhase()
+	span.End()
+	if len(errors) > 0 {
+		return errors
+	}
+	return self.finishGraph()
 }
 
 func (self *Runtime) runInlinePlugins() []error {
@@ -137,7 +200,7 @@ func (self *Runtime) runMainPhase() []error {
 			var rule *BuildRule
 			rule, errs = self.makeRule(node)
 			if len(errs) == 0 {
-				self.addRule(rule)
+				errs = self.addRule(rule)
 			}
 		case dsl.ASTExpression:
 			_, errs = self.evaluate(node)
@@ -152,30 +215,54 @@ func (self *Runtime) runMainPhase() []error {
 }
 
 func (self *Runtime) makeRule(astrule *dsl.ASTBuildRule) (*BuildRule, []error) {
-	targets, sources, errs := self.makeRuleNodes(astrule)
+	targets, sources, orderonly, errs := self.makeRuleNodes(astrule)
 	if len(errs) > 0 {
 		return nil, errs
 	}
 
+	rule := NewBuildRule(self, targets, sources)
 	allactions := NewSequenceAction()
 	for _, action_ := range astrule.Actions() {
 		switch action := action_.(type) {
 		case *dsl.ASTString:
 			allactions.AddCommand(action)
 		case *dsl.ASTAssignment:
+			if isRuleAttribute(action.Target()) {
+				// evaluated now, in the main phase, since it affects
+				// how the rule is executed rather than what it does
+				errs = self.setRuleAttribute(rule, action)
+				if len(errs) > 0 {
+					return nil, errs
+				}
+				continue
+			}
 			allactions.AddAssignment(action)
 		case *dsl.ASTFunctionCall:
 			allactions.AddFunctionCall(action)
 		}
 	}
 
-	rule := NewBuildRule(self, targets, sources)
+	rule.orderonly = orderonly
+	rule.location = astrule.Location()
 	rule.action = allactions
 	return rule, nil
 }
 
+func (self *Runtime) setRuleAttribute(
+	rule *BuildRule, assignment *dsl.ASTAssignment) []error {
+	value, errs := self.evaluate(assignment.Expression())
+	if len(errs) > 0 {
+		return errs
+	}
+	err := rule.setAttribute(assignment.Target(), value)
+	if err != nil {
+		return MakeLocationErrors(assignment, []error{err})
+	}
+	return nil
+}
+
 func (self *Runtime) makeRuleNodes(astrule *dsl.ASTBuildRule) (
-	targets, sources []dag.Node, errs []error) {
+	targets, sources, orderonly []dag.Node, errs []error) {
 
 	// Evaluate the target and source lists, so we get one FuObject
 	// each. It might be a string, a list of strings, a FinderNode...
@@ -189,14 +276,22 @@ func (self *Runtime) makeRuleNodes(astrule *dsl.ASTBuildRule) (
 	if len(errs) > 0 {
 		return
 	}
+	var orderobj types.FuObject
+	if astrule.OrderOnly() != nil {
+		orderobj, errs = self.evaluate(astrule.OrderOnly())
+		if len(errs) > 0 {
+			return
+		}
+	}
 
 	// Convert each of those FuObjects to a list of DAG nodes.
 	targets = self.nodify(targetobj)
 	sources = self.nodify(sourceobj)
+	orderonly = self.nodify(orderobj)
 	return
 }
 
-func (self *Runtime) addRule(rule *BuildRule) {
+func (self *Runtime) addRule(rule *BuildRule) []error {
 	targets := rule.targets.Nodes()
 	sources := rule.sources.Nodes()
 
@@ -208,6 +303,29 @@ func (self *Runtime) addRule(rule *BuildRule) {
 	// And connect the nodes to each other (every source is a parent
 	// of every target).
 	self.dag.AddManyParents(targets, sources)
+	self.dag.AddManyOrderOnlyParents(targets, rule.orderonly)
+
+	// Finally, make every target depend on the value of every global
+	// variable used in the rule's command strings (e.g. $CFLAGS), so
+	// that changing the variable rebuilds the targets. Variables
+	// whose values are nodes or functions don't count: nodes are
+	// tracked in their own right.
+	for _, name := range rule.referencedNames() {
+		value, ok := self.stack.Lookup(name)
+		if !ok {
+			continue // undefined: an error when the action runs
+		}
+		switch value.(type) {
+		case dag.Node, types.FuCallable:
+			continue
+		}
+		vnode, err := dag.MakeValueNode(self.dag, name, nil)
+		if err != nil {
+			return []error{err}
+		}
+		self.dag.AddManyParents(targets, []dag.Node{vnode})
+	}
+	return nil
 }
 
 // Convert a single FuObject (possibly a FuList) to a list of Nodes and
@@ -220,7 +338,14 @@ func (self *Runtime) nodify(values types.FuObject) []dag.Node {
 	var result []dag.Node
 	switch values := values.(type) {
 	case types.FuString:
-		result = []dag.Node{dag.MakeFileNode(self.dag, values.ValueString())}
+		// a string names a file, unless there's already some other
+		// kind of node by that name (e.g. an alias)
+		name := values.ValueString()
+		node := self.dag.Lookup(name)
+		if node == nil {
+			node = dag.MakeFileNode(self.dag, name)
+		}
+		result = []dag.Node{node}
 	case types.FuList:
 		result = make([]dag.Node, 0, len(values.List()))
 		for _, val := range values.List() {
@@ -237,21 +362,57 @@ func (self *Runtime) nodify(values types.FuObject) []dag.Node {
 	return result
 }
 
-// Build user's requested targets according to the dependency graph in
-// self.dag (as constructed by runMainPhase()).
-func (self *Runtime) runBuildPhase() []error {
-	var errs []error
-
+// Convert the dependency graph constructed by runMainPhase() to its
+// final form: add implicit dependencies, expand every node, and
+// figure out which nodes are original sources.
+func (self *Runtime) finishGraph() []error {
+	errs := self.addEnvParents()
+	if len(errs) > 0 {
+		return errs
+	}
+	self.addToolParents()
+	span := self.tracer.Begin(0, "phase", "expand nodes")
 	errs = self.dag.ExpandNodes(self.stack)
+	span.End()
 	if len(errs) > 0 {
 		return errs
 	}
 	self.dag.MarkSources()
+	errs = self.checkPools()
+	if len(errs) > 0 {
+		return errs
+	}
 
 	log.Debug(log.DAG, "dependency graph:")
 	log.DebugDump(log.DAG, self.dag)
+	return nil
+}
 
-	goal, errs := self.dag.MatchTargets(self.options.Targets)
+// Make sure that every build rule assigned to a pool names one
+// declared by pool(), so a typo fails before anything is built. Rules
+// from the build script are checked as they are defined, but rules
+// can come from elsewhere (e.g. plugins).
+func (self *Runtime) checkPools() []error {
+	var errs []error
+	seen := make(map[dag.PooledRule]bool) // report each rule once
+	for _, node := range self.dag.Nodes() {
+		pooled, ok := node.BuildRule().(dag.PooledRule)
+		if !ok || seen[pooled] || pooled.Pool() == "" ||
+			self.pools[pooled.Pool()] != nil {
+			continue
+		}
+		seen[pooled] = true
+		errs = append(errs, fmt.Errorf(
+			"build rule for '%s': undefined pool '%s'",
+			node.Name(), pooled.Pool()))
+	}
+	return errs
+}
+
+// Build user's requested targets according to the dependency graph in
+// self.dag (as constructed by loadGraph()).
+func (self *Runtime) runBuildPhase() []error {
+	goal, errs := self.selectTargets()
 	if len(errs) > 0 {
 		return errs
 	}
@@ -264,13 +425,179 @@ func (self *Runtime) runBuildPhase() []error {
 	defer bdb.Close()
 
 	bstate := build.NewBuildState(self.dag, bdb, self.options)
+	if self.tracer != nil {
+		bstate.SetTracer(self.tracer)
+	}
+	bstate.SetEvents(self.events)
+	for _, pool := range self.pools {
+		bstate.AddPool(pool)
+	}
 	err = bstate.BuildTargets(goal)
 	if err != nil {
 		errs = append(errs, err)
 	}
+	if self.tracer != nil {
+		bstate.WriteTimings(os.Stdout, slowestActions)
+		err = self.tracer.WriteFile(self.options.TraceFile)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
 	return errs
 }
 
+// Return the set of targets to build: the targets requested by the
+// user (default: all final targets), restricted to those affected by
+// options.AffectedBy if set.
+func (self *Runtime) selectTargets() (*dag.NodeSet, []error) {
+	goal, errs := self.dag.MatchTargets(self.options.Targets)
+	if len(errs) > 0 || self.options.AffectedBy == nil {
+		return goal, errs
+	}
+	affected, err := self.dag.FindAffected(self.options.AffectedBy)
+	if err != nil {
+		return nil, []error{err}
+	}
+	goal = goal.Intersection(affected)
+	log.Verbose("%d targets affected by %d changed files",
+		goal.Length(), len(self.options.AffectedBy))
+	return goal, nil
+}
+
+// Make every target in the DAG depend on every environment variable
+// declared by buildenv(), wherever the build rule was defined.
+func (self *Runtime) addEnvParents() []error {
+	if len(self.envvars) == 0 {
+		return nil
+	}
+	envnodes := make([]dag.Node, len(self.envvars))
+	for i, name := range self.envvars {
+		node, err := dag.MakeEnvNode(self.dag, name)
+		if err != nil {
+			return []error{fmt.Errorf("buildenv(): %s", err)}
+		}
+		envnodes[i] = node
+	}
+	targets := []dag.Node{}
+	for _, node := range self.dag.Nodes() {
+		if node.BuildRule() != nil {
+			targets = append(targets, node)
+		}
+	}
+	self.dag.AddManyParents(targets, envnodes)
+	return nil
+}
+
+// Make every target depend on the programs run by its build rule
+// (as found by BuildRule.toolNames()), so that e.g. upgrading the
+// compiler rebuilds everything it compiled.
+func (self *Runtime) addToolParents() {
+	tools := make(map[*BuildRule][]dag.Node)
+	for _, node := range self.dag.Nodes() {
+		rule, ok := node.BuildRule().(*BuildRule)
+		if !ok {
+			continue
+		}
+		parents, ok := tools[rule]
+		if !ok {
+			parents = self.findTools(rule)
+			tools[rule] = parents
+		}
+		for _, parent := range parents {
+			self.dag.AddParent(node, parent)
+		}
+	}
+}
+
+// Resolve the programs run by rule to nodes. A program that is
+// itself a target of some other rule (e.g. "./gen") depends on that
+// node; anything else is a ToolNode, found by searching PATH if it
+// has no directory part. Programs that can't be found are silently
+// ignored: either the command will fail, or the shell knows
+// something that we don't.
+func (self *Runtime) findTools(rule *BuildRule) []dag.Node {
+	targets := make(map[string]bool)
+	for _, tnode := range rule.targets.Nodes() {
+		targets[tnode.Name()] = true
+	}
+
+	var nodes []dag.Node
+	for _, name := range rule.toolNames(self.stack) {
+		var filename string
+		var err error
+		if strings.Contains(name, "/") {
+			filename = filepath.Clean(name)
+		} else if filename, err = lookPath(name); err != nil {
+			continue
+		}
+		node := self.dag.Lookup(filename)
+		if node == nil {
+			if _, err = os.Stat(filename); err == nil {
+				// can't fail: there is no node by this name yet
+				node, _ = dag.MakeToolNode(self.dag, filename)
+			}
+		}
+		if node == nil || targets[node.Name()] {
+			// not found, or the rule runs its own target (weird but
+			// harmless -- and we must not make a node its own parent)
+			continue
+		}
+		log.Debug(log.DAG, "rule %v runs %s", rule, node)
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+// Return a copy of this runtime for executing rule, with locals
+// pushed on a value stack of its own and rule as the current build
+// rule. Rules executing at once (in a parallel build) each have their
+// own copy, so they share only what does not change in the build
+// phase (e.g. global variables).
+func (self *Runtime) forRule(rule *BuildRule, locals types.Namespace) *Runtime {
+	rt := *self
+	stack := make(types.ValueStack, len(*self.stack), len(*self.stack)+1)
+	copy(stack, *self.stack)
+	stack.Push(locals)
+	rt.stack = &stack
+	rt.rule = rule
+	rt.ruleenv = rule.envNames()
+	rt.actionlog = nil
+	return &rt
+}
+
+// Return the environment for running an action of the current build
+// rule, in the form expected by exec.Cmd: nil (inherit everything)
+// unless the user asked for a hermetic build, in which case only the
+// declared environment variables that are actually set.
+func (self *Runtime) actionEnvironment() []string {
+	if !self.options.Hermetic {
+		return nil
+	}
+	env := []string{}
+	seen := make(map[string]bool)
+	for _, names := range [][]string{self.envvars, self.ruleenv} {
+		for _, name := range names {
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			if value, ok := syscall.Getenv(name); ok {
+				env = append(env, name+"="+value)
+			}
+		}
+	}
+	return env
+}
+
+// Return the name of the (first) target of the build rule currently
+// executing, or "" if no rule is executing.
+func (self *Runtime) currentTarget() string {
+	if self.rule == nil {
+		return ""
+	}
+	return self.rule.targets.Nodes()[0].Name()
+}
+
 func (self *Runtime) Namespace() types.Namespace {
 	return self.stack
 }
@@ -279,6 +606,10 @@ func (self *Runtime) Lookup(name string) (types.FuObject, bool) {
 	return self.stack.Lookup(name)
 }
 
+// the build database may be opened several times in one run (e.g. by
+// shell() as well as for the build phase), but one warning is enough
+var noDBWarning sync.Once
+
 func openBuildDB() (build.BuildDB, error) {
 	var bdb build.BuildDB
 	var err error
@@ -288,16 +619,31 @@ func openBuildDB() (build.BuildDB, error) {
 		return nil, err
 	}
 
-	bdb, err = db.OpenKyotoDB(".fubsy/buildstate.kch", true)
+	kdb, err := db.OpenKyotoDB(".fubsy/buildstate.kch", true)
 	if _, ok := err.(db.NotAvailableError); ok {
 		bdb = db.NewFakeDB()
 		err = nil
-		log.Warning(
-			"no database libraries available; build state will not be saved")
+		noDBWarning.Do(func() {
+			log.Warning(
+				"no database libraries available; build state will not be saved")
+		})
+		return bdb, nil
 	} else if err != nil {
 		return nil, err
 	}
-	return bdb, nil
+
+	// signatures computed with one hash algorithm are meaningless
+	// with another, so start over if the user switched algorithms
+	reset, err := kdb.CheckHashAlgorithm(dag.HashAlgorithm())
+	if err != nil {
+		kdb.Close()
+		return nil, err
+	}
+	if reset {
+		log.Info("hash algorithm is now %s: rebuilding everything",
+			dag.HashAlgorithm())
+	}
+	return kdb, nil
 }
 
 func unsupportedAST(node dsl.ASTNode) error {
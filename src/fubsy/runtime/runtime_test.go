@@ -6,7 +6,10 @@ package runtime
 
 import (
 	"bytes"
+	"errors"
+	"io/ioutil"
 	"testing"
+	"time"
 	//"fmt"
 	//"reflect"
 
@@ -14,7 +17,9 @@ import (
 
 	"fubsy/build"
 	"fubsy/dag"
+	"fubsy/db"
 	"fubsy/dsl"
+	"fubsy/testutils"
 	"fubsy/types"
 )
 
@@ -53,7 +58,9 @@ func Test_Runtime_runMainPhase_valid(t *testing.T) {
   action: "cc -o $TARGET $src"
   parents:
     0001: foo.c
+    0002: src:value
 0001: FileNode "foo.c" (state UNKNOWN)
+0002: ValueNode "src:value" (state UNKNOWN)
 `
 	var buf bytes.Buffer
 	rt.dag.Dump(&buf, "")
@@ -63,6 +70,395 @@ func Test_Runtime_runMainPhase_valid(t *testing.T) {
 	}
 }
 
+func Test_Runtime_runMainPhase_values(t *testing.T) {
+	// targets depend on the variables used in their actions, unless
+	// they are local to the rule or their values are nodes
+	script := "" +
+		"main {\n" +
+		"  CFLAGS = \"-O2\"\n" +
+		"  headers = <*.h>\n" +
+		"  \"foo\": [\"foo.c\", ValueNode(\"mode\", \"debug\")] {\n" +
+		"    out = \"$TARGET.tmp\"\n" +
+		"    \"cc $CFLAGS -I$headers -o $out $SOURCE\"\n" +
+		"  }\n" +
+		"}\n"
+	rt := parseScript(t, "test.fubsy", script)
+	errors := rt.runMainPhase()
+	assert.Equal(t, 0, len(errors))
+
+	expect := `0000: ValueNode "mode:value:36967f86" (state UNKNOWN)
+0001: FileNode "foo" (state UNKNOWN)
+  action: out = ... && "cc $CFLAGS -I$headers -o $out $SOURCE"
+  parents:
+    0000: mode:value:36967f86
+    0002: foo.c
+    0003: CFLAGS:value
+0002: FileNode "foo.c" (state UNKNOWN)
+0003: ValueNode "CFLAGS:value" (state UNKNOWN)
+`
+	var buf bytes.Buffer
+	rt.dag.Dump(&buf, "")
+	actual := buf.String()
+	if expect != actual {
+		t.Errorf("dag.Dump(): expected\n%v\nbut got\n%v", expect, actual)
+	}
+
+	errs := rt.dag.ExpandNodes(rt.stack)
+	assert.Equal(t, 0, len(errs))
+	node := rt.dag.Lookup("CFLAGS:value").(*dag.ValueNode)
+	assert.Equal(t, "-O2", node.Value())
+	node = rt.dag.Lookup("mode:value:36967f86").(*dag.ValueNode)
+	assert.Equal(t, "debug", node.Value())
+}
+
+func Test_Runtime_runMainPhase_orderonly(t *testing.T) {
+	script := "" +
+		"main {\n" +
+		"  \"obj/foo.o\": \"foo.c\" | DirNode(\"obj\") {\n" +
+		"    \"cc -c -o $TARGET $SOURCES\"\n" +
+		"  }\n" +
+		"}\n"
+	rt := parseScript(t, "test.fubsy", script)
+	errors := rt.runMainPhase()
+	assert.Equal(t, 0, len(errors))
+
+	expect := `0000: DirNode "obj" (state UNKNOWN)
+0001: FileNode "obj/foo.o" (state UNKNOWN)
+  action: "cc -c -o $TARGET $SOURCES"
+  parents:
+    0000: obj (order-only)
+    0002: foo.c
+0002: FileNode "foo.c" (state UNKNOWN)
+`
+	var buf bytes.Buffer
+	rt.dag.Dump(&buf, "")
+	actual := buf.String()
+	if expect != actual {
+		t.Errorf("dag.Dump(): expected\n%v\nbut got\n%v", expect, actual)
+	}
+
+	// order-only sources are not in $SOURCES
+	target := rt.dag.Lookup("obj/foo.o")
+	locals := types.NewValueMap()
+	target.BuildRule().(*BuildRule).setLocals(locals)
+	sources, _ := locals.Lookup("SOURCES")
+	assert.Equal(t, "foo.c", sources.ValueString())
+}
+
+// changing an order-only source does not make the target stale, and
+// the action never sees it in $SOURCES
+func Test_Runtime_build_orderonly(t *testing.T) {
+	cleanup := testutils.Chtemp()
+	defer cleanup()
+	testutils.Mkfile(".", "in.txt", "hello\n")
+	testutils.Mkfile(".", "setup.txt", "v1\n")
+
+	script := "" +
+		"main {\n" +
+		"  \"out.txt\": \"in.txt\" | \"setup.txt\" {\n" +
+		"    \"echo $SOURCES >> sources.log; cat in.txt > $TARGET\"\n" +
+		"  }\n" +
+		"}\n"
+	bdb := db.NewFakeDB()
+	buildOnce := func() {
+		rt := parseScript(t, "test.fubsy", script)
+		testutils.NoErrors(t, rt.runMainPhase())
+		testutils.NoErrors(t, rt.finishGraph())
+		goal, errs := rt.selectTargets()
+		testutils.NoErrors(t, errs)
+		bstate := build.NewBuildState(rt.dag, bdb, rt.options)
+		assert.Nil(t, bstate.BuildTargets(goal))
+	}
+	runs := func() string {
+		data, err := ioutil.ReadFile("sources.log")
+		assert.Nil(t, err)
+		return string(data)
+	}
+
+	buildOnce()
+	assert.Equal(t, "in.txt\n", runs())
+
+	testutils.Mkfile(".", "setup.txt", "v2\n")
+	buildOnce()
+	assert.Equal(t, "in.txt\n", runs())
+
+	testutils.Mkfile(".", "in.txt", "goodbye\n")
+	buildOnce()
+	assert.Equal(t, "in.txt\nin.txt\n", runs())
+}
+
+func Test_Runtime_runMainPhase_attributes(t *testing.T) {
+	script := "" +
+		"main {\n" +
+		"  \"test.out\": \"test\" {\n" +
+		"    timeout = \"90s\"\n" +
+		"    retries = \"2\"\n" +
+		"    \"./test > $TARGET\"\n" +
+		"  }\n" +
+		"}\n"
+	rt := parseScript(t, "test.fubsy", script)
+	errors := rt.runMainPhase()
+	assert.Equal(t, 0, len(errors))
+
+	rule := rt.dag.Lookup("test.out").BuildRule().(*BuildRule)
+	assert.Equal(t, 90*time.Second, rule.timeout)
+	assert.Equal(t, 2, rule.Retries())
+	value, ok := rule.Lookup("timeout")
+	assert.True(t, ok)
+	assert.Equal(t, "90s", value.ValueString())
+
+	// attributes are not assignments run by the rule's action
+	assert.Equal(t, `"./test > $TARGET"`, rule.ActionString())
+
+	script = "" +
+		"main {\n" +
+		"  \"test.out\": \"test\" {\n" +
+		"    \"./test > $TARGET\"\n" +
+		"    timeout = \"forever\"\n" +
+		"  }\n" +
+		"}\n"
+	rt = parseScript(t, "test.fubsy", script)
+	errors = rt.runMainPhase()
+	assert.Equal(t, 1, len(errors))
+	assert.Equal(t,
+		"test.fubsy:4: invalid timeout 'forever' (expected a number "+
+			"of seconds, or a duration like \"90s\" or \"5m\")",
+		errors[0].Error())
+}
+
+func Test_Runtime_runMainPhase_pool(t *testing.T) {
+	script := "" +
+		"main {\n" +
+		"  pool(\"link\", \"2\")\n" +
+		"  \"app\": \"app.o\" {\n" +
+		"    pool = \"link\"\n" +
+		"    \"cc -o $TARGET $SOURCES\"\n" +
+		"  }\n" +
+		"}\n"
+	rt := parseScript(t, "test.fubsy", script)
+	errors := rt.runMainPhase()
+	assert.Equal(t, 0, len(errors))
+	rule := rt.dag.Lookup("app").BuildRule().(*BuildRule)
+	assert.Equal(t, "link", rule.Pool())
+	assert.Equal(t, 2, rt.pools["link"].Capacity())
+
+	script = "" +
+		"main {\n" +
+		"  \"app\": \"app.o\" {\n" +
+		"    pool = \"link\"\n" +
+		"    \"cc -o $TARGET $SOURCES\"\n" +
+		"  }\n" +
+		"}\n"
+	rt = parseScript(t, "test.fubsy", script)
+	errors = rt.runMainPhase()
+	assert.Equal(t, 1, len(errors))
+	assert.Equal(t,
+		"test.fubsy:3: undefined pool 'link' (declare it with pool() first)",
+		errors[0].Error())
+}
+
+// naming an existing node as a node of another type is an error in
+// the build script, reported where it happens
+func Test_Runtime_runMainPhase_node_type_clash(t *testing.T) {
+	script := "" +
+		"main {\n" +
+		"  \"foo\": \"foo.c\" {\n" +
+		"    \"cc -o $TARGET $SOURCES\"\n" +
+		"  }\n" +
+		"  out = DirNode(\"foo\")\n" +
+		"}\n"
+	rt := parseScript(t, "test.fubsy", script)
+	errors := rt.runMainPhase()
+	assert.Equal(t, 1, len(errors))
+	assert.Equal(t,
+		"test.fubsy:5: DirNode(): cannot create DirNode 'foo': "+
+			"there is already a FileNode with that name",
+		errors[0].Error())
+}
+
+// rules that don't come from the build script are checked when the
+// graph is finished, before anything is built
+func Test_Runtime_finishGraph_pool(t *testing.T) {
+	script := "" +
+		"main {\n" +
+		"  pool(\"link\", \"1\")\n" +
+		"  \"app\": \"app.o\" {\n" +
+		"    \"cc -o $TARGET $SOURCES\"\n" +
+		"  }\n" +
+		"}\n"
+	rt := parseScript(t, "test.fubsy", script)
+	errors := rt.runMainPhase()
+	assert.Equal(t, 0, len(errors))
+	node := rt.dag.Lookup("app")
+	rule := dag.MakeStubRule(func(string) {}, node)
+	rule.SetPool("link")
+	node.SetBuildRule(rule)
+	errors = rt.finishGraph()
+	assert.Equal(t, 0, len(errors))
+
+	rule.SetPool("lnik")
+	errors = rt.finishGraph()
+	assert.Equal(t, 1, len(errors))
+	assert.Equal(t, "build rule for 'app': undefined pool 'lnik'", errors[0].Error())
+}
+
+func Test_Runtime_selectTargets_affected(t *testing.T) {
+	script := "" +
+		"main {\n" +
+		"  \"app\": <src/*.c> {\n" +
+		"    \"./compile $TARGET $SOURCES\"\n" +
+		"  }\n" +
+		"  \"doc.html\": \"doc.txt\" {\n" +
+		"    \"./format $SOURCE\"\n" +
+		"  }\n" +
+		"}\n"
+	rt := parseScript(t, "test.fubsy", script)
+	errs := rt.runMainPhase()
+	assert.Equal(t, 0, len(errs))
+	errs = rt.finishGraph()
+	assert.Equal(t, 0, len(errs))
+
+	names := func(goal *dag.NodeSet) []string {
+		result := []string{}
+		for _, node := range rt.dag.NodesIn(goal) {
+			result = append(result, node.Name())
+		}
+		return result
+	}
+
+	goal, errs := rt.selectTargets()
+	assert.Equal(t, 0, len(errs))
+	assert.Equal(t, []string{"app", "doc.html"}, names(goal))
+
+	rt.options.AffectedBy = []string{"src/new.c"}
+	goal, errs = rt.selectTargets()
+	assert.Equal(t, 0, len(errs))
+	assert.Equal(t, []string{"app"}, names(goal))
+
+	// affected targets are intersected with requested targets
+	rt.options.Targets = []string{"doc.html"}
+	goal, errs = rt.selectTargets()
+	assert.Equal(t, 0, len(errs))
+	assert.Equal(t, []string{}, names(goal))
+
+	rt.options.AffectedBy = []string{"doc.txt", "src/new.c"}
+	goal, errs = rt.selectTargets()
+	assert.Equal(t, 0, len(errs))
+	assert.Equal(t, []string{"doc.html"}, names(goal))
+}
+
+func Test_Runtime_addEnvParents(t *testing.T) {
+	script := "" +
+		"main {\n" +
+		"  \"a\": [\"a.c\", EnvNode(\"CC\")] {\n" +
+		"    \"cc -o $TARGET $SOURCES\"\n" +
+		"  }\n" +
+		"  buildenv(\"PATH\", \"LANG\")\n" +
+		"}\n"
+	rt := parseScript(t, "test.fubsy", script)
+	errors := rt.runMainPhase()
+	assert.Equal(t, 0, len(errors))
+	assert.Equal(t, []string{"PATH", "LANG"}, rt.envvars)
+
+	// buildenv() applies to rules defined before it, too
+	errors = rt.addEnvParents()
+	assert.Equal(t, 0, len(errors))
+	expect := `0000: EnvNode "CC:env" (state UNKNOWN)
+0001: FileNode "a" (state UNKNOWN)
+  action: "cc -o $TARGET $SOURCES"
+  parents:
+    0000: CC:env
+    0002: a.c
+    0003: PATH:env
+    0004: LANG:env
+0002: FileNode "a.c" (state UNKNOWN)
+0003: EnvNode "PATH:env" (state UNKNOWN)
+0004: EnvNode "LANG:env" (state UNKNOWN)
+`
+	var buf bytes.Buffer
+	rt.dag.Dump(&buf, "")
+	actual := buf.String()
+	if expect != actual {
+		t.Errorf("dag.Dump(): expected\n%v\nbut got\n%v", expect, actual)
+	}
+
+	rule := rt.dag.Lookup("a").BuildRule().(*BuildRule)
+	assert.Equal(t, []string{"CC"}, rule.envNames())
+}
+
+func Test_Runtime_addToolParents(t *testing.T) {
+	cleanup := testutils.Chtemp()
+	defer cleanup()
+	testutils.TouchFiles("bin/cc", "tools/lint")
+
+	// fake PATH lookup, so the test doesn't depend on what's installed
+	defer func(orig func(string) (string, error)) {
+		lookPath = orig
+	}(lookPath)
+	lookPath = func(name string) (string, error) {
+		if name == "cc" || name == "mkdir" {
+			return "bin/" + name, nil
+		}
+		return "", errors.New("not found: " + name)
+	}
+
+	script := "" +
+		"main {\n" +
+		"  \"gen\": \"gen.c\" {\n" +
+		"    \"cc -o $TARGET $SOURCE\"\n" +
+		"  }\n" +
+		"  \"out\": [\"in\", \"gen\"] {\n" +
+		"    \"./gen < in > out\"\n" +
+		"    \"tools/lint out\"\n" +
+		"    \"mkdir -p x && bogus\"\n" +
+		"    \"./out --selftest\"\n" +
+		"  }\n" +
+		"}\n"
+	rt := parseScript(t, "test.fubsy", script)
+	errs := rt.runMainPhase()
+	assert.Equal(t, 0, len(errs))
+	rt.addToolParents()
+
+	// bin/mkdir does not exist, bogus isn't on PATH, and "out"
+	// can't depend on itself
+	expect := `0000: FileNode "gen" (state UNKNOWN)
+  action: "cc -o $TARGET $SOURCE"
+  parents:
+    0001: gen.c
+    0004: bin/cc
+0001: FileNode "gen.c" (state UNKNOWN)
+0002: FileNode "out" (state UNKNOWN)
+  action: "./gen < in > out" && "tools/lint out" && "mkdir -p x && bogus" && ...
+  parents:
+    0000: gen
+    0003: in
+    0005: tools/lint
+0003: FileNode "in" (state UNKNOWN)
+0004: ToolNode "bin/cc" (state UNKNOWN)
+0005: ToolNode "tools/lint" (state UNKNOWN)
+`
+	var buf bytes.Buffer
+	rt.dag.Dump(&buf, "")
+	actual := buf.String()
+	if expect != actual {
+		t.Errorf("dag.Dump(): expected\n%v\nbut got\n%v", expect, actual)
+	}
+
+	// explicitly declared tools must be found
+	args := RuntimeArgs{
+		BasicArgs: types.MakeBasicArgs(
+			nil, types.MakeStringList("cc").List(), nil),
+		runtime: rt,
+	}
+	node, errs := fn_ToolNode(args)
+	assert.Equal(t, 0, len(errs))
+	assert.True(t, node == rt.dag.Lookup("bin/cc"))
+	args.BasicArgs = types.MakeBasicArgs(
+		nil, types.MakeStringList("bogus").List(), nil)
+	_, errs = fn_ToolNode(args)
+	assert.Equal(t, "not found: bogus", errs[0].Error())
+}
+
 func Test_Runtime_runMainPhase_error(t *testing.T) {
 	// runtime error evaluating a build rule
 	script := "" +
@@ -0,0 +1,151 @@
+// Copyright © 2013, Greg Ward. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE.txt file.
+
+package runtime
+
+// shell(): run a command while the build script is running (not
+// later, in the build phase) and capture its output in a variable,
+// e.g. version = shell("git describe").
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"syscall"
+
+	"fubsy/build"
+	"fubsy/log"
+	"fubsy/types"
+)
+
+// shell(command, option, ...) runs command with the shell and returns
+// its output, less any trailing newlines, as a string. With option
+// "split", the output is split into words and returned as a list;
+// with "lines", it is split into lines. With "cache", the output
+// saved in the build database by an earlier run is reused, as long
+// as the variables declared by buildenv() are unchanged (handy for
+// slow commands whose output rarely changes).
+func fn_shell(argsource types.ArgSource) (types.FuObject, []error) {
+	rt := argsource.(RuntimeArgs).runtime
+	args := argsource.Args()
+	command := args[0].ValueString()
+	split := ""
+	cache := false
+	for _, arg := range args[1:] {
+		switch option := arg.ValueString(); option {
+		case "split", "lines":
+			split = option
+		case "cache":
+			cache = true
+		default:
+			return nil, []error{fmt.Errorf(
+				"shell(): unknown option '%s' "+
+					"(expected \"split\", \"lines\", or \"cache\")", option)}
+		}
+	}
+
+	var output []byte
+	var err error
+	if cache {
+		output, err = rt.cachedShell(command)
+	} else {
+		output, err = rt.runShell(command)
+	}
+	if err != nil {
+		return nil, []error{err}
+	}
+
+	result := strings.TrimRight(string(output), "\n")
+	switch split {
+	case "split":
+		return types.MakeStringList(strings.Fields(result)...), nil
+	case "lines":
+		if result == "" {
+			return types.MakeStringList(), nil
+		}
+		return types.MakeStringList(strings.Split(result, "\n")...), nil
+	}
+	return types.MakeFuString(result), nil
+}
+
+// Run command and return its standard output. Standard error goes
+// straight to ours. A command that fails is reported as a
+// *build.ActionError.
+func (self *Runtime) runShell(command string) ([]byte, error) {
+	log.Verbose("running %s", command)
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Env = self.actionEnvironment()
+	cmd.Stderr = os.Stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, self.actionError(command, err)
+	}
+	return output, nil
+}
+
+// Like runShell(), but first look for the output of an earlier run
+// in the build database, and save the output there for next time.
+func (self *Runtime) cachedShell(command string) ([]byte, error) {
+	bdb, err := openBuildDB()
+	if err != nil {
+		return nil, err
+	}
+	defer bdb.Close()
+	return self.cachedShellIn(bdb, command)
+}
+
+// The guts of cachedShell(), using bdb as the build database. Each
+// command has a single entry in bdb: the fingerprint of the
+// environment it ran with (see shellEnvFingerprint()) followed by its
+// output. The entry is reused if the fingerprint still matches, and
+// replaced otherwise, so the database holds no stale entries.
+func (self *Runtime) cachedShellIn(bdb build.BuildDB, command string) (
+	[]byte, error) {
+	key := shellCacheKey(command)
+	fingerprint := self.shellEnvFingerprint()
+	entry, err := bdb.LookupValue(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(entry) >= len(fingerprint) &&
+		bytes.Equal(entry[:len(fingerprint)], fingerprint) {
+		log.Verbose("using cached output of %s", command)
+		return entry[len(fingerprint):], nil
+	}
+	output, err := self.runShell(command)
+	if err != nil {
+		return nil, err
+	}
+	entry = append(fingerprint, output...)
+	return output, bdb.WriteValue(key, entry)
+}
+
+// Return the build database key for the cached output of command.
+func shellCacheKey(command string) string {
+	hash := sha1.Sum([]byte(command))
+	return "shell:" + hex.EncodeToString(hash[:])
+}
+
+// Return a hash of the environment variables declared by buildenv()
+// (so far) and their current values. Only those variables count:
+// the whole environment includes variables like PWD and SHLVL that
+// differ from one shell to the next, so the cache would hardly ever
+// be used.
+func (self *Runtime) shellEnvFingerprint() []byte {
+	names := append([]string(nil), self.envvars...)
+	sort.Strings(names)
+	hash := sha1.New()
+	for _, name := range names {
+		hash.Write([]byte("\x00" + name))
+		if value, ok := syscall.Getenv(name); ok {
+			hash.Write([]byte("=" + value))
+		}
+	}
+	return hash.Sum(nil)
+}
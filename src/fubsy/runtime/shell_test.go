@@ -0,0 +1,123 @@
+// Copyright © 2013, Greg Ward. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE.txt file.
+
+package runtime
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchrcom/testify/assert"
+
+	"fubsy/build"
+	"fubsy/db"
+	"fubsy/testutils"
+	"fubsy/types"
+)
+
+func Test_shell(t *testing.T) {
+	rt := minimalRuntime()
+	makeArgs := func(args ...string) RuntimeArgs {
+		return RuntimeArgs{
+			BasicArgs: types.MakeBasicArgs(
+				nil, types.MakeStringList(args...).List(), nil),
+			runtime: rt,
+		}
+	}
+
+	result, errs := fn_shell(makeArgs("echo '1.2.3'"))
+	testutils.NoErrors(t, errs)
+	assert.Equal(t, types.MakeFuString("1.2.3"), result)
+
+	command := "echo '-I/usr/include/gtk  -pthread'; echo"
+	result, errs = fn_shell(makeArgs(command))
+	testutils.NoErrors(t, errs)
+	assert.Equal(t,
+		types.MakeFuString("-I/usr/include/gtk  -pthread"), result)
+	result, errs = fn_shell(makeArgs(command, "split"))
+	testutils.NoErrors(t, errs)
+	assert.Equal(t,
+		types.MakeStringList("-I/usr/include/gtk", "-pthread"), result)
+
+	result, errs = fn_shell(makeArgs("printf 'a b\\nc\\n'", "lines"))
+	testutils.NoErrors(t, errs)
+	assert.Equal(t, types.MakeStringList("a b", "c"), result)
+	result, errs = fn_shell(makeArgs("true", "lines"))
+	testutils.NoErrors(t, errs)
+	assert.Equal(t, types.MakeStringList(), result)
+
+	_, errs = fn_shell(makeArgs("true", "bogus"))
+	assert.Equal(t,
+		"shell(): unknown option 'bogus' "+
+			"(expected \"split\", \"lines\", or \"cache\")",
+		errs[0].Error())
+}
+
+func Test_shell_failure(t *testing.T) {
+	rt := parseScript(t, "test.fubsy",
+		"main {\n  version = shell(\"echo oops; exit 2\")\n}\n")
+	errs := rt.runMainPhase()
+	assert.Equal(t, 1, len(errs))
+	actionerr := errs[0].(*build.ActionError)
+	assert.Equal(t, 2, actionerr.ExitStatus)
+	assert.Equal(t, "test.fubsy:2: ", actionerr.Location.ErrorPrefix())
+	assert.Equal(t,
+		"test.fubsy:2: command exited with status 2: echo oops; exit 2",
+		actionerr.Error())
+}
+
+func Test_shell_cache(t *testing.T) {
+	cleanup := testutils.Chtemp()
+	defer cleanup()
+
+	rt := minimalRuntime()
+	args := RuntimeArgs{
+		BasicArgs: types.MakeBasicArgs(nil, types.MakeStringList(
+			"echo run >> runs; echo hello", "cache").List(), nil),
+		runtime: rt,
+	}
+	result, errs := fn_shell(args)
+	testutils.NoErrors(t, errs)
+	assert.Equal(t, types.MakeFuString("hello"), result)
+
+	// output is reused until a variable declared by buildenv()
+	// changes; anything else in the environment doesn't count
+	os.Setenv("FUBSY_TEST_PKG_CONFIG_PATH", "/opt/lib")
+	defer os.Unsetenv("FUBSY_TEST_PKG_CONFIG_PATH")
+	bdb := db.NewFakeDB()
+	command := "echo run >> runs; echo $FUBSY_TEST_PKG_CONFIG_PATH"
+	shell := func(expect string) {
+		output, err := rt.cachedShellIn(bdb, command)
+		assert.Nil(t, err)
+		assert.Equal(t, expect+"\n", string(output))
+	}
+	runs := func() int {
+		data, err := ioutil.ReadFile("runs")
+		assert.Nil(t, err)
+		return strings.Count(string(data), "run\n")
+	}
+	shell("/opt/lib")
+	assert.Equal(t, 2, runs())
+	os.Setenv("FUBSY_TEST_OTHER", "whatever")
+	defer os.Unsetenv("FUBSY_TEST_OTHER")
+	shell("/opt/lib")
+	assert.Equal(t, 2, runs())
+
+	rt.envvars = []string{"FUBSY_TEST_PKG_CONFIG_PATH"}
+	shell("/opt/lib")
+	assert.Equal(t, 3, runs())
+	os.Setenv("FUBSY_TEST_PKG_CONFIG_PATH", "/usr/lib")
+	shell("/usr/lib")
+	assert.Equal(t, 4, runs())
+	shell("/usr/lib")
+	assert.Equal(t, 4, runs())
+
+	// each command has a single entry, replaced when it's stale
+	entry, err := bdb.LookupValue(shellCacheKey(command))
+	assert.Nil(t, err)
+	assert.Equal(t, append(rt.shellEnvFingerprint(), "/usr/lib\n"...), entry)
+	assert.NotEqual(t, shellCacheKey(command), shellCacheKey("echo hello"))
+}
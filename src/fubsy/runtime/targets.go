@@ -0,0 +1,141 @@
+// Copyright © 2013, Greg Ward. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE.txt file.
+
+package runtime
+
+// Implementation of "fubsy targets": describe the targets defined by
+// a build script instead of building them.
+
+import (
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"fubsy/build"
+	"fubsy/dag"
+)
+
+// Run the build script up to the end of the main phase, and write a
+// table describing its targets to writer: each target's name, whether
+// it is up to date according to the build database, where its build
+// rule is defined, and a summary of its action. Lists the targets
+// that the user asked for, or (by default) all final targets and
+// aliases; if all is true, lists every target in the graph. If tree
+// is true, each target is followed by its ancestors (excluding
+// original sources), indented.
+func (self *Runtime) ListTargets(writer io.Writer, all bool, tree bool) []error {
+	errs := self.loadGraph()
+	if len(errs) > 0 {
+		return errs
+	}
+
+	bdb, err := openBuildDB()
+	if err != nil {
+		return []error{err}
+	}
+	defer bdb.Close()
+	return self.describeTargets(writer, bdb, all, tree)
+}
+
+func (self *Runtime) describeTargets(
+	writer io.Writer, bdb build.BuildDB, all bool, tree bool) []error {
+	goal, errs := self.dag.MatchTargets(self.options.Targets)
+	if len(errs) > 0 {
+		return errs
+	}
+	bstate := build.NewBuildState(self.dag, bdb, self.options)
+	stale, err := bstate.StaleTargets(goal)
+	if err != nil {
+		return []error{err}
+	}
+
+	var targets []dag.Node
+	if all {
+		for _, node := range self.dag.Nodes() {
+			if node.State() != dag.SOURCE {
+				targets = append(targets, node)
+			}
+		}
+	} else if len(self.options.Targets) > 0 {
+		targets = self.dag.NodesIn(goal)
+	} else {
+		// aliases are usually final targets anyway, but not if one
+		// alias includes another
+		final := make(map[dag.Node]bool)
+		for _, node := range self.dag.NodesIn(goal) {
+			final[node] = true
+		}
+		for _, node := range self.dag.Nodes() {
+			_, isalias := node.(*dag.AliasNode)
+			if final[node] || isalias {
+				targets = append(targets, node)
+			}
+		}
+	}
+
+	lister := &targetLister{
+		graph:  self.dag,
+		stale:  stale,
+		tree:   tree,
+		shown:  make(map[dag.Node]bool),
+		writer: tabwriter.NewWriter(writer, 0, 4, 2, ' ', 0),
+	}
+	lister.writeRow("TARGET", "STATUS", "RULE", "ACTION")
+	for _, node := range targets {
+		lister.describe(node, "")
+	}
+	lister.writer.Flush()
+	return nil
+}
+
+type targetLister struct {
+	graph  *dag.DAG
+	stale  map[dag.Node]bool
+	tree   bool
+	shown  map[dag.Node]bool // nodes already shown in the tree view
+	writer *tabwriter.Writer
+}
+
+func (self *targetLister) describe(node dag.Node, indent string) {
+	status := "up to date"
+	if self.stale[node] {
+		status = "out of date"
+	}
+	location := ruleLocation(node)
+	if location == "" {
+		location = "-"
+	}
+	action := ""
+	if node.BuildRule() != nil {
+		action = node.BuildRule().ActionString()
+	}
+	if self.tree && self.shown[node] {
+		// don't repeat entire subtrees for shared dependencies
+		action = "(see above)"
+	}
+	self.writeRow(indent+node.Name(), status, location, action)
+
+	if !self.tree || self.shown[node] {
+		return
+	}
+	self.shown[node] = true
+	for _, parent := range self.graph.ParentNodes(node) {
+		if parent.State() != dag.SOURCE {
+			self.describe(parent, indent+"  ")
+		}
+	}
+}
+
+func (self *targetLister) writeRow(cols ...string) {
+	io.WriteString(self.writer, strings.Join(cols, "\t")+"\n")
+}
+
+// Return the location (filename and line numbers) of the build rule
+// that defined node, or "" if unknown.
+func ruleLocation(node dag.Node) string {
+	if rule, ok := node.BuildRule().(*BuildRule); ok && rule.Location() != nil {
+		return strings.TrimSuffix(rule.Location().ErrorPrefix(), ": ")
+	}
+	return ""
+}
@@ -0,0 +1,77 @@
+// Copyright © 2013, Greg Ward. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE.txt file.
+
+package runtime
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchrcom/testify/assert"
+
+	"fubsy/db"
+)
+
+func Test_Runtime_describeTargets(t *testing.T) {
+	script := "" +
+		"main {\n" +
+		"  \"app\": [\"app.o\", \"util.o\"] {\n" +
+		"    \"./link $TARGET $SOURCES\"\n" +
+		"  }\n" +
+		"  \"app.o\": \"app.c\" {\n" +
+		"    \"./compile $SOURCE\"\n" +
+		"  }\n" +
+		"  \"util.o\": \"util.c\" {\n" +
+		"    \"./compile $SOURCE\"\n" +
+		"  }\n" +
+		"  \"doc.html\": \"doc.txt\" {\n" +
+		"    \"./format $SOURCE\"\n" +
+		"  }\n" +
+		"  alias(\"all\", [\"app\", \"doc.html\"])\n" +
+		"  alias(\"everything\", \"all\")\n" +
+		"}\n"
+	rt := parseScript(t, "test.fubsy", script)
+	errs := rt.runMainPhase()
+	assert.Equal(t, 0, len(errs))
+	errs = rt.finishGraph()
+	assert.Equal(t, 0, len(errs))
+
+	// nothing has been built, so everything is out of date
+	bdb := db.NewFakeDB()
+	var buf bytes.Buffer
+	errs = rt.describeTargets(&buf, bdb, false, false)
+	assert.Equal(t, 0, len(errs))
+	expect := "" +
+		"TARGET      STATUS       RULE  ACTION\n" +
+		"all         out of date  -     (alias)\n" +
+		"everything  out of date  -     (alias)\n"
+	assert.Equal(t, expect, buf.String())
+
+	buf.Reset()
+	errs = rt.describeTargets(&buf, bdb, true, false)
+	assert.Equal(t, 0, len(errs))
+	expect = "" +
+		"TARGET      STATUS       RULE              ACTION\n" +
+		"app         out of date  test.fubsy:2-4    \"./link $TARGET $SOURCES\"\n" +
+		"app.o       out of date  test.fubsy:5-7    \"./compile $SOURCE\"\n" +
+		"util.o      out of date  test.fubsy:8-10   \"./compile $SOURCE\"\n" +
+		"doc.html    out of date  test.fubsy:11-13  \"./format $SOURCE\"\n" +
+		"all         out of date  -                 (alias)\n" +
+		"everything  out of date  -                 (alias)\n"
+	assert.Equal(t, expect, buf.String())
+
+	buf.Reset()
+	rt.options.Targets = []string{"everything"}
+	errs = rt.describeTargets(&buf, bdb, false, true)
+	assert.Equal(t, 0, len(errs))
+	expect = "" +
+		"TARGET        STATUS       RULE              ACTION\n" +
+		"everything    out of date  -                 (alias)\n" +
+		"  all         out of date  -                 (alias)\n" +
+		"    app       out of date  test.fubsy:2-4    \"./link $TARGET $SOURCES\"\n" +
+		"      app.o   out of date  test.fubsy:5-7    \"./compile $SOURCE\"\n" +
+		"      util.o  out of date  test.fubsy:8-10   \"./compile $SOURCE\"\n" +
+		"    doc.html  out of date  test.fubsy:11-13  \"./format $SOURCE\"\n"
+	assert.Equal(t, expect, buf.String())
+}
@@ -0,0 +1,223 @@
+// Copyright © 2013, Greg Ward. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE.txt file.
+
+package runtime
+
+// Watch mode: build, then wait for source files to change and build
+// again, forever.
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"fubsy/dag"
+	"fubsy/dsl"
+	"fubsy/log"
+	"fubsy/trace"
+)
+
+// something that reports changes to files in a set of directories
+// (implemented with inotify on Linux)
+type watcher interface {
+	// start watching dir (not recursively); watching the same
+	// directory twice is harmless
+	watch(dir string) error
+
+	// the name of every file that changes in a watched directory
+	events() <-chan string
+}
+
+// how long to wait for more changes after seeing one, so that a burst
+// of changes (e.g. a version control checkout, or an editor saving
+// via a temporary file) results in a single rebuild
+var watchDelay = 200 * time.Millisecond
+
+// Build the requested targets, then watch the source files and
+// rebuild whenever they change. Only a change to a build script
+// re-runs the main phase; otherwise, each rebuild reuses the
+// dependency graph from the previous one. Errors from any one build
+// are reported to stderr, and then we keep watching. Only returns if
+// we cannot watch the filesystem at all.
+func (self *Runtime) Watch() []error {
+	watcher, err := newWatcher()
+	if err != nil {
+		return []error{err}
+	}
+
+	errs := self.loadGraph()
+	loaded := len(errs) == 0
+	if loaded {
+		errs = self.runBuildPhase()
+	}
+	reportErrors("error:", errs)
+	log.Info("watching for changes (press Ctrl-C to stop)")
+
+	for {
+		for _, dir := range self.watchDirs() {
+			err = watcher.watch(dir)
+			if err != nil {
+				log.Verbose("not watching %s: %s", dir, err)
+			}
+		}
+
+		changed, ok := collectChanges(watcher.events(), watchDelay)
+		if !ok {
+			return nil
+		}
+		log.Debug(log.BUILD, "changed files: %v", changed)
+
+		if scriptChanged(changed) {
+			log.Info("build script changed: reloading %s", self.script)
+			var ast *dsl.ASTRoot
+			ast, errs = dsl.Parse(self.script)
+			if len(errs) > 0 {
+				reportErrors("parse error:", errs)
+				loaded = false
+				continue
+			}
+			stream := self.events
+			*self = *NewRuntime(self.options, self.script, ast)
+			self.events = stream
+			errs = self.loadGraph()
+			loaded = len(errs) == 0
+		} else if !loaded {
+			// nothing to do until the user fixes the build script
+			continue
+		} else if self.sourcesChanged(changed) {
+			self.dag.Reset()
+			if self.tracer != nil {
+				// each build gets a trace of its own
+				self.tracer = trace.NewTracer()
+			}
+		} else {
+			continue
+		}
+		if loaded {
+			errs = self.runBuildPhase()
+		}
+		reportErrors("error:", errs)
+		log.Info("watching for changes (press Ctrl-C to stop)")
+	}
+}
+
+// Wait for at least one change from events, then keep collecting
+// changes until none arrive for delay. Return the (sorted, unique)
+// names of changed files, or ok=false if events was closed.
+func collectChanges(events <-chan string, delay time.Duration) (
+	changed []string, ok bool) {
+	name, ok := <-events
+	if !ok {
+		return nil, false
+	}
+	seen := map[string]bool{name: true}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+collect:
+	for {
+		select {
+		case name, ok = <-events:
+			if !ok {
+				break collect
+			}
+			seen[name] = true
+			timer.Reset(delay)
+		case <-timer.C:
+			break collect
+		}
+	}
+
+	changed = make([]string, 0, len(seen))
+	for name := range seen {
+		changed = append(changed, name)
+	}
+	sort.Strings(changed)
+	return changed, true
+}
+
+// Return true if any of changed is a build script.
+func scriptChanged(changed []string) bool {
+	for _, name := range changed {
+		if strings.HasSuffix(name, ".fubsy") {
+			return true
+		}
+	}
+	return false
+}
+
+// Return true if the files in changed might make any target out of
+// date: i.e. if any of them is an original source, or is covered by
+// a source FinderNode or DirNode. Changes to other files (notably
+// the targets we just built) are not interesting. An empty name
+// means the watcher lost track, so anything might have changed.
+func (self *Runtime) sourcesChanged(changed []string) bool {
+	for _, name := range changed {
+		if name == "" {
+			return true
+		}
+	}
+	covering, err := self.dag.FindCovering(changed)
+	if err != nil {
+		log.Warning("%s", err)
+		return true
+	}
+	for _, node := range self.dag.NodesIn(covering) {
+		if node.State() == dag.SOURCE {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the directories to watch: the directory containing the build
+// script, and every directory where a change could affect an original
+// source node. Never includes Fubsy's own state directory, which
+// changes on every build.
+func (self *Runtime) watchDirs() []string {
+	dirs := []string{filepath.Dir(self.script)}
+	for _, node := range self.dag.Nodes() {
+		if node.State() != dag.SOURCE {
+			continue
+		}
+		switch node := node.(type) {
+		case *dag.FileNode:
+			dirs = append(dirs, filepath.Dir(node.Name()))
+		case *dag.DirNode:
+			filepath.Walk(node.Name(),
+				func(path string, info os.FileInfo, err error) error {
+					if err == nil && info.IsDir() {
+						dirs = append(dirs, path)
+					}
+					return nil
+				})
+		case *dag.FinderNode:
+			finderdirs, err := node.WatchDirs()
+			if err != nil {
+				log.Warning("%s", err)
+			}
+			dirs = append(dirs, finderdirs...)
+		}
+	}
+
+	result := make([]string, 0, len(dirs))
+	seen := make(map[string]bool)
+	for _, dir := range dirs {
+		if seen[dir] || dir == ".fubsy" || strings.HasPrefix(dir, ".fubsy/") {
+			continue
+		}
+		seen[dir] = true
+		result = append(result, dir)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func reportErrors(prefix string, errs []error) {
+	for _, err := range errs {
+		fmt.Fprintln(os.Stderr, prefix, err)
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright © 2013, Greg Ward. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE.txt file.
+
+package runtime
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchrcom/testify/assert"
+
+	"fubsy/testutils"
+)
+
+func Test_collectChanges(t *testing.T) {
+	events := make(chan string)
+	go func() {
+		events <- "b.c"
+		events <- "a.c"
+		time.Sleep(10 * time.Millisecond)
+		events <- "b.c"
+		close(events)
+	}()
+	changed, ok := collectChanges(events, 100*time.Millisecond)
+	assert.True(t, ok)
+	assert.Equal(t, []string{"a.c", "b.c"}, changed)
+
+	changed, ok = collectChanges(events, 100*time.Millisecond)
+	assert.False(t, ok)
+	assert.Equal(t, 0, len(changed))
+
+	// changes that arrive after the delay are left for next time
+	events = make(chan string, 2)
+	events <- "a.c"
+	changed, ok = collectChanges(events, 10*time.Millisecond)
+	assert.True(t, ok)
+	assert.Equal(t, []string{"a.c"}, changed)
+}
+
+func Test_scriptChanged(t *testing.T) {
+	assert.False(t, scriptChanged([]string{}))
+	assert.False(t, scriptChanged([]string{"a.c", "main.fubsy~"}))
+	assert.True(t, scriptChanged([]string{"a.c", "main.fubsy"}))
+}
+
+func Test_Runtime_watch(t *testing.T) {
+	cleanup := testutils.Chtemp()
+	defer cleanup()
+	testutils.TouchFiles(
+		"src/a.c", "src/sub/b.c", "include/a.h", "doc/x.txt", ".fubsy/db")
+
+	script := "" +
+		"main {\n" +
+		"  \"app\": [\"obj/a.o\", \"obj/b.o\"] {\n" +
+		"    \"./link $TARGET $SOURCES\"\n" +
+		"  }\n" +
+		"  [\"obj/a.o\", \"obj/b.o\"]: <src/**/*.c> + \"include/a.h\" {\n" +
+		"    \"./compile $SOURCES\"\n" +
+		"  }\n" +
+		"}\n"
+	rt := parseScript(t, "test.fubsy", script)
+	testutils.NoErrors(t, rt.runMainPhase())
+	testutils.NoErrors(t, rt.finishGraph())
+
+	assert.Equal(t,
+		[]string{".", "include", "src", "src/sub"}, rt.watchDirs())
+
+	assert.True(t, rt.sourcesChanged([]string{"include/a.h"}))
+	assert.True(t, rt.sourcesChanged([]string{"src/sub/new.c"}))
+	assert.True(t, rt.sourcesChanged([]string{""}))
+	assert.False(t, rt.sourcesChanged([]string{"src/a.o", "doc/x.txt"}))
+	assert.False(t, rt.sourcesChanged([]string{"obj/a.o", "app"}))
+}
@@ -0,0 +1,157 @@
+// Copyright © 2013, Greg Ward. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE.txt file.
+
+package trace
+
+// Package trace records how long things take while Fubsy runs (the
+// main phase, building each node, ...) and writes the results in the
+// Trace Event Format understood by Chrome's about:tracing viewer (and
+// Perfetto, and speedscope, ...). Every span of time belongs to a
+// lane: lane 0 is Fubsy itself, and each parallel build job gets a
+// lane of its own. A nil *Tracer is valid and records nothing, so
+// callers need not check whether tracing is enabled.
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+type Tracer struct {
+	lock   sync.Mutex
+	start  time.Time
+	events []event
+
+	// lane number -> name (shown as the thread name in the viewer)
+	lanes map[int]string
+}
+
+// a single entry in the "traceEvents" array
+type event struct {
+	Name     string            `json:"name"`
+	Category string            `json:"cat,omitempty"`
+	Phase    string            `json:"ph"`
+	Time     int64             `json:"ts"` // microseconds since start
+	Duration int64             `json:"dur"`
+	Pid      int               `json:"pid"`
+	Lane     int               `json:"tid"`
+	Args     map[string]string `json:"args,omitempty"`
+}
+
+// a span of time that has started but not yet ended
+type Span struct {
+	tracer *Tracer
+	event  event
+	start  time.Time
+}
+
+func NewTracer() *Tracer {
+	return &Tracer{
+		start: time.Now(),
+		lanes: map[int]string{0: "fubsy"},
+	}
+}
+
+// Give lane a name to show in the trace viewer.
+func (self *Tracer) NameLane(lane int, name string) {
+	if self == nil {
+		return
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.lanes[lane] = name
+}
+
+// Start timing something called name in lane. category is a short
+// word that groups similar spans (e.g. "phase", "action"). Call End()
+// on the returned Span when the thing is done.
+func (self *Tracer) Begin(lane int, category string, name string) *Span {
+	if self == nil {
+		return nil
+	}
+	return &Span{
+		tracer: self,
+		event:  event{Name: name, Category: category, Phase: "X", Lane: lane},
+		start:  time.Now(),
+	}
+}
+
+// Attach extra information to this span (shown when it's selected in
+// the trace viewer).
+func (self *Span) SetArg(key string, value string) {
+	if self == nil {
+		return
+	}
+	if self.event.Args == nil {
+		self.event.Args = make(map[string]string)
+	}
+	self.event.Args[key] = value
+}
+
+// Stop timing and record this span in its Tracer. Returns the span's
+// duration (zero if tracing is disabled).
+func (self *Span) End() time.Duration {
+	if self == nil {
+		return 0
+	}
+	duration := time.Since(self.start)
+	tracer := self.tracer
+	self.event.Time = int64(self.start.Sub(tracer.start) / time.Microsecond)
+	self.event.Duration = int64(duration / time.Microsecond)
+
+	tracer.lock.Lock()
+	defer tracer.lock.Unlock()
+	tracer.events = append(tracer.events, self.event)
+	return duration
+}
+
+// Write every span recorded so far to writer as a JSON trace.
+func (self *Tracer) Write(writer io.Writer) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	lanes := make([]int, 0, len(self.lanes))
+	for lane := range self.lanes {
+		lanes = append(lanes, lane)
+	}
+	sort.Ints(lanes)
+	events := make([]event, 0, len(lanes)+len(self.events))
+	for _, lane := range lanes {
+		events = append(events, event{
+			Name:  "thread_name",
+			Phase: "M",
+			Lane:  lane,
+			Args:  map[string]string{"name": self.lanes[lane]},
+		})
+	}
+	events = append(events, self.events...)
+
+	trace := struct {
+		TraceEvents     []event `json:"traceEvents"`
+		DisplayTimeUnit string  `json:"displayTimeUnit"`
+	}{events, "ms"}
+	data, err := json.Marshal(trace)
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(append(data, '\n'))
+	return err
+}
+
+// Write the trace to filename (see Write()).
+func (self *Tracer) WriteFile(filename string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	err = self.Write(file)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,67 @@
+// Copyright © 2013, Greg Ward. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can
+// be found in the LICENSE.txt file.
+
+package trace
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchrcom/testify/assert"
+)
+
+func Test_Tracer_nil(t *testing.T) {
+	// a nil Tracer is valid, and does nothing
+	var tracer *Tracer
+	tracer.NameLane(1, "job 1")
+	span := tracer.Begin(0, "phase", "main")
+	assert.Nil(t, span)
+	span.SetArg("foo", "bar")
+	assert.Equal(t, time.Duration(0), span.End())
+}
+
+func Test_Tracer_Write(t *testing.T) {
+	tracer := NewTracer()
+	tracer.NameLane(1, "job 1")
+	outer := tracer.Begin(0, "phase", "build")
+	inner := tracer.Begin(1, "action", "foo.o")
+	inner.SetArg("action", "cc -c foo.c")
+	time.Sleep(2 * time.Millisecond)
+	duration := inner.End()
+	assert.True(t, duration >= 2*time.Millisecond)
+	outer.End()
+
+	buf := &bytes.Buffer{}
+	err := tracer.Write(buf)
+	assert.Nil(t, err)
+
+	var trace struct {
+		TraceEvents []event
+	}
+	err = json.Unmarshal(buf.Bytes(), &trace)
+	assert.Nil(t, err)
+	events := trace.TraceEvents
+	assert.Equal(t, 4, len(events))
+
+	// lane names come first
+	assert.Equal(t, "M", events[0].Phase)
+	assert.Equal(t, 0, events[0].Lane)
+	assert.Equal(t, "fubsy", events[0].Args["name"])
+	assert.Equal(t, 1, events[1].Lane)
+	assert.Equal(t, "job 1", events[1].Args["name"])
+
+	// then spans, in the order they ended
+	assert.Equal(t, "foo.o", events[2].Name)
+	assert.Equal(t, "action", events[2].Category)
+	assert.Equal(t, "X", events[2].Phase)
+	assert.Equal(t, 1, events[2].Lane)
+	assert.Equal(t, "cc -c foo.c", events[2].Args["action"])
+	assert.True(t, events[2].Duration >= 2000)
+	assert.Equal(t, "build", events[3].Name)
+	assert.Equal(t, 0, events[3].Lane)
+	assert.True(t, events[3].Time <= events[2].Time)
+	assert.True(t, events[3].Duration >= events[2].Duration)
+}